@@ -0,0 +1,83 @@
+package ratelimit
+
+import "sync"
+
+// adaptiveSteps is the number of increases it takes an AdaptiveRateLimit to
+// recover from its minimum to its maximum write limit.
+const adaptiveSteps = 10
+
+// AdaptiveRateLimit is a RateLimit whose write limit adapts to feedback about
+// congestion using additive increase and multiplicative decrease (AIMD). Every
+// signal of congestion halves the write limit while every signal of success
+// increases it by a fixed step. That way the limit converges towards the
+// capacity of the link. The write limit always stays within [min, max].
+type AdaptiveRateLimit struct {
+	*RateLimit
+
+	min  int64
+	max  int64
+	step int64
+
+	mu sync.Mutex // serializes adjustments.
+}
+
+// NewAdaptiveRateLimit creates a new AdaptiveRateLimit with a write limit of
+// start bytes per second which adapts within [min, max]. Reads are unlimited.
+// The additive step is a tenth of the range between min and max. Since a
+// limit of 0 means unlimited, min is at least 1.
+func NewAdaptiveRateLimit(start, min, max int64, packetSize uint64) *AdaptiveRateLimit {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	step := (max - min) / adaptiveSteps
+	if step < 1 {
+		step = 1
+	}
+	return &AdaptiveRateLimit{
+		RateLimit: NewRateLimit(0, clampBPS(start, min, max), packetSize),
+		min:       min,
+		max:       max,
+		step:      step,
+	}
+}
+
+// Increase signals that writes succeeded and increases the write limit by
+// the additive step. It takes effect immediately, even for writes that are
+// already waiting.
+func (arl *AdaptiveRateLimit) Increase() {
+	arl.mu.Lock()
+	defer arl.mu.Unlock()
+	arl.SetWriteBPS(clampBPS(arl.WriteBPS()+arl.step, arl.min, arl.max))
+}
+
+// Decrease signals congestion and halves the write limit. It takes effect
+// immediately, even for writes that are already waiting.
+func (arl *AdaptiveRateLimit) Decrease() {
+	arl.mu.Lock()
+	defer arl.mu.Unlock()
+	arl.SetWriteBPS(clampBPS(arl.WriteBPS()/2, arl.min, arl.max))
+}
+
+// Feedback adjusts the write limit according to the outcome of a write. An
+// error is treated as a signal of congestion, otherwise the limit increases.
+func (arl *AdaptiveRateLimit) Feedback(err error) {
+	if err != nil {
+		arl.Decrease()
+	} else {
+		arl.Increase()
+	}
+}
+
+// clampBPS limits bps to the range [min, max].
+func clampBPS(bps, min, max int64) int64 {
+	if bps < min {
+		return min
+	}
+	if bps > max {
+		return max
+	}
+	return bps
+}
@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestAdaptiveRateLimit tests that an AdaptiveRateLimit halves its write limit
+// on congestion and recovers additively.
+func TestAdaptiveRateLimit(t *testing.T) {
+	arl := NewAdaptiveRateLimit(1000, 100, 1000, 10)
+	if arl.WriteBPS() != 1000 || arl.ReadBPS() != 0 {
+		t.Fatal("wrong initial limits", arl.WriteBPS(), arl.ReadBPS())
+	}
+
+	// Congestion halves the limit until it reaches the minimum.
+	for _, expected := range []int64{500, 250, 125, 100, 100} {
+		arl.Decrease()
+		if arl.WriteBPS() != expected {
+			t.Fatal("wrong limit after decrease", arl.WriteBPS(), expected)
+		}
+	}
+
+	// It recovers in steps of 90 up to the maximum.
+	for i := int64(1); i <= adaptiveSteps; i++ {
+		arl.Feedback(nil)
+		if arl.WriteBPS() != 100+90*i {
+			t.Fatal("wrong limit after increase", arl.WriteBPS(), i)
+		}
+	}
+	arl.Increase()
+	if arl.WriteBPS() != 1000 {
+		t.Fatal("limit exceeded the maximum", arl.WriteBPS())
+	}
+	arl.Feedback(errors.New("write failed"))
+	if arl.WriteBPS() != 500 {
+		t.Fatal("error didn't decrease the limit", arl.WriteBPS())
+	}
+
+	// The start is clamped and the limit never becomes unlimited.
+	arl = NewAdaptiveRateLimit(5000, 0, 1000, 10)
+	if arl.WriteBPS() != 1000 {
+		t.Fatal("start wasn't clamped", arl.WriteBPS())
+	}
+	for i := 0; i < 20; i++ {
+		arl.Decrease()
+	}
+	if arl.WriteBPS() != 1 {
+		t.Fatal("limit should be at least 1", arl.WriteBPS())
+	}
+}
@@ -0,0 +1,97 @@
+package ratelimit
+
+import "io"
+
+type (
+	// rlReaderAt is a rate-limiting wrapper for the io.ReaderAt interface.
+	rlReaderAt struct {
+		r    io.ReaderAt
+		rlrw *RLReadWriter
+	}
+
+	// rlWriterAt is a rate-limiting wrapper for the io.WriterAt interface.
+	rlWriterAt struct {
+		w    io.WriterAt
+		rlrw *RLReadWriter
+	}
+)
+
+// NewRLReaderAt wraps a io.ReaderAt into a rlReaderAt which is limited by the
+// read limit of the global rate limiter. Closing cancel interrupts all pending
+// reads.
+func NewRLReaderAt(r io.ReaderAt, rl Limiter, cancel <-chan struct{}) io.ReaderAt {
+	return &rlReaderAt{
+		r:    r,
+		rlrw: NewRLReadWriter(nil, rl, cancel),
+	}
+}
+
+// NewRLWriterAt wraps a io.WriterAt into a rlWriterAt which is limited by the
+// write limit of the global rate limiter. Closing cancel interrupts all
+// pending writes.
+func NewRLWriterAt(w io.WriterAt, rl Limiter, cancel <-chan struct{}) io.WriterAt {
+	return &rlWriterAt{
+		w:    w,
+		rlrw: NewRLReadWriter(nil, rl, cancel),
+	}
+}
+
+// ReadAt reads len(p) bytes starting at offset off from the underlying
+// io.ReaderAt with the maximum possible speed allowed by the rateLimit. Every
+// packet is read at its own offset and only the bytes that were actually read
+// are charged. Like io.ReaderAt, it returns a non-nil error if it reads fewer
+// than len(p) bytes.
+func (r *rlReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	defer r.rlrw.end(r.rlrw.begin())
+	for len(p) > 0 {
+		data := p
+		if packetSize := r.rlrw.packetSize(DirectionRead); packetSize > 0 && uint64(len(data)) > packetSize {
+			data = data[:packetSize]
+		}
+		var read int
+		read, err = r.rlrw.transferPacket(DirectionRead, data, func(b []byte) (int, error) {
+			return r.r.ReadAt(b, off+int64(n))
+		})
+		p = p[read:]
+		n += read
+		if err != nil {
+			return
+		}
+		// The underlying io.ReaderAt is required to return an error if it
+		// didn't fill the packet.
+		if read < len(data) {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	return
+}
+
+// WriteAt writes len(p) bytes starting at offset off to the underlying
+// io.WriterAt with the maximum possible speed allowed by the rateLimit. Every
+// packet is written at its own offset and only the bytes that were actually
+// written are charged. Like io.WriterAt, it returns a non-nil error if it
+// writes fewer than len(p) bytes.
+func (w *rlWriterAt) WriteAt(p []byte, off int64) (n int, err error) {
+	defer w.rlrw.end(w.rlrw.begin())
+	for len(p) > 0 {
+		data := p
+		if packetSize := w.rlrw.packetSize(DirectionWrite); packetSize > 0 && uint64(len(data)) > packetSize {
+			data = data[:packetSize]
+		}
+		var written int
+		written, err = w.rlrw.transferPacket(DirectionWrite, data, func(b []byte) (int, error) {
+			return w.w.WriteAt(b, off+int64(n))
+		})
+		p = p[written:]
+		n += written
+		if err != nil {
+			return
+		}
+		// The underlying io.WriterAt is required to return an error if it
+		// didn't write the whole packet.
+		if written < len(data) {
+			return n, io.ErrShortWrite
+		}
+	}
+	return
+}
@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+)
+
+// bufferAt is an in-memory io.WriterAt.
+type bufferAt struct {
+	b []byte
+}
+
+// WriteAt implements io.WriterAt.
+func (b *bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(b.b) {
+		b.b = append(b.b, make([]byte, end-len(b.b))...)
+	}
+	return copy(b.b[off:], p), nil
+}
+
+// TestRLReaderAt tests reading from a rlReaderAt.
+func TestRLReaderAt(t *testing.T) {
+	data := fastrand.Bytes(1000)
+	rl := NewRateLimit(1000, 0, 100)
+	r := NewRLReaderAt(bytes.NewReader(data), rl, nil)
+
+	// Reading 3 packets at an offset waits for 2 of them.
+	start := time.Now()
+	buf := make([]byte, 300)
+	n, err := r.ReadAt(buf, 450)
+	if err != nil || n != len(buf) {
+		t.Fatal("read failed", n, err)
+	}
+	if !bytes.Equal(buf, data[450:750]) {
+		t.Fatal("wrong data")
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatal("read wasn't limited", d)
+	}
+
+	// Reading past the end returns the available bytes together with an
+	// error and is only charged for them.
+	rl = NewRateLimit(0, 0, 100)
+	r = NewRLReaderAt(bytes.NewReader(data), rl, nil)
+	n, err = r.ReadAt(buf, 850)
+	if err != io.EOF || n != 150 {
+		t.Fatal("expected EOF", n, err)
+	}
+	if !bytes.Equal(buf[:n], data[850:]) {
+		t.Fatal("wrong data")
+	}
+	if stats := rl.Stats(); stats.BytesRead != 150 {
+		t.Fatal("wrong number of bytes read", stats.BytesRead)
+	}
+}
+
+// TestRLWriterAt tests writing to a rlWriterAt.
+func TestRLWriterAt(t *testing.T) {
+	data := fastrand.Bytes(300)
+	rl := NewRateLimit(0, 1000, 100)
+	b := &bufferAt{}
+	w := NewRLWriterAt(b, rl, nil)
+
+	// Writing 3 packets at an offset waits for 2 of them.
+	start := time.Now()
+	n, err := w.WriteAt(data, 200)
+	if err != nil || n != len(data) {
+		t.Fatal("write failed", n, err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatal("write wasn't limited", d)
+	}
+	if len(b.b) != 500 || !bytes.Equal(b.b[200:], data) {
+		t.Fatal("wrong data")
+	}
+	if stats := rl.Stats(); stats.BytesWritten != uint64(len(data)) {
+		t.Fatal("wrong number of bytes written", stats.BytesWritten)
+	}
+}
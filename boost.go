@@ -0,0 +1,73 @@
+package ratelimit
+
+import "time"
+
+// boost is a temporary raise of the limits of a RateLimit which is reverted
+// once its timer fires.
+type boost struct {
+	readBPS  int64 // the read limit to restore.
+	writeBPS int64 // the write limit to restore.
+	stop     chan struct{}
+}
+
+// Boost temporarily sets the limits of the RateLimit to readBPS and writeBPS
+// for d. Afterwards the previous limits are restored. If another Boost is
+// still in effect, the last Boost wins: its limits replace the ones of the
+// previous Boost, d starts over and the limits from before the first Boost
+// are restored once it expires. Limits set by other means during a Boost are
+// overwritten when it expires. A bps of 0 removes the limit for the duration
+// of the Boost.
+func (rl *RateLimit) Boost(readBPS, writeBPS int64, d time.Duration) {
+	rl.boostMu.Lock()
+	defer rl.boostMu.Unlock()
+	b := &boost{
+		readBPS:  rl.ReadBPS(),
+		writeBPS: rl.WriteBPS(),
+		stop:     make(chan struct{}),
+	}
+	if rl.boost != nil {
+		b.readBPS, b.writeBPS = rl.boost.readBPS, rl.boost.writeBPS
+		close(rl.boost.stop)
+	}
+	rl.boost = b
+	rl.SetReadBPS(readBPS)
+	rl.SetWriteBPS(writeBPS)
+	rl.debugf("boosted limits to %v/%v bps for %v", readBPS, writeBPS, d)
+	go rl.threadedRevert(b, rl.clock.NewTimer(d))
+}
+
+// Close ends a Boost that is still in effect right away and restores the
+// limits from before the Boost. The RateLimit can still be used afterwards.
+func (rl *RateLimit) Close() error {
+	rl.boostMu.Lock()
+	defer rl.boostMu.Unlock()
+	if b := rl.boost; b != nil {
+		close(b.stop)
+		rl.boost = nil
+		rl.SetReadBPS(b.readBPS)
+		rl.SetWriteBPS(b.writeBPS)
+		rl.debugf("boost closed, restored limits to %v/%v bps", b.readBPS, b.writeBPS)
+	}
+	return nil
+}
+
+// threadedRevert restores the limits from before the boost b once timer
+// fires unless b is replaced or canceled before that.
+func (rl *RateLimit) threadedRevert(b *boost, timer Timer) {
+	defer timer.Stop()
+	select {
+	case <-b.stop:
+		return
+	case <-timer.C():
+	}
+
+	rl.boostMu.Lock()
+	defer rl.boostMu.Unlock()
+	if rl.boost != b {
+		return
+	}
+	rl.boost = nil
+	rl.SetReadBPS(b.readBPS)
+	rl.SetWriteBPS(b.writeBPS)
+	rl.debugf("boost expired, restored limits to %v/%v bps", b.readBPS, b.writeBPS)
+}
@@ -0,0 +1,104 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// TestBoost tests that a Boost raises the throughput until it expires.
+func TestBoost(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	packetSize := uint64(100)
+	rl := NewRateLimit(1000, 1000, packetSize)
+	rlc := NewRLReadWriter(&spyReadWriter{}, rl, nil)
+
+	// write writes 5 packets and returns how long it took.
+	write := func() time.Duration {
+		start := time.Now()
+		if _, err := rlc.Write(make([]byte, 5*packetSize)); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+
+	// While boosted, the packets are paced at the higher limit.
+	rl.Boost(10000, 10000, 300*time.Millisecond)
+	if rl.ReadBPS() != 10000 || rl.WriteBPS() != 10000 {
+		t.Fatal("limits weren't boosted", rl.ReadBPS(), rl.WriteBPS())
+	}
+	if d := write(); d > 100*time.Millisecond {
+		t.Fatal("boosted write was too slow", d)
+	}
+
+	// Once the boost expires, the previous limits are restored.
+	time.Sleep(350 * time.Millisecond)
+	if rl.ReadBPS() != 1000 || rl.WriteBPS() != 1000 {
+		t.Fatal("limits weren't restored", rl.ReadBPS(), rl.WriteBPS())
+	}
+	write()
+	if d := write(); d < 450*time.Millisecond {
+		t.Fatal("write after boost wasn't paced", d)
+	}
+}
+
+// TestBoostOverride tests that the last Boost wins and that Close ends a Boost
+// early.
+func TestBoostOverride(t *testing.T) {
+	clock := newFakeClock()
+	rl := NewRateLimitWithOptions(WithReadBPS(1000), WithWriteBPS(2000), WithClock(clock))
+
+	// waitLimits waits for the limits to become the expected ones.
+	waitLimits := func(readBPS, writeBPS int64) {
+		t.Helper()
+		for i := 0; rl.ReadBPS() != readBPS || rl.WriteBPS() != writeBPS; i++ {
+			if i == 1000 {
+				t.Fatal("wrong limits", rl.ReadBPS(), rl.WriteBPS())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// waitPending waits for the revert to start its timer.
+	waitPending := func() {
+		for clock.Pending() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The second Boost replaces the first one and restarts the duration. The
+	// limits from before the first Boost are restored.
+	rl.Boost(3000, 4000, time.Second)
+	waitPending()
+	clock.Advance(500 * time.Millisecond)
+	rl.Boost(5000, 6000, time.Second)
+	waitLimits(5000, 6000)
+	clock.Advance(500 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	waitLimits(5000, 6000)
+	waitPending()
+	clock.Advance(500 * time.Millisecond)
+	waitLimits(1000, 2000)
+
+	// Closing the RateLimit restores the limits right away and the expiry
+	// of the closed Boost doesn't change them anymore.
+	rl.Boost(3000, 4000, time.Second)
+	waitPending()
+	if err := rl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rl.ReadBPS() != 1000 || rl.WriteBPS() != 2000 {
+		t.Fatal("limits weren't restored", rl.ReadBPS(), rl.WriteBPS())
+	}
+	rl.SetReadBPS(1500)
+	rl.SetWriteBPS(2500)
+	clock.Advance(time.Second)
+	time.Sleep(10 * time.Millisecond)
+	waitLimits(1500, 2500)
+
+	// Closing without a Boost is a no-op.
+	if err := rl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitLimits(1500, 2500)
+}
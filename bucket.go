@@ -0,0 +1,624 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+)
+
+// maxDuration is the longest duration the pacing arithmetic produces.
+const maxDuration = time.Duration(math.MaxInt64)
+
+// ErrLimitTooLow is returned when honoring the rate limit would require a
+// single read or write to wait for longer than the maximum block duration of
+// the RateLimit.
+var ErrLimitTooLow = errors.New("rate limit too low")
+
+// maxOvertakes is the number of callers with a higher priority that can get in
+// line in front of a waiting caller.
+const maxOvertakes = 8
+
+// timerSlack is how late a timer may fire before a bucket credits the caller
+// for the time it lost.
+const timerSlack = 2 * time.Millisecond
+
+type (
+	// bucket paces the data flowing in a single direction. Callers queue up in
+	// the order of their flows' priorities and start tags and the caller at
+	// the front of the queue has to wait until block before it can start its
+	// read or write operation. Callers with the same priority and start tag
+	// are served in the order they arrive. Each
+	// caller also pushes block into the future to prevent the callers behind
+	// it from reading or writing prematurely. While the bucket is idle, block
+	// falls behind the current time by up to the time it takes to transfer
+	// burst bytes which allows for bursting after being idle.
+	bucket struct {
+		atomicBPS    int64 // the bytes per second that can be transferred.
+		atomicPaused int32 // whether the bucket is paused, 1 if it is.
+
+		clock    Clock         // the source of time.
+		maxBlock time.Duration // the longest a caller may wait, 0 for no limit.
+		jitter   float64       // the fraction by which charges are randomized.
+		minSleep time.Duration // callers don't sleep for less than this.
+
+		mu    sync.Mutex
+		burst uint64    // the number of bytes that can be accumulated while idle.
+		warm  bool      // whether the bucket still holds the initial fill.
+		block time.Time // timestamp before which no new transfer can start.
+		last  time.Time // the last time the bucket looked at the clock.
+		pause time.Time // the time the bucket was paused.
+		vtime float64   // the start tag of the last caller that was served.
+		queue []*waiter // callers waiting for their turn.
+
+		waiters sync.Pool // waiters that can be reused.
+	}
+
+	// waiter is a caller queued up in a bucket. Waiters are reused to avoid
+	// allocating a new channel and timer every time a caller has to wait. A
+	// stale signal left over from a previous use only causes the waiter to
+	// re-evaluate its wait.
+	waiter struct {
+		wake      chan struct{} // signals the waiter to re-evaluate its wait.
+		timer     Timer         // wakes up the waiter at the front of the queue.
+		armed     bool          // whether timer is running.
+		start     float64       // the start tag of the caller's flow.
+		priority  Priority      // the priority of the caller's flow.
+		overtaken int           // the number of callers that got in line in front.
+	}
+)
+
+// newBucket creates a new, empty bucket with the provided bandwidth, burst
+// and clock.
+func newBucket(bps int64, burst uint64, clock Clock) *bucket {
+	now := clock.Now()
+	return &bucket{
+		atomicBPS: bps,
+		burst:     burst,
+		clock:     clock,
+		block:     now,
+		last:      now,
+	}
+}
+
+// bps returns the current bandwidth of the bucket.
+func (b *bucket) bps() int64 {
+	return atomic.LoadInt64(&b.atomicBPS)
+}
+
+// setBPS updates the bandwidth of the bucket. The time that is still owed for
+// previous transfers is rescaled to the new bandwidth and the caller at the
+// front of the queue is woken up to re-evaluate its wait.
+func (b *bucket) setBPS(bps int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old := atomic.SwapInt64(&b.atomicBPS, bps)
+	if old == bps {
+		return
+	}
+	now := b.now()
+	if old == 0 || bps == 0 {
+		// Transfers are not accounted for while there is no limit.
+		b.block = now
+	} else {
+		// Rescale the time that is owed or accumulated.
+		b.clamp(now, old)
+		remaining := float64(b.block.Sub(now)) * float64(old) / float64(bps)
+		b.block = now.Add(time.Duration(clampInt64(remaining)))
+	}
+	b.wakeHead()
+}
+
+// burstSize returns the number of bytes the bucket can accumulate while idle.
+func (b *bucket) burstSize() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.burst
+}
+
+// setBurst updates the number of bytes the bucket can accumulate while idle.
+func (b *bucket) setBurst(burst uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.burst = burst
+}
+
+// paused returns whether the bucket is paused.
+func (b *bucket) paused() bool {
+	return atomic.LoadInt32(&b.atomicPaused) == 1
+}
+
+// setPaused pauses or resumes the bucket. While the bucket is paused, no
+// transfers can start and time stands still for the bucket. That way it
+// neither pays off previous transfers nor accumulates a burst.
+func (b *bucket) setPaused(paused bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if paused == b.paused() {
+		return
+	}
+	if paused {
+		b.pause = b.now()
+		atomic.StoreInt32(&b.atomicPaused, 1)
+		return
+	}
+	atomic.StoreInt32(&b.atomicPaused, 0)
+	now := b.now()
+	b.block = b.block.Add(now.Sub(b.pause))
+	b.wakeHead()
+}
+
+// reset resets the bucket to the state of a newly created one. Callers that
+// are waiting will re-evaluate their wait.
+func (b *bucket) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.block = b.now()
+	b.wakeHead()
+}
+
+// fill fills the bucket as if it had been idle. Until the fill is used up,
+// the bucket holds the larger of its burst and one second's worth of bytes.
+func (b *bucket) fill() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	full := duration(b.burst, b.bps())
+	if full < time.Second {
+		full = time.Second
+	}
+	b.warm = true
+	b.block = b.now().Add(-full)
+}
+
+// available returns the number of bytes that were accumulated while the
+// bucket was idle. It is negative if the bucket still owes time for previous
+// transfers and math.MaxInt64 if there is no limit.
+func (b *bucket) available() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bps := b.bps()
+	if bps == 0 {
+		return math.MaxInt64
+	}
+	now := b.now()
+	b.clamp(now, bps)
+	return transferable(now.Sub(b.block), bps)
+}
+
+// eta returns how long it takes until the bucket has accumulated n bytes
+// including the bytes that are already available.
+func (b *bucket) eta(n int64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bps := b.bps()
+	if bps == 0 || n <= 0 {
+		return 0
+	}
+	now := b.now()
+	b.clamp(now, bps)
+	if d := b.block.Add(duration(uint64(n), bps)).Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// untilReady returns how long it takes until a transfer can start without
+// waiting. Unlike eta, it doesn't wait for the bucket to accumulate the
+// bytes of the transfer.
+func (b *bucket) untilReady() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.bps() == 0 {
+		return 0
+	}
+	if d := b.block.Sub(b.now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// allow charges the bucket for n bytes if they are available right away. It
+// returns whether the bucket was charged.
+func (b *bucket) allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.paused() {
+		return false
+	}
+	bps := b.bps()
+	if bps == 0 {
+		return true
+	}
+	// Don't skip the line.
+	if len(b.queue) > 0 {
+		return false
+	}
+	now := b.now()
+	b.clamp(now, bps)
+	if transferable(now.Sub(b.block), bps) < int64(n) {
+		return false
+	}
+	b.charge(n)
+	return true
+}
+
+// reserve charges the bucket for n bytes and returns how long it takes until
+// the bucket has accumulated them.
+func (b *bucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.bps() == 0 {
+		return 0
+	}
+	b.charge(n)
+	if d := b.block.Sub(b.now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// try charges the bucket for n bytes if a transfer can start right away
+// without waiting. It returns whether the bucket was charged. Like a transfer
+// that had to wait, the transfer is paid for by the callers after it.
+func (b *bucket) try(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.paused() {
+		return false
+	}
+	if b.bps() == 0 {
+		return true
+	}
+	if len(b.queue) > 0 || !b.ready() {
+		return false
+	}
+	b.serve(b.vtime, n)
+	return true
+}
+
+// refund returns n bytes that the bucket was charged for but that weren't
+// transferred. The caller at the front of the queue is woken up to
+// re-evaluate its wait.
+func (b *bucket) refund(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bps := b.bps()
+	if bps == 0 {
+		return
+	}
+	b.block = b.block.Add(-duration(uint64(n), bps))
+	b.clamp(b.now(), bps)
+	b.wakeHead()
+}
+
+// wait blocks until the caller is allowed to transfer n bytes as part of flow
+// f and charges the bucket for them. It returns how long the caller had to
+// wait. If ctx is done before that, ctx.Err() is returned. If expired is closed
+// before that, ErrDeadlineExceeded is returned. If the caller would have to
+// wait for longer than maxBlock, ErrLimitTooLow is returned.
+func (b *bucket) wait(ctx context.Context, n int, expired <-chan struct{}, f *flow) (time.Duration, error) {
+	// If bps is 0 there is no limit.
+	bps := b.bps()
+	if bps == 0 && !b.paused() {
+		return 0, nil
+	}
+	// Transfers that take longer than maxBlock on their own would block the
+	// next caller for too long.
+	if b.maxBlock > 0 && duration(uint64(n), bps) > b.maxBlock {
+		return 0, ErrLimitTooLow
+	}
+
+	b.mu.Lock()
+	tag, priority := f.start(b, n), f.priorityOf()
+	// If nobody is waiting and the block is in the past we can start right
+	// away.
+	if len(b.queue) == 0 && b.ready() {
+		b.serve(tag, n)
+		b.mu.Unlock()
+		return 0, nil
+	}
+
+	// Otherwise we get in line.
+	start := b.now()
+	w := b.getWaiter()
+	w.start, w.priority = tag, priority
+	b.enqueue(w)
+	for {
+		// Only the caller at the front of the queue watches the clock. Everyone
+		// else waits for their turn unless their wait is limited by maxBlock.
+		var timeout <-chan time.Time
+		var err error
+		if b.queue[0] == w {
+			if b.ready() {
+				late := b.now().Sub(b.block)
+				b.queue = append(b.queue[:0], b.queue[1:]...)
+				b.serve(w.start, n)
+				b.credit(late, n)
+				b.wakeHead()
+				b.mu.Unlock()
+				b.putWaiter(w)
+				return b.since(start), nil
+			}
+			d := b.block.Sub(b.now())
+			switch {
+			case b.paused():
+				// While paused, the caller waits to be woken up on resume.
+			case b.maxBlock > 0 && b.since(start)+d > b.maxBlock:
+				err = ErrLimitTooLow
+			default:
+				timeout = w.startTimer(b.clock, d)
+			}
+		} else if b.maxBlock > 0 && !b.paused() {
+			d := b.maxBlock - b.since(start)
+			if d <= 0 {
+				err = ErrLimitTooLow
+			} else {
+				timeout = w.startTimer(b.clock, d)
+			}
+		}
+
+		// Sleep until it is our turn or something changed.
+		if err == nil {
+			b.mu.Unlock()
+			select {
+			case <-timeout:
+				w.armed = false
+			case <-w.wake:
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-expired:
+				err = ErrDeadlineExceeded
+			}
+			w.stopTimer()
+			b.mu.Lock()
+		}
+		if err != nil {
+			b.remove(w)
+			b.mu.Unlock()
+			b.putWaiter(w)
+			return b.since(start), err
+		}
+	}
+}
+
+// now returns the current time. If the clock jumped backwards since the last
+// time the bucket looked at it, the block is moved back by the same amount to
+// prevent absurdly long waits. Jumps forward are limited by the burst. While
+// the bucket is paused, now returns the time it was paused. b.mu must be held
+// by the caller.
+func (b *bucket) now() time.Time {
+	now := b.clock.Now()
+	if now.Before(b.last) {
+		b.block = b.block.Add(now.Sub(b.last))
+		b.pause = b.pause.Add(now.Sub(b.last))
+	}
+	b.last = now
+	if b.paused() {
+		return b.pause
+	}
+	return now
+}
+
+// since returns the time that passed since start. It is never negative.
+func (b *bucket) since(start time.Time) time.Duration {
+	if d := b.clock.Now().Sub(start); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// ready returns whether a new transfer can start right now. Transfers may
+// start up to minSleep early to coalesce tiny waits into fewer, longer ones.
+// b.mu must be held by the caller.
+func (b *bucket) ready() bool {
+	if b.paused() {
+		return false
+	}
+	return b.bps() == 0 || !b.block.After(b.now().Add(b.minSleep))
+}
+
+// charge pushes the block into the future by the time it takes to transfer n
+// bytes. b.mu must be held by the caller.
+func (b *bucket) charge(n int) {
+	bps := b.bps()
+	if bps == 0 {
+		return
+	}
+	b.clamp(b.now(), bps)
+	b.block = b.block.Add(b.jittered(duration(uint64(n), bps)))
+}
+
+// credit credits a caller that started its transfer of n bytes late by
+// moving the block back by the time it lost. Otherwise sleeps that return
+// late, e.g. on a loaded system, would make the throughput drift below the
+// limit. Lateness within the burst is already kept by the block. Lateness of
+// up to timerSlack is the usual imprecision of timers and isn't credited, so
+// transfers are never spaced closer than the limit because of it. The credit
+// is limited to the time it takes to transfer n bytes to prevent bursts. b.mu
+// must be held by the caller.
+func (b *bucket) credit(late time.Duration, n int) {
+	bps := b.bps()
+	late -= duration(b.burst, bps)
+	if late <= timerSlack {
+		return
+	}
+	if d := duration(uint64(n), bps); late > d {
+		late = d
+	}
+	b.block = b.block.Add(-late)
+}
+
+// jittered randomizes d by up to the jitter fraction of d in either
+// direction. The randomization averages out over many transfers, so the
+// throughput stays the same in the long run.
+func (b *bucket) jittered(d time.Duration) time.Duration {
+	if b.jitter <= 0 || d <= 0 {
+		return d
+	}
+	// u is uniformly distributed in [-1, 1).
+	u := float64(fastrand.Uint64n(1<<53))/(1<<52) - 1
+	return d + time.Duration(float64(d)*b.jitter*u)
+}
+
+// serve charges the bucket for n bytes transferred by a caller with the
+// provided start tag and advances the bucket's virtual time. b.mu must be held
+// by the caller.
+func (b *bucket) serve(start float64, n int) {
+	if start > b.vtime {
+		b.vtime = start
+	}
+	b.charge(n)
+}
+
+// clamp makes sure that the block doesn't fall behind now by more than the
+// time it takes to transfer burst bytes or one second while the bucket still
+// holds its initial fill. b.mu must be held by the caller.
+func (b *bucket) clamp(now time.Time, bps int64) {
+	burst := duration(b.burst, bps)
+	if b.warm {
+		if now.Sub(b.block) <= burst {
+			// The initial fill was used up.
+			b.warm = false
+		} else if burst < time.Second {
+			burst = time.Second
+		}
+	}
+	if earliest := now.Add(-burst); b.block.Before(earliest) {
+		b.block = earliest
+	}
+}
+
+// getWaiter returns an unused waiter.
+func (b *bucket) getWaiter() *waiter {
+	if w, ok := b.waiters.Get().(*waiter); ok {
+		return w
+	}
+	return &waiter{wake: make(chan struct{}, 1)}
+}
+
+// putWaiter returns a waiter that is no longer queued up for reuse.
+func (b *bucket) putWaiter(w *waiter) {
+	select {
+	case <-w.wake:
+	default:
+	}
+	b.waiters.Put(w)
+}
+
+// startTimer starts the waiter's timer to fire after d and returns the channel
+// the timer fires on.
+func (w *waiter) startTimer(clock Clock, d time.Duration) <-chan time.Time {
+	if w.timer == nil {
+		w.timer = clock.NewTimer(d)
+	} else {
+		w.timer.Reset(d)
+	}
+	w.armed = true
+	return w.timer.C()
+}
+
+// stopTimer stops the waiter's timer if it is running.
+func (w *waiter) stopTimer() {
+	if !w.armed {
+		return
+	}
+	w.armed = false
+	if !w.timer.Stop() {
+		select {
+		case <-w.timer.C():
+		default:
+		}
+	}
+}
+
+// enqueue inserts a waiter into the queue behind all the waiters with a higher
+// priority and the waiters with the same priority and the same or an earlier
+// start tag. To prevent starvation, a waiter can't be overtaken by more than
+// maxOvertakes waiters with a higher priority. b.mu must be held by the caller.
+func (b *bucket) enqueue(w *waiter) {
+	w.overtaken = 0
+	i := len(b.queue)
+	for ; i > 0; i-- {
+		prev := b.queue[i-1]
+		if prev.priority > w.priority || (prev.priority == w.priority && prev.start <= w.start) {
+			break
+		}
+		if prev.priority < w.priority && prev.overtaken >= maxOvertakes {
+			break
+		}
+	}
+	for _, prev := range b.queue[i:] {
+		if prev.priority < w.priority {
+			prev.overtaken++
+		}
+	}
+	b.queue = append(b.queue, nil)
+	copy(b.queue[i+1:], b.queue[i:])
+	b.queue[i] = w
+}
+
+// remove removes a waiter from the queue. b.mu must be held by the caller.
+func (b *bucket) remove(w *waiter) {
+	for i := range b.queue {
+		if b.queue[i] != w {
+			continue
+		}
+		b.queue = append(b.queue[:i], b.queue[i+1:]...)
+		if i == 0 {
+			b.wakeHead()
+		}
+		return
+	}
+}
+
+// wakeHead signals the caller at the front of the queue to re-evaluate its
+// wait. b.mu must be held by the caller.
+func (b *bucket) wakeHead() {
+	if len(b.queue) == 0 {
+		return
+	}
+	select {
+	case b.queue[0].wake <- struct{}{}:
+	default:
+	}
+}
+
+// duration returns the time it takes to transfer n bytes with the provided
+// bps. The intermediate product of n and time.Second is computed with 128
+// bits to avoid overflows and the result is capped at maxDuration.
+func duration(n uint64, bps int64) time.Duration {
+	if bps <= 0 {
+		return 0
+	}
+	hi, lo := bits.Mul64(n, uint64(time.Second))
+	if hi >= uint64(bps) {
+		return maxDuration
+	}
+	d, _ := bits.Div64(hi, lo, uint64(bps))
+	if d > uint64(maxDuration) {
+		return maxDuration
+	}
+	return time.Duration(d)
+}
+
+// transferable returns the number of bytes that can be transferred within d
+// with the provided bps. The result is capped to the range of an int64.
+func transferable(d time.Duration, bps int64) int64 {
+	return clampInt64(float64(d) * float64(bps) / float64(time.Second))
+}
+
+// clampInt64 converts f to an int64, capping it to the range of an int64.
+func clampInt64(f float64) int64 {
+	if f >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	if f <= math.MinInt64 {
+		return math.MinInt64
+	}
+	return int64(f)
+}
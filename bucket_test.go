@@ -0,0 +1,255 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestDuration tests that the pacing arithmetic doesn't overflow.
+func TestDuration(t *testing.T) {
+	tests := []struct {
+		n        uint64
+		bps      int64
+		expected time.Duration
+	}{
+		{0, 1000, 0},
+		{1000, 1000, time.Second},
+		{1, 3, 333333333},
+		{1 << 30, 1250000000, 858993459},     // 1GiB at 10Gbit/s
+		{1 << 40, 1250000000, 879609302220},  // 1TiB at 10Gbit/s
+		{1e12, 1e9, 1000 * time.Second},      // n * time.Second overflows int64
+		{1, math.MaxInt64, 0},                // bps larger than time.Second
+		{math.MaxInt64, 1, maxDuration},      // result overflows int64
+		{math.MaxUint64, 1, maxDuration},     // product overflows 128 bits
+		{math.MaxUint64, math.MaxInt64, 2e9}, // huge n and bps
+		{1000, 0, 0},
+		{1000, -1, 0},
+	}
+	for _, test := range tests {
+		if d := duration(test.n, test.bps); d != test.expected {
+			t.Errorf("duration(%v, %v): expected %v but got %v", test.n, test.bps, test.expected, d)
+		}
+	}
+}
+
+// TestTransferable tests that converting durations to bytes doesn't
+// overflow.
+func TestTransferable(t *testing.T) {
+	if n := transferable(time.Second, 1000); n != 1000 {
+		t.Fatal("wrong number of bytes", n)
+	}
+	if n := transferable(-time.Second, 1000); n != -1000 {
+		t.Fatal("wrong number of bytes", n)
+	}
+	if n := transferable(maxDuration, math.MaxInt64); n != math.MaxInt64 {
+		t.Fatal("expected result to be capped", n)
+	}
+	if n := transferable(-maxDuration, math.MaxInt64); n != math.MinInt64 {
+		t.Fatal("expected result to be capped", n)
+	}
+}
+
+// TestLargeBPS tests that very large limits and writes are still paced
+// correctly.
+func TestLargeBPS(t *testing.T) {
+	bps := int64(1250000000) // 10Gbit/s
+	rl := NewRateLimit(bps, bps, 0)
+
+	// Reserving 1GiB takes a bit less than a second.
+	d := rl.ReserveWrite(1 << 30)
+	if d < 850*time.Millisecond || d > 860*time.Millisecond {
+		t.Fatal("wrong delay", d)
+	}
+
+	// A huge reservation results in a long but positive delay.
+	rl = NewRateLimit(1, 1, 0)
+	if d := rl.ReserveWrite(math.MaxInt32); d <= 0 || d < time.Duration(math.MaxInt32-1)*time.Second {
+		t.Fatal("wrong delay", d)
+	}
+	if n := rl.AvailableWrite(); n >= 0 || n < -math.MaxInt32 {
+		t.Fatal("wrong available bytes", n)
+	}
+
+	// Rescaling a huge debt doesn't overflow.
+	rl = NewRateLimit(1e9, 1e9, 0)
+	for i := 0; i < 5; i++ {
+		rl.ReserveWrite(math.MaxInt32)
+	}
+	rl.SetWriteBPS(1)
+	if n := rl.AvailableWrite(); n >= 0 {
+		t.Fatal("wrong available bytes", n)
+	}
+}
+
+// TestManyWriters tests that many writers sharing a RateLimit don't wake up at
+// the same time and exceed the limit. Only the writer at the front of the
+// queue sleeps until the next packet is due, the others wait for their turn.
+func TestManyWriters(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	packetSize := 100
+	bps := int64(100 * packetSize)
+	rl := NewRateLimit(0, bps, uint64(packetSize))
+	spy := &spyReadWriter{}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rlc := NewRLReadWriter(spy, rl, stop)
+			data := make([]byte, packetSize)
+			for {
+				if _, err := rlc.Write(data); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	// Sample the written bytes in short windows. No window should exceed the
+	// limit by more than a couple of packets.
+	start := time.Now()
+	last, lastWritten := start, atomic.LoadUint64(&spy.written)
+	for time.Since(start) < 2*time.Second {
+		time.Sleep(50 * time.Millisecond)
+		now, written := time.Now(), atomic.LoadUint64(&spy.written)
+		allowed := now.Sub(last).Seconds()*float64(bps) + 2*float64(packetSize)
+		if burst := float64(written - lastWritten); burst > allowed {
+			t.Errorf("window exceeded the limit: %v > %v", burst, allowed)
+		}
+		last, lastWritten = now, written
+	}
+	close(stop)
+	wg.Wait()
+
+	// On average the writers use the whole bandwidth.
+	rate := float64(atomic.LoadUint64(&spy.written)) / time.Since(start).Seconds()
+	if rate > float64(bps)*1.05 || rate < float64(bps)*0.9 {
+		t.Fatal("wrong average rate", rate)
+	}
+}
+
+// TestQueueOrder tests that waiting writers are served in the order they
+// arrive and that writers that give up leave the queue.
+func TestQueueOrder(t *testing.T) {
+	clock := newFakeClock()
+	rl := NewRateLimitWithOptions(WithWriteBPS(1000), WithPacketSize(100), WithClock(clock))
+	rl.ReserveWrite(100)
+	queued := func() int {
+		rl.write.mu.Lock()
+		defer rl.write.mu.Unlock()
+		return len(rl.write.queue)
+	}
+
+	// Queue up writers one after another. The third one gives up.
+	n := 5
+	order := make(chan int, n)
+	cancel := make(chan struct{})
+	for i := 0; i < n; i++ {
+		var c chan struct{}
+		if i == 2 {
+			c = cancel
+		}
+		go func(i int, rlc *RLReadWriter) {
+			if _, err := rlc.Write(make([]byte, 100)); err == nil {
+				order <- i
+			}
+		}(i, NewRLReadWriter(&spyReadWriter{}, rl, c))
+		for queued() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	close(cancel)
+	for queued() != n-1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Serve the remaining writers.
+	for i := 0; i < n-1; i++ {
+		for clock.Pending() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(100 * time.Millisecond)
+	}
+	for _, expected := range []int{0, 1, 3, 4} {
+		if i := <-order; i != expected {
+			t.Fatal("wrong order", i, expected)
+		}
+	}
+}
+
+type (
+	// lateClock is a Clock which never blocks but oversleeps. Creating or
+	// resetting a timer moves the clock forward to the time the timer fires
+	// plus the oversleep.
+	lateClock struct {
+		mu        sync.Mutex
+		now       time.Time
+		oversleep time.Duration
+	}
+
+	// lateTimer is a Timer created by a lateClock.
+	lateTimer struct {
+		c     chan time.Time
+		clock *lateClock
+	}
+)
+
+// Now implements the Clock interface.
+func (c *lateClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer implements the Clock interface.
+func (c *lateClock) NewTimer(d time.Duration) Timer {
+	t := &lateTimer{c: make(chan time.Time, 1), clock: c}
+	t.Reset(d)
+	return t
+}
+
+// C implements the Timer interface.
+func (t *lateTimer) C() <-chan time.Time { return t.c }
+
+// Reset implements the Timer interface.
+func (t *lateTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	if d > 0 {
+		t.clock.now = t.clock.now.Add(d + t.clock.oversleep)
+	}
+	now := t.clock.now
+	t.clock.mu.Unlock()
+	select {
+	case t.c <- now:
+	default:
+	}
+	return false
+}
+
+// Stop implements the Timer interface.
+func (t *lateTimer) Stop() bool { return false }
+
+// TestOversleep tests that the throughput doesn't drift below the limit if
+// every sleep returns late.
+func TestOversleep(t *testing.T) {
+	clock := &lateClock{now: time.Unix(0, 0), oversleep: 10 * time.Millisecond}
+	start := clock.Now()
+	rl := NewRateLimitWithOptions(WithWriteBPS(1000), WithPacketSize(100), WithClock(clock))
+	rlc := NewRLReadWriter(&spyReadWriter{}, rl, nil)
+
+	// Without compensation, each of the 99 packets after the first would
+	// take 110ms instead of 100ms.
+	if _, err := rlc.Write(make([]byte, 10000)); err != nil {
+		t.Fatal(err)
+	}
+	d := clock.Now().Sub(start)
+	if d < 9900*time.Millisecond || d > 9900*time.Millisecond+clock.oversleep {
+		t.Fatal("throughput drifted", d)
+	}
+}
@@ -0,0 +1,80 @@
+package ratelimit
+
+import "net"
+
+// WriteBuffers writes the contents of bufs to the underlying readWriter with
+// the maximum possible speed allowed by the rateLimit. The buffers are paced
+// as if they were a single slice and every packet is written with a single
+// call to net.Buffers.WriteTo. That way the underlying writer's support for
+// vectored writes is used if available. If the write is interrupted, n is the
+// number of bytes that were written to the underlying readWriter before. Unlike
+// net.Buffers.WriteTo, WriteBuffers doesn't modify bufs. Like a call to Write,
+// a call to WriteBuffers counts as a single write towards WithWritePPS.
+func (l *RLReadWriter) WriteBuffers(bufs net.Buffers) (n int64, err error) {
+	defer l.end(l.begin())
+
+	// Work on a copy to avoid consuming the caller's buffers.
+	bufs = append(net.Buffers(nil), bufs...)
+	remaining := buffersLen(bufs)
+	if remaining > 0 {
+		if err := l.waitMessage(); err != nil {
+			return 0, err
+		}
+	}
+	for remaining > 0 {
+		// The packet size is looked up for every packet to pick up changes
+		// made while writing.
+		size := remaining
+		if packetSize := l.packetSize(DirectionWrite); packetSize > 0 && uint64(size) > packetSize {
+			size = int64(packetSize)
+		}
+		var written int
+		written, err = l.transferPacketN(DirectionWrite, int(size), transferWait, func(size int) (int, error) {
+			packet := buffersPrefix(bufs, size)
+			m, err := packet.WriteTo(l.ReadWriter)
+			return int(m), err
+		})
+		consumeBuffers(&bufs, written)
+		remaining -= int64(written)
+		n += int64(written)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// buffersLen returns the total number of bytes in bufs.
+func buffersLen(bufs net.Buffers) (n int64) {
+	for _, b := range bufs {
+		n += int64(len(b))
+	}
+	return
+}
+
+// buffersPrefix returns the buffers containing the first n bytes of bufs.
+func buffersPrefix(bufs net.Buffers, n int) net.Buffers {
+	var prefix net.Buffers
+	for _, b := range bufs {
+		if n == 0 {
+			break
+		}
+		if len(b) > n {
+			b = b[:n]
+		}
+		prefix = append(prefix, b)
+		n -= len(b)
+	}
+	return prefix
+}
+
+// consumeBuffers removes the first n bytes from bufs.
+func consumeBuffers(bufs *net.Buffers, n int) {
+	for len(*bufs) > 0 && n >= len((*bufs)[0]) {
+		n -= len((*bufs)[0])
+		*bufs = (*bufs)[1:]
+	}
+	if len(*bufs) > 0 {
+		(*bufs)[0] = (*bufs)[0][n:]
+	}
+}
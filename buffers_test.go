@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+)
+
+// recordWriter records the size of every write.
+type recordWriter struct {
+	bytes.Buffer
+	writes []int
+}
+
+// Write implements io.Writer.
+func (rw *recordWriter) Write(b []byte) (int, error) {
+	rw.writes = append(rw.writes, len(b))
+	return rw.Buffer.Write(b)
+}
+
+// TestWriteBuffers tests writing multiple buffers with a single call.
+func TestWriteBuffers(t *testing.T) {
+	clock := newFakeClock()
+	rl := NewRateLimitWithOptions(WithWriteBPS(1000), WithPacketSize(100), WithClock(clock))
+	rw := &recordWriter{}
+	rlc := NewRLReadWriter(rw, rl, nil)
+
+	bufs := net.Buffers{fastrand.Bytes(30), fastrand.Bytes(70), fastrand.Bytes(150), fastrand.Bytes(50)}
+	orig := append(net.Buffers(nil), bufs...)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err := rlc.WriteBuffers(bufs)
+		if err != nil || n != 300 {
+			t.Error("wrong write", n, err)
+		}
+	}()
+
+	// The 300 bytes are paced like a single write of 3 packets. The first
+	// packet goes through right away.
+	for i := 0; i < 2; i++ {
+		for clock.Pending() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(100 * time.Millisecond)
+	}
+	<-done
+
+	// The packets span the buffers.
+	expected := []int{30, 70, 100, 50, 50}
+	if !reflect.DeepEqual(rw.writes, expected) {
+		t.Fatal("wrong writes", rw.writes)
+	}
+	if !bytes.Equal(rw.Bytes(), bytes.Join(orig, nil)) {
+		t.Fatal("data was corrupted")
+	}
+	if !reflect.DeepEqual(bufs, orig) {
+		t.Fatal("buffers were modified")
+	}
+	if stats := rl.Stats(); stats.BytesWritten != 300 {
+		t.Fatal("wrong number of bytes written", stats.BytesWritten)
+	}
+	if n := rl.AvailableWrite(); n != -100 {
+		t.Fatal("wrong available bytes", n)
+	}
+}
+
+// TestConsumeBuffers tests removing bytes from the front of buffers.
+func TestConsumeBuffers(t *testing.T) {
+	bufs := net.Buffers{[]byte("ab"), []byte("cde"), []byte("f")}
+	if prefix := buffersPrefix(bufs, 4); !bytes.Equal(bytes.Join(prefix, nil), []byte("abcd")) {
+		t.Fatal("wrong prefix", prefix)
+	}
+	consumeBuffers(&bufs, 3)
+	if !bytes.Equal(bytes.Join(bufs, nil), []byte("def")) || len(bufs) != 2 {
+		t.Fatal("wrong buffers", bufs)
+	}
+	consumeBuffers(&bufs, 3)
+	if len(bufs) != 0 {
+		t.Fatal("buffers should be empty", bufs)
+	}
+}
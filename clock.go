@@ -0,0 +1,44 @@
+package ratelimit
+
+import "time"
+
+type (
+	// Clock is the source of time used by a RateLimit to pace reads and
+	// writes. It can be replaced to control the passing of time in tests.
+	Clock interface {
+		// Now returns the current time.
+		Now() time.Time
+		// NewTimer creates a new Timer that fires after at least d.
+		NewTimer(d time.Duration) Timer
+	}
+
+	// Timer is a timer created by a Clock.
+	Timer interface {
+		// C returns the channel on which the current time is sent once the
+		// Timer fires.
+		C() <-chan time.Time
+		// Reset changes the Timer to fire after d. It returns false if the
+		// Timer already fired or was stopped.
+		Reset(d time.Duration) bool
+		// Stop prevents the Timer from firing. It returns false if the Timer
+		// already fired or was stopped.
+		Stop() bool
+	}
+
+	// realClock is the Clock backed by the time package.
+	realClock struct{}
+
+	// realTimer is the Timer backed by a time.Timer.
+	realTimer struct {
+		*time.Timer
+	}
+)
+
+// Now implements the Clock interface.
+func (realClock) Now() time.Time { return time.Now() }
+
+// NewTimer implements the Clock interface.
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+// C implements the Timer interface.
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
@@ -0,0 +1,317 @@
+package ratelimit
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+)
+
+type (
+	// fakeClock is a Clock that only advances when told to.
+	fakeClock struct {
+		mu     sync.Mutex
+		now    time.Time
+		timers []*fakeTimer
+	}
+
+	// fakeTimer is a Timer created by a fakeClock.
+	fakeTimer struct {
+		c     chan time.Time
+		when  time.Time
+		clock *fakeClock
+	}
+)
+
+// newFakeClock creates a new fakeClock.
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+// Now implements the Clock interface.
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer implements the Clock interface.
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{
+		c:     make(chan time.Time, 1),
+		when:  c.now.Add(d),
+		clock: c,
+	}
+	if d <= 0 {
+		t.fire(c.now)
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and fires all the timers that expired.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var pending []*fakeTimer
+	for _, t := range c.timers {
+		if t.when.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.fire(c.now)
+	}
+	c.timers = pending
+}
+
+// Pending returns the number of timers that didn't fire yet.
+func (c *fakeClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// C implements the Timer interface.
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+// fire sends now on the timer's channel unless there is already a value
+// pending.
+func (t *fakeTimer) fire(now time.Time) {
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+// Reset implements the Timer interface.
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.stop()
+	t.when = t.clock.now.Add(d)
+	if d <= 0 {
+		t.fire(t.clock.now)
+		return active
+	}
+	t.clock.timers = append(t.clock.timers, t)
+	return active
+}
+
+// Stop implements the Timer interface.
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.stop()
+}
+
+// stop removes the timer from the clock. t.clock.mu must be held by the
+// caller.
+func (t *fakeTimer) stop() bool {
+	for i := range t.clock.timers {
+		if t.clock.timers[i] == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// TestFakeClock tests the pacing of a RateLimit using a fake clock.
+func TestFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	bps := int64(1000)
+	packetSize := 100
+	rl := NewRateLimitWithOptions(WithWriteBPS(bps), WithBurst(uint64(bps)), WithPacketSize(uint64(packetSize)), WithClock(clock))
+
+	// The RateLimit starts out empty.
+	if n := rl.AvailableWrite(); n != 0 {
+		t.Fatal("wrong available bytes", n)
+	}
+	clock.Advance(500 * time.Millisecond)
+	if n := rl.AvailableWrite(); n != bps/2 {
+		t.Fatal("wrong available bytes", n)
+	}
+
+	// Every simulated second allows for exactly bps bytes.
+	for i := 0; i < 3; i++ {
+		clock.Advance(time.Second)
+		var allowed int64
+		for rl.AllowWrite(packetSize) {
+			allowed += int64(packetSize)
+		}
+		if allowed != bps {
+			t.Fatal("wrong number of bytes allowed", allowed)
+		}
+	}
+
+	// A writer is paced by the clock. The first packet goes through since
+	// the bucket isn't in debt.
+	rl.Reset()
+	rlc := NewRLReadWriter(bytes.NewBuffer(nil), rl, nil)
+	if _, err := rlc.Write(fastrand.Bytes(packetSize)); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := rlc.Write(fastrand.Bytes(packetSize)); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// Wait for the writer to start waiting.
+	for clock.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The writer needs to wait for the time it takes to transfer the first
+	// packet.
+	clock.Advance(99 * time.Millisecond)
+	if clock.Pending() != 1 {
+		t.Fatal("writer shouldn't be done yet")
+	}
+	clock.Advance(time.Millisecond)
+	<-done
+}
+
+// TestETA tests estimating the time it takes to transfer some bytes.
+func TestETA(t *testing.T) {
+	clock := newFakeClock()
+	bps := int64(1000)
+	rl := NewRateLimitWithOptions(WithReadBPS(bps), WithWriteBPS(bps), WithBurst(500), WithClock(clock))
+
+	// A new RateLimit hasn't accumulated anything yet.
+	if d := rl.ETAWrite(2000); d != 2*time.Second {
+		t.Fatal("wrong ETA", d)
+	}
+
+	// Accumulated bytes reduce the ETA up to the burst.
+	clock.Advance(300 * time.Millisecond)
+	if d := rl.ETAWrite(2000); d != 1700*time.Millisecond {
+		t.Fatal("wrong ETA", d)
+	}
+	clock.Advance(time.Second)
+	if d := rl.ETAWrite(2000); d != 1500*time.Millisecond {
+		t.Fatal("wrong ETA", d)
+	}
+	if d := rl.ETAWrite(500); d != 0 {
+		t.Fatal("wrong ETA", d)
+	}
+
+	// Bytes that are owed increase the ETA.
+	rl.ReserveRead(1500)
+	if d := rl.ETARead(1000); d != 2*time.Second {
+		t.Fatal("wrong ETA", d)
+	}
+
+	// Without a limit there is no waiting.
+	rl.SetLimits(0, 0, 0)
+	if d := rl.ETAWrite(2000); d != 0 {
+		t.Fatal("wrong ETA", d)
+	}
+}
+
+// TestClockJump tests that a RateLimit isn't thrown off by the clock jumping
+// backwards or forwards.
+func TestClockJump(t *testing.T) {
+	clock := newFakeClock()
+	rl := NewRateLimitWithOptions(WithWriteBPS(1000), WithBurst(500), WithClock(clock))
+
+	// Go into debt and jump back an hour. The debt shouldn't grow by an hour.
+	rl.ReserveWrite(100)
+	clock.Advance(-time.Hour)
+	if n := rl.AvailableWrite(); n != -100 {
+		t.Fatal("wrong available bytes", n)
+	}
+	if d := rl.ReserveWrite(100); d != 200*time.Millisecond {
+		t.Fatal("wrong wait", d)
+	}
+
+	// Jumping forward only accumulates up to the burst.
+	clock.Advance(time.Hour)
+	if n := rl.AvailableWrite(); n != 500 {
+		t.Fatal("wrong available bytes", n)
+	}
+}
+
+// TestPause tests pausing and resuming a RateLimit in the middle of a
+// transfer.
+func TestPause(t *testing.T) {
+	clock := newFakeClock()
+	rl := NewRateLimitWithOptions(WithWriteBPS(1000), WithPacketSize(100), WithClock(clock))
+	spy := &spyReadWriter{}
+	rlc := NewRLReadWriter(spy, rl, nil)
+	done := make(chan error)
+	go func() {
+		_, err := rlc.Write(make([]byte, 500))
+		done <- err
+	}()
+
+	// Pause while the second packet is waiting. No matter how much time
+	// passes, no more bytes are written.
+	for clock.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	rl.Pause()
+	clock.Advance(time.Hour)
+	time.Sleep(10 * time.Millisecond)
+	if written := atomic.LoadUint64(&spy.written); written != 100 {
+		t.Fatal("bytes were written while paused", written)
+	}
+	if n := rl.AvailableWrite(); n != -100 {
+		t.Fatal("paused time was charged", n)
+	}
+
+	// New writes block too and can be canceled.
+	c := make(chan struct{})
+	rlc2 := NewRLReadWriter(spy, rl, c)
+	go func() {
+		_, err := rlc2.Write(make([]byte, 10))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(c)
+	if err := <-done; !errors.Is(err, ErrCanceled) {
+		t.Fatal("expected ErrCanceled", err)
+	}
+
+	// After resuming, the writer continues at the same pace.
+	rl.Resume()
+	for i := 0; i < 4; i++ {
+		for clock.Pending() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(100 * time.Millisecond)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if written := atomic.LoadUint64(&spy.written); written != 500 {
+		t.Fatal("wrong number of bytes written", written)
+	}
+
+	// Unlimited RateLimits can be paused too.
+	rl = NopRateLimit()
+	rl.Pause()
+	go func() {
+		_, err := NewRLReadWriter(spy, rl, nil).Write(make([]byte, 10))
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("write wasn't paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+	rl.Resume()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,34 @@
+package ratelimit
+
+// Clone creates a new RateLimit with the same configuration as rl. The clone
+// starts out with the current limits, packet sizes, burst and name of rl and
+// the options it was created with, but with fresh Stats and an empty bucket.
+// Reads and writes using the clone don't affect rl and changing the limits of
+// the clone doesn't affect rl either. A clone of a derived RateLimit is not
+// derived from the parent. Callbacks set with SetOnThrottle are not copied.
+func (rl *RateLimit) Clone() *RateLimit {
+	opts := []Option{
+		WithPacketSizes(rl.ReadPacketSize(), rl.WritePacketSize()),
+		WithBurst(rl.read.burstSize()),
+		WithName(rl.Name()),
+		WithClock(rl.clock),
+		WithLogger(rl.logger),
+		WithMaxBlock(rl.read.maxBlock),
+		WithPacingJitter(rl.read.jitter),
+		WithMinSleep(rl.read.minSleep),
+		WithExemptBelow(rl.exemptBelow),
+		WithWritePPS(rl.WritePPS()),
+	}
+	if rl.write == rl.read {
+		opts = append(opts, WithAggregateBPS(rl.ReadBPS()))
+	} else {
+		opts = append(opts, WithReadBPS(rl.ReadBPS()), WithWriteBPS(rl.WriteBPS()))
+	}
+	if sw := rl.exemptBudget; sw != nil {
+		opts = append(opts, WithExemptBudget(sw.maxBytes, sw.window))
+	}
+	if w := rl.watchdog; w != nil {
+		opts = append(opts, WithWatchdog(w.threshold, w.logger))
+	}
+	return NewRateLimitWithOptions(opts...)
+}
@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestClone tests that a clone of a RateLimit has the same configuration but
+// is independent of the original.
+func TestClone(t *testing.T) {
+	rl := NewRateLimitWithOptions(
+		WithReadBPS(1000),
+		WithWriteBPS(2000),
+		WithPacketSizes(100, 200),
+		WithBurst(300),
+		WithName("tenant"),
+		WithMaxBlock(time.Minute),
+		WithWritePPS(50),
+	)
+	rlc := NewRLReadWriter(new(bytes.Buffer), rl, nil)
+	if _, err := rlc.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The clone has the same configuration but fresh Stats.
+	clone := rl.Clone()
+	if clone.ReadBPS() != 1000 || clone.WriteBPS() != 2000 || clone.WritePPS() != 50 {
+		t.Fatal("wrong limits", clone.ReadBPS(), clone.WriteBPS(), clone.WritePPS())
+	}
+	if clone.ReadPacketSize() != 100 || clone.WritePacketSize() != 200 {
+		t.Fatal("wrong packet sizes", clone.ReadPacketSize(), clone.WritePacketSize())
+	}
+	if clone.read.burstSize() != 300 || clone.write.maxBlock != time.Minute || clone.Name() != "tenant" {
+		t.Fatal("wrong options", clone.read.burstSize(), clone.write.maxBlock, clone.Name())
+	}
+	if stats := clone.Stats(); stats.BytesWritten != 0 || stats.BytesRead != 0 {
+		t.Fatal("stats were copied", stats)
+	}
+
+	// Changing the clone doesn't affect the original.
+	clone.SetLimits(1, 2, 3)
+	clone.SetName("other")
+	if rl.ReadBPS() != 1000 || rl.WriteBPS() != 2000 || rl.Name() != "tenant" {
+		t.Fatal("original was changed", rl.ReadBPS(), rl.WriteBPS(), rl.Name())
+	}
+
+	// Transfers using the clone aren't accounted for by the original.
+	clone = rl.Clone()
+	if _, err := NewRLReadWriter(new(bytes.Buffer), clone, nil).Write(make([]byte, 50)); err != nil {
+		t.Fatal(err)
+	}
+	if clone.Stats().BytesWritten != 50 || rl.Stats().BytesWritten != 100 {
+		t.Fatal("accounting isn't independent", clone.Stats(), rl.Stats())
+	}
+
+	// Aggregate limits stay aggregate.
+	clone = NewRateLimitWithOptions(WithAggregateBPS(500)).Clone()
+	if clone.read != clone.write || clone.ReadBPS() != 500 {
+		t.Fatal("clone isn't aggregate")
+	}
+}
@@ -0,0 +1,156 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// CompositeRateLimit is a Limiter which enforces multiple RateLimits at once.
+// Every read and write has to wait until all of the RateLimits allow it and
+// is charged to all of them. That way the tightest limit is enforced at any
+// moment.
+type CompositeRateLimit struct {
+	limits []*RateLimit
+}
+
+// NewCompositeRateLimit creates a new CompositeRateLimit which enforces all of
+// the provided limits.
+func NewCompositeRateLimit(limits ...*RateLimit) *CompositeRateLimit {
+	return &CompositeRateLimit{
+		limits: append([]*RateLimit(nil), limits...),
+	}
+}
+
+// PacketSize returns the smallest packet size of the composed RateLimits.
+func (c *CompositeRateLimit) PacketSize() uint64 {
+	return c.smallestPacketSize((*RateLimit).PacketSize)
+}
+
+// packetSize returns the smallest packet size of the composed RateLimits for
+// the given direction.
+func (c *CompositeRateLimit) packetSize(dir Direction) uint64 {
+	return c.smallestPacketSize(func(rl *RateLimit) uint64 {
+		return rl.packetSize(dir)
+	})
+}
+
+// smallestPacketSize returns the smallest non-zero packet size returned by
+// packetSize for the composed RateLimits.
+func (c *CompositeRateLimit) smallestPacketSize(packetSize func(*RateLimit) uint64) uint64 {
+	var smallest uint64
+	for _, rl := range c.limits {
+		if ps := packetSize(rl); ps > 0 && (smallest == 0 || ps < smallest) {
+			smallest = ps
+		}
+	}
+	return smallest
+}
+
+// WaitRead blocks until n bytes may be read according to the read limits of
+// all the composed RateLimits.
+func (c *CompositeRateLimit) WaitRead(ctx context.Context, n int) error {
+	waited, err := c.wait(ctx, DirectionRead, n, nil, nil)
+	c.throttled(DirectionRead, waited, n)
+	return err
+}
+
+// WaitWrite blocks until n bytes may be written according to the write limits
+// of all the composed RateLimits.
+func (c *CompositeRateLimit) WaitWrite(ctx context.Context, n int) error {
+	waited, err := c.wait(ctx, DirectionWrite, n, nil, nil)
+	c.throttled(DirectionWrite, waited, n)
+	return err
+}
+
+// holds returns whether b is one of the buckets of the composed RateLimits.
+func (c *CompositeRateLimit) holds(b *bucket) bool {
+	for _, rl := range c.limits {
+		if rl.holds(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// wait waits until n bytes may be transferred in the given direction by all
+// the composed RateLimits as part of flow f. If the wait is interrupted, the
+// RateLimits that were already charged are refunded.
+func (c *CompositeRateLimit) wait(ctx context.Context, dir Direction, n int, expired <-chan struct{}, f *flow) (time.Duration, error) {
+	var waited time.Duration
+	for i, rl := range c.limits {
+		w, err := rl.wait(ctx, dir, n, expired, f)
+		waited += w
+		if err != nil {
+			for _, rl := range c.limits[:i] {
+				rl.refund(dir, n, f)
+			}
+			return waited, err
+		}
+	}
+	return waited, nil
+}
+
+// refund returns n bytes that were waited for but not transferred in the
+// given direction as part of flow f to all the composed RateLimits.
+func (c *CompositeRateLimit) refund(dir Direction, n int, f *flow) {
+	for _, rl := range c.limits {
+		rl.refund(dir, n, f)
+	}
+}
+
+// try charges all the composed RateLimits for n bytes in the given direction
+// as part of flow f if all of them allow transferring them right away. It
+// returns whether they were charged.
+func (c *CompositeRateLimit) try(dir Direction, n int, f *flow) bool {
+	for i, rl := range c.limits {
+		if !rl.try(dir, n, f) {
+			for _, rl := range c.limits[:i] {
+				rl.refund(dir, n, f)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// eta returns the longest time it takes until n bytes may be transferred in
+// the given direction without waiting for any of the composed RateLimits.
+func (c *CompositeRateLimit) eta(dir Direction, n int) time.Duration {
+	var d time.Duration
+	for _, rl := range c.limits {
+		if rlD := rl.eta(dir, n); rlD > d {
+			d = rlD
+		}
+	}
+	return d
+}
+
+// throttled calls the throttle callbacks of all the composed RateLimits.
+func (c *CompositeRateLimit) throttled(dir Direction, waited time.Duration, n int) {
+	for _, rl := range c.limits {
+		rl.throttled(dir, waited, n)
+	}
+}
+
+// transferred updates the Stats of all the composed RateLimits.
+func (c *CompositeRateLimit) transferred(dir Direction, n int) {
+	for _, rl := range c.limits {
+		rl.transferred(dir, n)
+	}
+}
+
+// begin marks the start of a read or write operation for all the composed
+// RateLimits.
+func (c *CompositeRateLimit) begin() {
+	for _, rl := range c.limits {
+		rl.begin()
+	}
+}
+
+// end marks the end of a read or write operation for all the composed
+// RateLimits.
+func (c *CompositeRateLimit) end() {
+	for _, rl := range c.limits {
+		rl.end()
+	}
+}
@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+)
+
+// TestCompositeRateLimit tests enforcing multiple RateLimits at once.
+func TestCompositeRateLimit(t *testing.T) {
+	packetSize := uint64(100)
+	fast := NewRateLimit(1000, 1000, packetSize)
+	slow := NewRateLimit(400, 400, 2*packetSize)
+	c := NewCompositeRateLimit(fast, slow)
+	if c.PacketSize() != packetSize {
+		t.Fatal("wrong packet size", c.PacketSize())
+	}
+
+	// The throughput is limited by the slower RateLimit.
+	rlc := NewRLReadWriter(bytes.NewBuffer(nil), c, nil)
+	data := fastrand.Bytes(1000)
+	start := time.Now()
+	if _, err := rlc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Duration(uint64(len(data))-packetSize) * time.Second / 400
+	if d := time.Since(start); d < expected || d > expected+500*time.Millisecond {
+		t.Fatal("wrong pacing", d, expected)
+	}
+
+	// Both RateLimits were charged.
+	if fast.Stats().BytesWritten != 1000 || slow.Stats().BytesWritten != 1000 {
+		t.Fatal("wrong stats", fast.Stats(), slow.Stats())
+	}
+	if fast.AvailableWrite() > 0 || slow.AvailableWrite() >= 0 {
+		t.Fatal("RateLimits should be in debt", fast.AvailableWrite(), slow.AvailableWrite())
+	}
+
+	// An interrupted wait doesn't charge any of the RateLimits.
+	fast.Reset()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.WaitWrite(ctx, 100); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected context.DeadlineExceeded but got", err)
+	}
+	if n := fast.AvailableWrite(); n < 0 {
+		t.Fatal("fast RateLimit was charged", n)
+	}
+}
+
+// TestCompositeTry tests that a CompositeRateLimit only charges its RateLimits
+// if all of them allow a transfer right away.
+func TestCompositeTry(t *testing.T) {
+	clock := newFakeClock()
+	open := NewRateLimitWithOptions(WithWriteBPS(1000), WithClock(clock))
+	busy := NewRateLimitWithOptions(WithWriteBPS(1000), WithClock(clock))
+	busy.ReserveWrite(100)
+	c := NewCompositeRateLimit(open, busy)
+
+	// The busy RateLimit doesn't allow the transfer and the open one isn't
+	// charged.
+	if c.try(DirectionWrite, 100, nil) {
+		t.Fatal("transfer shouldn't be allowed")
+	}
+	if n := open.AvailableWrite(); n != 0 {
+		t.Fatal("open RateLimit was charged", n)
+	}
+
+	// Once the busy RateLimit is paid off, both are charged.
+	clock.Advance(100 * time.Millisecond)
+	if !c.try(DirectionWrite, 100, nil) {
+		t.Fatal("transfer should be allowed")
+	}
+	if open.AvailableWrite() != -100 || busy.AvailableWrite() != -100 {
+		t.Fatal("RateLimits weren't charged", open.AvailableWrite(), busy.AvailableWrite())
+	}
+}
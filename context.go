@@ -0,0 +1,37 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// chanContext is a context.Context that is done once the underlying channel
+// is closed. It allows for using a cancel channel wherever a context is
+// expected without spawning a goroutine to bridge the two. A nil channel is
+// never done.
+type chanContext <-chan struct{}
+
+// Deadline implements context.Context. A chanContext has no deadline.
+func (c chanContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// Done implements context.Context.
+func (c chanContext) Done() <-chan struct{} {
+	return c
+}
+
+// Err implements context.Context.
+func (c chanContext) Err() error {
+	select {
+	case <-c:
+		return context.Canceled
+	default:
+		return nil
+	}
+}
+
+// Value implements context.Context. A chanContext carries no values.
+func (c chanContext) Value(key interface{}) interface{} {
+	return nil
+}
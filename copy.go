@@ -0,0 +1,29 @@
+package ratelimit
+
+import "io"
+
+// CopyN copies n bytes from src to dst like io.CopyN but with the maximum
+// possible speed allowed by the write limit of the global rate limiter. It
+// returns the number of bytes copied. If src ends before n bytes were copied,
+// io.EOF is returned. Closing cancel interrupts the copy.
+func CopyN(dst io.Writer, src io.Reader, n int64, rl Limiter, cancel <-chan struct{}) (int64, error) {
+	rlw := NewRLReadWriter(struct {
+		io.Reader
+		io.Writer
+	}{Writer: dst}, rl, cancel)
+	written, err := rlw.ReadFrom(io.LimitReader(src, n))
+	if err == nil && written < n {
+		err = io.EOF
+	}
+	return written, err
+}
+
+// ReadFull reads exactly len(buf) bytes from r into buf like io.ReadFull but
+// with the maximum possible speed allowed by the read limit of the global rate
+// limiter. It returns the number of bytes read. If r ends before buf is full,
+// io.ErrUnexpectedEOF is returned. Closing cancel interrupts the read and the
+// number of bytes read up to that point is returned together with
+// ErrCanceled.
+func ReadFull(r io.Reader, buf []byte, rl Limiter, cancel <-chan struct{}) (int, error) {
+	return io.ReadFull(NewRLReader(r, rl, cancel), buf)
+}
@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+)
+
+// TestCopyN tests copying a fixed number of bytes.
+func TestCopyN(t *testing.T) {
+	src := bytes.NewReader(fastrand.Bytes(1 << 20))
+	dst := bytes.NewBuffer(nil)
+	rl := NewRateLimit(0, 1000, 100)
+
+	// Copying 5 packets waits for 4 of them.
+	start := time.Now()
+	n, err := CopyN(dst, src, 500, rl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 500 || dst.Len() != 500 || rl.Stats().BytesWritten != 500 {
+		t.Fatal("wrong number of bytes copied", n, dst.Len())
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatal("copy wasn't limited", d)
+	}
+
+	// A short source results in io.EOF.
+	dst.Reset()
+	n, err = CopyN(dst, bytes.NewReader(make([]byte, 50)), 100, NewRateLimit(0, 0, 0), nil)
+	if err != io.EOF || n != 50 || dst.Len() != 50 {
+		t.Fatal("wrong result for short source", n, err)
+	}
+
+	// Cancelling interrupts the copy.
+	dst.Reset()
+	cancel := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(cancel) })
+	n, err = CopyN(dst, src, 1000, NewRateLimit(0, 10, 10), cancel)
+	if !errors.Is(err, ErrCanceled) {
+		t.Fatal("expected ErrCanceled", err)
+	}
+	if n != int64(dst.Len()) || n >= 1000 {
+		t.Fatal("wrong number of bytes copied", n, dst.Len())
+	}
+}
+
+// TestReadFull tests reading a full buffer.
+func TestReadFull(t *testing.T) {
+	data := fastrand.Bytes(500)
+	src := &chunkReader{chunk: 30}
+	src.Write(data)
+	rl := NewRateLimit(1000, 0, 100)
+
+	// Reading 5 packets waits for 4 of them even though the source returns
+	// fewer bytes per read.
+	buf := make([]byte, len(data))
+	start := time.Now()
+	n, err := ReadFull(src, buf, rl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) || !bytes.Equal(buf, data) || rl.Stats().BytesRead != 500 {
+		t.Fatal("wrong data read", n)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatal("read wasn't limited", d)
+	}
+
+	// A short source results in io.ErrUnexpectedEOF.
+	n, err = ReadFull(bytes.NewReader(make([]byte, 50)), buf, NewRateLimit(0, 0, 0), nil)
+	if err != io.ErrUnexpectedEOF || n != 50 {
+		t.Fatal("wrong result for short source", n, err)
+	}
+}
+
+// TestReadFullCancel tests cancelling ReadFull partway through.
+func TestReadFullCancel(t *testing.T) {
+	cancel := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(cancel) })
+	buf := make([]byte, 1000)
+	n, err := ReadFull(bytes.NewReader(fastrand.Bytes(1000)), buf, NewRateLimit(100, 0, 10), cancel)
+	if !errors.Is(err, ErrCanceled) {
+		t.Fatal("expected ErrCanceled", err)
+	}
+	if n == 0 || n >= len(buf) {
+		t.Fatal("wrong number of bytes read", n)
+	}
+}
@@ -0,0 +1,167 @@
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type (
+	// deadline is a resettable deadline for the reads or writes of a
+	// rate-limited wrapper. It is modeled after the pipeDeadline of the net
+	// package.
+	deadline struct {
+		mu     sync.Mutex // guards timer, cancel and closed.
+		timer  *time.Timer
+		cancel chan struct{} // closed once the deadline is exceeded.
+		closed bool          // set once the deadline is permanently exceeded.
+	}
+
+	// netError is an error of a rate-limited wrapper which implements
+	// net.Error. That way code that retries on timeouts treats the errors of
+	// the wrappers like the ones of a net.Conn.
+	netError struct {
+		msg       string
+		timeout   bool
+		temporary bool
+	}
+
+	// canceledError is the error returned by a rate-limited wrapper when it
+	// is cancelled while waiting for the rate limit. It wraps the error of
+	// the wrapper's context and behaves like ErrCanceled otherwise.
+	canceledError struct {
+		err error
+	}
+)
+
+var (
+	// ErrCanceled is returned by a rate-limited wrapper when it is cancelled
+	// while waiting for the rate limit. The returned error also matches the
+	// error of the wrapper's context, e.g. context.Canceled, when using
+	// errors.Is. It implements net.Error and reports neither a timeout nor a
+	// temporary error.
+	ErrCanceled error = &netError{msg: "rate limit wait canceled"}
+
+	// ErrDeadlineExceeded is returned by a rate-limited wrapper when a
+	// deadline is exceeded while waiting for the rate limit. It implements
+	// net.Error and reports a timeout.
+	ErrDeadlineExceeded error = &netError{msg: "i/o timeout", timeout: true, temporary: true}
+
+	// errClosed is returned when reading from or writing to a closed
+	// RLReadWriter.
+	errClosed = errors.New("use of closed readwriter")
+)
+
+// Error implements the error interface.
+func (e *netError) Error() string { return e.msg }
+
+// Timeout implements the net.Error interface.
+func (e *netError) Timeout() bool { return e.timeout }
+
+// Temporary implements the net.Error interface.
+func (e *netError) Temporary() bool { return e.temporary }
+
+// Error implements the error interface.
+func (e canceledError) Error() string { return ErrCanceled.Error() + ": " + e.err.Error() }
+
+// Timeout implements the net.Error interface.
+func (e canceledError) Timeout() bool { return false }
+
+// Temporary implements the net.Error interface.
+func (e canceledError) Temporary() bool { return false }
+
+// Is reports whether the error matches target for errors.Is.
+func (e canceledError) Is(target error) bool { return target == ErrCanceled }
+
+// Unwrap returns the error of the context for errors.Is and errors.As.
+func (e canceledError) Unwrap() error { return e.err }
+
+// newDeadline creates a deadline that doesn't time out.
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set sets the point in time when the deadline will time out. A timeout is
+// signaled by closing the channel returned by wait. Once a timeout has
+// occurred, the deadline can be refreshed by specifying a t in the future. A
+// zero value for t prevents a timeout.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+
+	// Wait for the timer callback to close cancel if it is already running.
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel
+	}
+	d.timer = nil
+
+	// If t is zero there is no deadline.
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	// If t is in the future we set up a timer to close cancel.
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	// Otherwise t is in the past and we close cancel right away.
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// close permanently exceeds the deadline.
+func (d *deadline) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel
+	}
+	d.timer = nil
+	if !isClosed(d.cancel) {
+		close(d.cancel)
+	}
+	d.closed = true
+}
+
+// err returns the error for an exceeded deadline.
+func (d *deadline) err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return errClosed
+	}
+	return ErrDeadlineExceeded
+}
+
+// wait returns a channel that is closed when the deadline is exceeded.
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+// isClosed returns whether c has been closed.
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,88 @@
+package ratelimit
+
+// Derive creates a new RateLimit whose limits are the provided fraction of the
+// limits of rl. The derived limits follow changes of the limits of rl. Reads
+// and writes using the derived RateLimit also wait for rl and count towards
+// its Stats, so multiple derived RateLimits can't exceed the limits of rl
+// together. The derived RateLimit starts out with the packet sizes of rl and
+// the fraction of its burst. rl keeps track of the derived RateLimit until it is released
+// with Release.
+func (rl *RateLimit) Derive(fraction float64) *RateLimit {
+	child := NewRateLimitWithOptions(
+		WithPacketSizes(rl.ReadPacketSize(), rl.WritePacketSize()),
+		WithBurst(uint64(float64(rl.read.burstSize())*fraction)),
+		WithClock(rl.clock),
+		WithLogger(rl.logger),
+	)
+	if rl.write == rl.read {
+		child.write = child.read
+	}
+	child.parent = rl
+	child.fraction = fraction
+
+	rl.childrenMu.Lock()
+	defer rl.childrenMu.Unlock()
+	rl.children = append(rl.children, child)
+	child.deriveLimits()
+	return child
+}
+
+// Release stops a RateLimit created by Derive or Split from following the
+// limits of its parent, which allows the parent to forget about it. The
+// released RateLimit keeps its current limits and reads and writes using it
+// still wait for the parent. If it was created by Split, its share is divided
+// among the remaining RateLimits of the group. Releasing a RateLimit that
+// wasn't derived or was released before is a no-op.
+func (rl *RateLimit) Release() {
+	parent := rl.parent
+	if parent == nil {
+		return
+	}
+	parent.childrenMu.Lock()
+	defer parent.childrenMu.Unlock()
+	parent.children = removeRateLimit(parent.children, rl)
+	if rl.group != nil {
+		rl.leave()
+	}
+}
+
+// removeRateLimit returns rls without rl.
+func removeRateLimit(rls []*RateLimit, rl *RateLimit) []*RateLimit {
+	for i := range rls {
+		if rls[i] == rl {
+			return append(rls[:i:i], rls[i+1:]...)
+		}
+	}
+	return rls
+}
+
+// updateChildren updates the limits of the RateLimits derived from rl after
+// its limits changed.
+func (rl *RateLimit) updateChildren() {
+	rl.childrenMu.Lock()
+	defer rl.childrenMu.Unlock()
+	for _, child := range rl.children {
+		child.deriveLimits()
+	}
+}
+
+// deriveLimits sets the limits of a derived RateLimit to its fraction of the
+// limits of its parent. rl.parent.childrenMu must be held by the caller.
+func (rl *RateLimit) deriveLimits() {
+	rl.read.setBPS(derivedBPS(rl.parent.ReadBPS(), rl.fraction))
+	rl.write.setBPS(derivedBPS(rl.parent.WriteBPS(), rl.fraction))
+	rl.updateChildren()
+}
+
+// derivedBPS returns the fraction of bps. A limited bps never results in an
+// unlimited fraction.
+func derivedBPS(bps int64, fraction float64) int64 {
+	if bps == 0 {
+		return 0
+	}
+	derived := clampInt64(float64(bps) * fraction)
+	if derived < 1 {
+		return 1
+	}
+	return derived
+}
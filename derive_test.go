@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestDerive tests that derived RateLimits share the limits of their parent.
+func TestDerive(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	packetSize := 100
+	bps := int64(100 * packetSize)
+	parent := NewRateLimit(0, bps, uint64(packetSize))
+	children := []*RateLimit{parent.Derive(0.5), parent.Derive(0.5)}
+	if children[0].WriteBPS() != bps/2 || children[0].ReadBPS() != 0 {
+		t.Fatal("wrong derived limits", children[0].WriteBPS(), children[0].ReadBPS())
+	}
+
+	// Write through both children and the parent for a second.
+	spies := []*spyReadWriter{{}, {}, {}}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, rl := range []*RateLimit{children[0], children[1], parent} {
+		wg.Add(1)
+		go func(rlc *RLReadWriter) {
+			defer wg.Done()
+			data := make([]byte, packetSize)
+			for {
+				if _, err := rlc.Write(data); err != nil {
+					return
+				}
+			}
+		}(NewRLReadWriter(spies[i], rl, stop))
+	}
+	start := time.Now()
+	time.Sleep(time.Second)
+	close(stop)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// The aggregate doesn't exceed the limit of the parent and the children
+	// don't exceed their share.
+	var total uint64
+	for _, spy := range spies {
+		total += atomic.LoadUint64(&spy.written)
+	}
+	if max := uint64(elapsed.Seconds()*float64(bps)) + 3*uint64(packetSize); total > max {
+		t.Fatal("parent limit was exceeded", total, max)
+	}
+	if stats := parent.Stats(); stats.BytesWritten != total {
+		t.Fatal("parent didn't count the bytes of its children", stats.BytesWritten, total)
+	}
+	for _, spy := range spies[:2] {
+		written := float64(atomic.LoadUint64(&spy.written))
+		if half := elapsed.Seconds() * float64(bps) / 2; written > half*1.1 || written < half*0.5 {
+			t.Fatal("child didn't get its share", written, half)
+		}
+	}
+
+	// The children follow the parent's limits.
+	parent.SetWriteBPS(2 * bps)
+	parent.SetReadBPS(bps)
+	for _, child := range children {
+		if child.WriteBPS() != bps || child.ReadBPS() != bps/2 {
+			t.Fatal("wrong derived limits", child.WriteBPS(), child.ReadBPS())
+		}
+	}
+
+	// Children can be derived from children.
+	grandchild := children[0].Derive(0.1)
+	parent.SetLimits(0, bps, 0)
+	if grandchild.WriteBPS() != bps/20 || grandchild.ReadBPS() != 0 {
+		t.Fatal("wrong derived limits", grandchild.WriteBPS(), grandchild.ReadBPS())
+	}
+}
+
+// TestDeriveRelease tests that released RateLimits stop following their
+// parent and are forgotten by it.
+func TestDeriveRelease(t *testing.T) {
+	parent := NewRateLimit(1000, 1000, 0)
+	kept, released := parent.Derive(0.5), parent.Derive(0.5)
+	released.Release()
+	released.Release()
+	parent.Release()
+	if len(parent.children) != 1 || parent.children[0] != kept {
+		t.Fatal("released RateLimit wasn't forgotten", len(parent.children))
+	}
+
+	// Only the kept RateLimit follows the parent.
+	parent.SetLimits(2000, 2000, 0)
+	if kept.ReadBPS() != 1000 || kept.WriteBPS() != 1000 {
+		t.Fatal("wrong derived limits", kept.ReadBPS(), kept.WriteBPS())
+	}
+	if released.ReadBPS() != 500 || released.WriteBPS() != 500 {
+		t.Fatal("released limits changed", released.ReadBPS(), released.WriteBPS())
+	}
+
+	// The released RateLimit still counts towards the parent.
+	rlc := NewRLReadWriter(&spyReadWriter{}, released, nil)
+	if _, err := rlc.Write(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if written := parent.Stats().BytesWritten; written != 10 {
+		t.Fatal("parent didn't count the write", written)
+	}
+}
@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrDropped is returned by a RLReadWriter in drop mode if it dropped data
+// instead of waiting for the rate limit.
+var ErrDropped = errors.New("write dropped by rate limit")
+
+// NewRLReadWriterDrop wraps a io.ReadWriter into a RLReadWriter whose writes
+// never wait for the rate limit. Instead a write stops at the first packet
+// that can't be written right away and returns the number of bytes written
+// together with ErrDropped. The remaining data is up to the caller to drop.
+// Reads wait for the rate limit as usual. Drop mode requires the Limiter to be
+// one of the Limiters of this package, other Limiters are waited for as usual.
+func NewRLReadWriterDrop(rw io.ReadWriter, rl Limiter, cancel <-chan struct{}) *RLReadWriter {
+	l := NewRLReadWriter(rw, rl, cancel)
+	l.drop = true
+	return l
+}
+
+// try charges both the limit of the connection and the provided Limiter for
+// size bytes in the given direction if they allow transferring them right
+// away. It returns whether they were charged. lim.rl must not be nil.
+func (l *RLReadWriter) try(lim *limiterRef, dir Direction, size int) bool {
+	if l.connRL != nil && !l.connRL.bucket(dir).try(size) {
+		return false
+	}
+	if lim.rl.try(dir, size, l.flows[dir]) {
+		return true
+	}
+	if l.connRL != nil {
+		l.connRL.bucket(dir).refund(size)
+	}
+	return false
+}
+
+// TryWrite writes b like Write but never waits for the rate limit, even if the
+// RLReadWriter isn't in drop mode. It stops at the first packet that can't be
+// written right away and returns the number of bytes written together with
+// ErrDropped. In that case retryAfter is the time until the limits have
+// accrued enough bandwidth for the remaining bytes. Like a call to Write, a
+// call to TryWrite counts as a single write towards WithWritePPS. If that
+// limit doesn't allow another write right away, nothing is written. Like drop
+// mode, TryWrite requires the Limiter to be one of the Limiters of this
+// package, other Limiters are waited for as usual.
+func (l *RLReadWriter) TryWrite(b []byte) (n int, retryAfter time.Duration, err error) {
+	defer l.end(l.begin())
+	if len(b) > 0 {
+		if retryAfter, err = l.tryMessage(); err != nil {
+			return
+		}
+	}
+	for len(b) > 0 {
+		// The packet size is looked up for every packet to pick up changes
+		// made while writing.
+		data := b
+		if packetSize := l.packetSize(DirectionWrite); packetSize > 0 && uint64(len(data)) > packetSize {
+			data = data[:packetSize]
+		}
+		var written int
+		written, err = l.transferPacketN(DirectionWrite, len(data), transferTry, func(size int) (int, error) {
+			return l.ReadWriter.Write(data[:size])
+		})
+		b = b[written:]
+		n += written
+		if err == ErrDropped {
+			retryAfter = l.retryAfter(DirectionWrite, len(b))
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// retryAfter returns how long it takes until both the limit of the connection
+// and the Limiter allow transferring size bytes in the given direction without
+// waiting.
+func (l *RLReadWriter) retryAfter(dir Direction, size int) time.Duration {
+	var d time.Duration
+	if l.connRL != nil {
+		d = l.connRL.eta(dir, size)
+	}
+	if lim := l.current(); lim.rl != nil {
+		if limD := lim.rl.eta(dir, size); limD > d {
+			d = limD
+		}
+	}
+	return d
+}
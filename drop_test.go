@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+)
+
+// TestDrop tests that a RLReadWriter in drop mode drops data instead of
+// waiting.
+func TestDrop(t *testing.T) {
+	clock := newFakeClock()
+	packetSize := 100
+	rl := NewRateLimitWithOptions(WithWriteBPS(1000), WithPacketSize(uint64(packetSize)), WithClock(clock))
+	buf := bytes.NewBuffer(nil)
+	rlc := NewRLReadWriterDrop(buf, rl, nil)
+
+	// Flood the writer. The clock doesn't advance so any wait would block
+	// forever.
+	done := make(chan struct{})
+	var written []int
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			n, err := rlc.Write(fastrand.Bytes(10 * packetSize))
+			if err != ErrDropped {
+				t.Error("expected ErrDropped", err)
+				return
+			}
+			written = append(written, n)
+			if i%10 == 9 {
+				clock.Advance(100 * time.Millisecond)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("writer blocked")
+	}
+
+	// Whenever the clock advanced far enough to pay for the previous packet,
+	// a single packet went through.
+	var total int
+	for i, n := range written {
+		if (i%10 == 0 && n != packetSize) || (i%10 != 0 && n != 0) {
+			t.Fatal("wrong number of bytes written", i, n)
+		}
+		total += n
+	}
+	if buf.Len() != total || rl.Stats().BytesWritten != uint64(total) {
+		t.Fatal("wrong number of bytes written", buf.Len(), total)
+	}
+
+	// Reads aren't affected.
+	if _, err := rlc.Read(make([]byte, total)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTryWrite tests that TryWrite doesn't wait and reports when the refused
+// bytes can be written.
+func TestTryWrite(t *testing.T) {
+	clock := newFakeClock()
+	packetSize := 100
+	rl := NewRateLimitWithOptions(WithWriteBPS(1000), WithPacketSize(uint64(packetSize)), WithBurst(1000), WithClock(clock))
+	buf := bytes.NewBuffer(nil)
+	rlc := NewRLReadWriter(buf, rl, nil)
+
+	// Only the first packet is written right away. The remaining 900 bytes
+	// take 900ms after paying for the first packet.
+	data := fastrand.Bytes(10 * packetSize)
+	n, retryAfter, err := rlc.TryWrite(data)
+	if err != ErrDropped || n != packetSize {
+		t.Fatal("expected ErrDropped after the first packet", n, err)
+	}
+	if retryAfter != time.Second {
+		t.Fatal("wrong retry after", retryAfter)
+	}
+
+	// Retrying early only writes the packets the limit allows in the
+	// meantime.
+	clock.Advance(retryAfter / 2)
+	n2, retryAfter, err := rlc.TryWrite(data[n:])
+	if err != ErrDropped || n2 != 5*packetSize || retryAfter != time.Second/2 {
+		t.Fatal("expected ErrDropped", n2, retryAfter, err)
+	}
+	n += n2
+
+	// After waiting for retryAfter, the rest is written at once.
+	clock.Advance(retryAfter)
+	n2, retryAfter, err = rlc.TryWrite(data[n:])
+	if err != nil || n+n2 != len(data) || retryAfter != 0 {
+		t.Fatal("remaining data wasn't written", n2, retryAfter, err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("data was corrupted")
+	}
+}
@@ -0,0 +1,26 @@
+package ratelimit
+
+// exempt returns whether a single write of n bytes is exempt from the limits
+// of the RateLimit because it is smaller than the threshold set with
+// WithExemptBelow. If the exempt writes have a budget, the write is only
+// exempt if it fits into the budget and is charged to it.
+func (rl *RateLimit) exempt(n int) bool {
+	if n <= 0 || n >= rl.exemptBelow {
+		return false
+	}
+	sw := rl.exemptBudget
+	if sw == nil {
+		return true
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	ok, _ := sw.admit(sw.clock.Now(), uint64(n))
+	return ok
+}
+
+// exempt returns whether a single write of n bytes is exempt from the limits
+// of the RLReadWriter. Only a RateLimit can exempt writes.
+func (l *RLReadWriter) exempt(n int) bool {
+	rl, ok := l.current().limiter.(*RateLimit)
+	return ok && rl.exempt(n)
+}
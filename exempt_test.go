@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// TestExemptBelow tests that small writes aren't limited by a RateLimit with
+// an exemption threshold while larger ones are.
+func TestExemptBelow(t *testing.T) {
+	clock := newFakeClock()
+	rl := NewRateLimitWithOptions(WithWriteBPS(1000), WithPacketSize(100), WithExemptBelow(10), WithClock(clock))
+	rw := &spyReadWriter{}
+	rlc := NewRLReadWriter(rw, rl, nil)
+
+	// Small writes go through without waiting or using up bandwidth, even
+	// if the RateLimit owes time.
+	rl.ReserveWrite(1000)
+	for i := 0; i < 100; i++ {
+		if n, err := rlc.Write(make([]byte, 9)); err != nil || n != 9 {
+			t.Fatal("exempt write failed", n, err)
+		}
+	}
+	if stats := rl.Stats(); stats.BytesWritten != 900 {
+		t.Fatal("exempt writes should be counted", stats.BytesWritten)
+	}
+
+	// Writes at the threshold are paced.
+	done := make(chan error)
+	go func() {
+		_, err := rlc.Write(make([]byte, 10))
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("write shouldn't be exempt")
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestExemptBudget tests that exempt writes are limited once they exceed
+// their budget.
+func TestExemptBudget(t *testing.T) {
+	clock := newFakeClock()
+	rl := NewRateLimitWithOptions(WithWriteBPS(1000), WithExemptBelow(10), WithExemptBudget(50, time.Second), WithClock(clock))
+	for i := 0; i < 5; i++ {
+		if !rl.exempt(9) {
+			t.Fatal("write should be exempt", i)
+		}
+	}
+	if rl.exempt(9) {
+		t.Fatal("write exceeds the budget")
+	}
+	clock.Advance(2 * time.Second)
+	if !rl.exempt(9) {
+		t.Fatal("budget should be available again")
+	}
+
+	// Without a threshold nothing is exempt.
+	if NewRateLimit(0, 1000, 0).exempt(1) {
+		t.Fatal("write shouldn't be exempt")
+	}
+}
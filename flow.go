@@ -0,0 +1,109 @@
+package ratelimit
+
+import "sync"
+
+type (
+	// Priority is the priority of the reads and writes of a RLReadWriter.
+	// When they compete with the reads and writes of other RLReadWriters for
+	// the same limiter, the ones with a higher priority get to go first.
+	Priority int
+
+	// flow is the sequence of reads or writes of a single RLReadWriter in one
+	// direction. Buckets share their bandwidth between the flows waiting for
+	// them proportionally to the flows' weights using start-time fair
+	// queueing. Every transfer is tagged with a virtual start time which is
+	// the later of the bucket's virtual time and the virtual finish time of
+	// the flow's previous transfer. Transfers are served in the order of their
+	// start tags and each transfer of n bytes advances the flow's finish time
+	// by n/weight. Flows with a higher priority are served before the ones
+	// with a lower priority regardless of their start tags.
+	flow struct {
+		weight   float64
+		priority Priority
+
+		mu     sync.Mutex
+		tags   []flowTag    // the finish times of the flow in every bucket it used.
+		charge volumeCharge // the interval of the flow's last charge of a VolumeCap.
+	}
+
+	// flowTag is the virtual finish time of a flow's last transfer in a
+	// bucket.
+	flowTag struct {
+		b      *bucket
+		finish float64
+	}
+)
+
+const (
+	// PriorityLow is the priority of bulk transfers which should only use
+	// the bandwidth that isn't needed otherwise.
+	PriorityLow Priority = iota - 1
+	// PriorityNormal is the default priority.
+	PriorityNormal
+	// PriorityHigh is the priority of latency-sensitive transfers like
+	// control messages.
+	PriorityHigh
+)
+
+// newFlow creates a new flow with the provided weight. Weights that aren't
+// positive are treated as 1.
+func newFlow(weight float64) *flow {
+	if !(weight > 0) {
+		weight = 1
+	}
+	return &flow{weight: weight}
+}
+
+// priorityOf returns the priority of the flow. A nil flow has the normal
+// priority.
+func (f *flow) priorityOf() Priority {
+	if f == nil {
+		return PriorityNormal
+	}
+	return f.priority
+}
+
+// start returns the virtual start tag of a transfer of n bytes by the flow in
+// b and advances the flow's finish time in b accordingly. A nil flow always
+// starts at the bucket's virtual time. b.mu must be held by the caller.
+func (f *flow) start(b *bucket, n int) float64 {
+	if f == nil {
+		return b.vtime
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.tags {
+		if f.tags[i].b != b {
+			continue
+		}
+		start := f.tags[i].finish
+		if start < b.vtime {
+			start = b.vtime
+		}
+		f.tags[i].finish = start + float64(n)/f.weight
+		return start
+	}
+	f.tags = append(f.tags, flowTag{b: b, finish: b.vtime + float64(n)/f.weight})
+	return b.vtime
+}
+
+// prune drops the finish times of the flow in the buckets keep returns false
+// for. The flow starts at the virtual time of these buckets again if it
+// returns to them.
+func (f *flow) prune(keep func(*bucket) bool) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tags := f.tags[:0]
+	for _, tag := range f.tags {
+		if keep(tag.b) {
+			tags = append(tags, tag)
+		}
+	}
+	for i := len(tags); i < len(f.tags); i++ {
+		f.tags[i] = flowTag{}
+	}
+	f.tags = tags
+}
@@ -0,0 +1,211 @@
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestWeightedSharing tests that RLReadWriters with different weights share
+// the bandwidth of a RateLimit proportionally to their weights.
+func TestWeightedSharing(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	packetSize := 1000
+	rl := NewRateLimit(0, 100*int64(packetSize), uint64(packetSize))
+
+	// Write as fast as possible on both RLReadWriters for a while.
+	heavy, light := &spyReadWriter{}, &spyReadWriter{}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, rlc := range []*RLReadWriter{
+		NewRLReadWriterWeighted(heavy, rl, 3, stop),
+		NewRLReadWriterWeighted(light, rl, 1, stop),
+	} {
+		wg.Add(1)
+		go func(rlc *RLReadWriter) {
+			defer wg.Done()
+			data := make([]byte, packetSize)
+			for {
+				if _, err := rlc.Write(data); err != nil {
+					return
+				}
+			}
+		}(rlc)
+	}
+	time.Sleep(time.Second)
+	close(stop)
+	wg.Wait()
+
+	// The throughput should roughly match the weights.
+	heavyWritten := atomic.LoadUint64(&heavy.written)
+	lightWritten := atomic.LoadUint64(&light.written)
+	if lightWritten == 0 {
+		t.Fatal("light writer was starved")
+	}
+	ratio := float64(heavyWritten) / float64(lightWritten)
+	if ratio < 2.5 || ratio > 3.5 {
+		t.Fatalf("wrong ratio %.2f: %v vs %v", ratio, heavyWritten, lightWritten)
+	}
+}
+
+// TestFlowStart tests the start tags assigned to the transfers of flows.
+func TestFlowStart(t *testing.T) {
+	b := newBucket(1, 0, realClock{})
+	heavy, light := newFlow(4), newFlow(0)
+
+	// Flows start at the virtual time of the bucket and advance by n/weight.
+	if s := heavy.start(b, 100); s != 0 {
+		t.Fatal("wrong start", s)
+	}
+	if s := heavy.start(b, 100); s != 25 {
+		t.Fatal("wrong start", s)
+	}
+	if s := light.start(b, 100); s != 0 {
+		t.Fatal("wrong start", s)
+	}
+	if s := light.start(b, 100); s != 100 {
+		t.Fatal("wrong start", s)
+	}
+
+	// Flows that fell behind the virtual time catch up.
+	b.vtime = 1000
+	if s := heavy.start(b, 100); s != 1000 {
+		t.Fatal("wrong start", s)
+	}
+	var f *flow
+	if s := f.start(b, 100); s != 1000 {
+		t.Fatal("wrong start", s)
+	}
+
+	// The queue is ordered by start tags and FIFO for equal tags.
+	ws := []*waiter{{start: 2}, {start: 1}, {start: 2}, {start: 0}}
+	for _, w := range ws {
+		b.enqueue(w)
+	}
+	expected := []*waiter{ws[3], ws[1], ws[0], ws[2]}
+	for i := range expected {
+		if b.queue[i] != expected[i] {
+			t.Fatal("wrong order at", i)
+		}
+	}
+}
+
+// TestPriority tests that high-priority writes aren't delayed by low-priority
+// bulk writes sharing the same RateLimit.
+func TestPriority(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	packetSize := 1000
+	rl := NewRateLimit(0, 10*int64(packetSize), uint64(packetSize))
+
+	// Start some bulk writers.
+	bulk := &spyReadWriter{}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rlc := NewRLReadWriterPriority(bulk, rl, PriorityLow, stop)
+			data := make([]byte, 10*packetSize)
+			for {
+				if _, err := rlc.Write(data); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	// Send small control messages. Without priorities they would have to
+	// wait for a packet of every bulk writer.
+	rlc := NewRLReadWriterPriority(&spyReadWriter{}, rl, PriorityHigh, stop)
+	var total time.Duration
+	messages := 20
+	for i := 0; i < messages; i++ {
+		time.Sleep(50 * time.Millisecond)
+		start := time.Now()
+		if _, err := rlc.Write(make([]byte, 10)); err != nil {
+			t.Fatal(err)
+		}
+		total += time.Since(start)
+	}
+	close(stop)
+	wg.Wait()
+
+	if avg := total / time.Duration(messages); avg > 150*time.Millisecond {
+		t.Fatal("control messages were delayed", avg)
+	}
+	if atomic.LoadUint64(&bulk.written) == 0 {
+		t.Fatal("bulk writers were starved")
+	}
+}
+
+// TestPriorityQueue tests the order of waiters with different priorities.
+func TestPriorityQueue(t *testing.T) {
+	b := newBucket(1, 0, realClock{})
+
+	// Higher priorities get in line first.
+	low := &waiter{priority: PriorityLow}
+	normal := &waiter{priority: PriorityNormal, start: 5}
+	high := &waiter{priority: PriorityHigh, start: 10}
+	for _, w := range []*waiter{low, normal, high} {
+		b.enqueue(w)
+	}
+	if b.queue[0] != high || b.queue[1] != normal || b.queue[2] != low {
+		t.Fatal("wrong order")
+	}
+
+	// A waiter can only be overtaken so many times.
+	b.queue = b.queue[:0]
+	b.enqueue(low)
+	for i := 0; i < maxOvertakes; i++ {
+		b.enqueue(&waiter{priority: PriorityHigh})
+	}
+	if b.queue[maxOvertakes] != low || low.overtaken != maxOvertakes {
+		t.Fatal("low priority waiter should be last", low.overtaken)
+	}
+	b.enqueue(high)
+	if b.queue[maxOvertakes] != low || b.queue[maxOvertakes+1] != high {
+		t.Fatal("low priority waiter was overtaken too often")
+	}
+}
+
+// TestFlowPrune tests that swapping the RateLimit of a RLReadWriter drops the
+// finish times of its flows in the buckets of the previous RateLimit.
+func TestFlowPrune(t *testing.T) {
+	clock := newFakeClock()
+	old := NewRateLimitWithOptions(WithWriteBPS(1000), WithBurst(1000), WithClock(clock))
+	rlc := NewRLReadWriter(&spyReadWriter{}, old, nil)
+	f := rlc.flows[DirectionWrite]
+	if _, err := rlc.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.tags) != 1 || f.tags[0].b != old.write {
+		t.Fatal("flow wasn't tagged in the bucket", f.tags)
+	}
+
+	// After the swap only the bucket of the new RateLimit is tagged.
+	rl := NewRateLimitWithOptions(WithWriteBPS(1000), WithBurst(1000), WithClock(clock))
+	rlc.SetRateLimit(rl)
+	if len(f.tags) != 0 {
+		t.Fatal("tags weren't pruned", f.tags)
+	}
+	if _, err := rlc.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.tags) != 1 || f.tags[0].b != rl.write {
+		t.Fatal("flow wasn't tagged in the new bucket", f.tags)
+	}
+
+	// Tags in the buckets of a parent are kept when swapping to a derived
+	// RateLimit.
+	child := rl.Derive(0.5)
+	rlc.SetRateLimit(child)
+	if len(f.tags) != 1 || f.tags[0].b != rl.write {
+		t.Fatal("tag of the parent was pruned", f.tags)
+	}
+}
@@ -0,0 +1,144 @@
+//go:build go1.18
+// +build go1.18
+
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	// skipClock is a Clock which never blocks. Instead, creating or
+	// resetting a timer moves the clock forward to the time the timer fires.
+	// That way pacing can be verified without waiting.
+	skipClock struct {
+		mu  sync.Mutex
+		now time.Time
+	}
+
+	// skipTimer is a Timer created by a skipClock.
+	skipTimer struct {
+		c     chan time.Time
+		clock *skipClock
+	}
+)
+
+// Now implements the Clock interface.
+func (c *skipClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer implements the Clock interface.
+func (c *skipClock) NewTimer(d time.Duration) Timer {
+	t := &skipTimer{c: make(chan time.Time, 1), clock: c}
+	t.Reset(d)
+	return t
+}
+
+// C implements the Timer interface.
+func (t *skipTimer) C() <-chan time.Time { return t.c }
+
+// Reset implements the Timer interface.
+func (t *skipTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	if d > 0 {
+		t.clock.now = t.clock.now.Add(d)
+	}
+	now := t.clock.now
+	t.clock.mu.Unlock()
+	select {
+	case t.c <- now:
+	default:
+	}
+	return false
+}
+
+// Stop implements the Timer interface.
+func (t *skipTimer) Stop() bool { return false }
+
+// FuzzReadWrite fuzzes interleaved reads and writes of random sizes through a
+// RLReadWriter with random limits and checks that no bytes are lost or
+// duplicated, that the Stats match and that the limits are honored.
+func FuzzReadWrite(f *testing.F) {
+	f.Add([]byte("hello, world"), uint16(4), uint32(10), uint16(5), uint16(3))
+	f.Add(make([]byte, 1000), uint16(64), uint32(1000), uint16(1000), uint16(100))
+	f.Add(make([]byte, 100), uint16(0), uint32(0), uint16(7), uint16(1))
+	f.Fuzz(func(t *testing.T, data []byte, packetSize uint16, bps uint32, writeChunk, readChunk uint16) {
+		ps := uint64(packetSize % 1024)
+		limit := int64(bps % 1000000)
+		wc := 1 + int(writeChunk%2048)
+		rc := 1 + int(readChunk%2048)
+
+		clock := &skipClock{now: time.Unix(0, 0)}
+		rl := NewRateLimitWithOptions(WithReadBPS(limit), WithWriteBPS(limit), WithPacketSize(ps), WithClock(clock))
+		buf := bytes.NewBuffer(nil)
+		rlc := NewRLReadWriter(buf, rl, nil)
+
+		// Interleave writing a chunk with reading a chunk.
+		var read []byte
+		readOnce := func() (int, error) {
+			b := make([]byte, rc)
+			n, err := rlc.Read(b)
+			if n < 0 || n > len(b) {
+				t.Fatalf("read returned %v for a buffer of %v bytes", n, len(b))
+			}
+			read = append(read, b[:n]...)
+			return n, err
+		}
+		for remaining := data; len(remaining) > 0; {
+			chunk := remaining
+			if len(chunk) > wc {
+				chunk = chunk[:wc]
+			}
+			remaining = remaining[len(chunk):]
+			n, err := rlc.Write(chunk)
+			if err != nil || n != len(chunk) {
+				t.Fatalf("write returned %v, %v for a chunk of %v bytes", n, err, len(chunk))
+			}
+			if _, err := readOnce(); err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+		}
+		for {
+			_, err := readOnce()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// No bytes were lost or duplicated.
+		if !bytes.Equal(read, data) {
+			t.Fatalf("read %v bytes which don't match the %v bytes written", len(read), len(data))
+		}
+		stats := rl.Stats()
+		if stats.BytesRead != uint64(len(data)) || stats.BytesWritten != uint64(len(data)) {
+			t.Fatalf("wrong stats %+v for %v bytes", stats, len(data))
+		}
+
+		// Every packet but the last one in each direction had to be paid
+		// for before the next one started. Allow for rounding by 1ns per
+		// byte.
+		for _, chunk := range []int{wc, rc} {
+			largest := uint64(chunk)
+			if ps > 0 && ps < largest {
+				largest = ps
+			}
+			if uint64(len(data)) <= largest {
+				continue
+			}
+			expected := duration(uint64(len(data))-largest, limit)
+			if elapsed := clock.Now().Sub(time.Unix(0, 0)); elapsed+time.Duration(len(data)) < expected {
+				t.Fatalf("limit wasn't honored: %v bytes took %v instead of %v", len(data), elapsed, expected)
+			}
+		}
+	})
+}
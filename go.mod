@@ -2,4 +2,9 @@ module github.com/uplo-tech/ratelimit
 
 go 1.13
 
-require github.com/uplo-tech/uplomux v0.0.0-20210218102326-70ae27ae7d49 // indirect
+require (
+	github.com/prometheus/client_golang v1.9.0
+	github.com/prometheus/client_model v0.2.0
+	github.com/uplo-tech/uplomux v0.0.0-20210218102326-70ae27ae7d49 // indirect
+	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324
+)
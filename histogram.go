@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Bucket is a bucket of the histogram returned by RateLimit.WaitHistogram. It
+// counts the packets which waited for longer than the UpperBound of the
+// previous Bucket and at most UpperBound.
+type Bucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// waitBounds are the upper bounds of the buckets of the wait histogram. The
+// last bucket counts all the waits that exceed the other bounds.
+var waitBounds = [...]time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	maxDuration,
+}
+
+// WaitHistogram returns the distribution of the time packets waited for the
+// global rate limiter in either direction. Packets that didn't have to wait
+// are counted in the first Bucket.
+func (rl *RateLimit) WaitHistogram() []Bucket {
+	buckets := make([]Bucket, len(waitBounds))
+	for i := range buckets {
+		buckets[i] = Bucket{
+			UpperBound: waitBounds[i],
+			Count:      atomic.LoadUint64(&rl.atomicWaits[i]),
+		}
+	}
+	return buckets
+}
+
+// TotalWait returns the total time packets waited for the global rate limiter
+// in either direction. Together with WaitHistogram it can be used to compute
+// the average wait.
+func (rl *RateLimit) TotalWait() time.Duration {
+	return time.Duration(atomic.LoadInt64(&rl.atomicWaitTotal))
+}
+
+// recordWait adds a wait to the wait histogram.
+func (rl *RateLimit) recordWait(waited time.Duration) {
+	if waited > 0 {
+		atomic.AddInt64(&rl.atomicWaitTotal, int64(waited))
+	}
+	i := 0
+	for waited > waitBounds[i] {
+		i++
+	}
+	atomic.AddUint64(&rl.atomicWaits[i], 1)
+}
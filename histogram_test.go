@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestWaitHistogram tests that waits are counted in the right buckets of the
+// wait histogram.
+func TestWaitHistogram(t *testing.T) {
+	rl := NewRateLimit(0, 1000, 10)
+
+	// The first packet doesn't wait, the following ones wait for about 10ms
+	// each.
+	for i := 0; i < 6; i++ {
+		if err := rl.WaitWrite(context.Background(), 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Add some waits that are too long to wait for in a test.
+	rl.throttled(DirectionRead, 3*time.Second, 10)
+	rl.throttled(DirectionRead, time.Hour, 10)
+
+	hist := rl.WaitHistogram()
+	if len(hist) != len(waitBounds) || hist[len(hist)-1].UpperBound != maxDuration {
+		t.Fatal("wrong buckets", hist)
+	}
+	var total, short uint64
+	for i, b := range hist {
+		total += b.Count
+		switch {
+		case b.UpperBound == time.Millisecond && b.Count < 1:
+			t.Fatal("packet without wait wasn't counted", hist)
+		case b.UpperBound > 5*time.Millisecond && b.UpperBound <= 100*time.Millisecond:
+			short += b.Count
+		case b.UpperBound == 5*time.Second && b.Count != 1:
+			t.Fatal("long wait wasn't counted", hist)
+		case i == len(hist)-1 && b.Count != 1:
+			t.Fatal("very long wait wasn't counted", hist)
+		}
+	}
+	if total != 8 || short < 4 {
+		t.Fatal("waits weren't counted correctly", hist)
+	}
+	if w := rl.TotalWait(); w < time.Hour+3*time.Second+40*time.Millisecond || w > time.Hour+4*time.Second {
+		t.Fatal("wrong total wait", w)
+	}
+}
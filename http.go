@@ -0,0 +1,165 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+type (
+	// rlRoundTripper is a rate-limiting wrapper for the http.RoundTripper
+	// interface. Request bodies are limited by the write limit and response
+	// bodies by the read limit.
+	rlRoundTripper struct {
+		rt     http.RoundTripper
+		rl     Limiter
+		cancel <-chan struct{}
+	}
+
+	// rlBody is a rate-limiting wrapper for the body of a http request or
+	// response. Every read from the body transfers up to a single packet
+	// worth of data in the body's direction.
+	rlBody struct {
+		io.ReadCloser
+		rlrw *RLReadWriter
+		dir  Direction
+	}
+
+	// rlResponseWriter is a rate-limiting wrapper for the http.ResponseWriter
+	// interface. Writes to the response are limited by the write limit.
+	rlResponseWriter struct {
+		http.ResponseWriter
+		rlw io.Writer
+	}
+
+	// rlFlushResponseWriter is a rlResponseWriter which also implements the
+	// http.Flusher interface.
+	rlFlushResponseWriter struct {
+		*rlResponseWriter
+		http.Flusher
+	}
+
+	// statsJSON is the JSON representation of a RateLimit's configuration
+	// and Stats served by StatsHandler.
+	statsJSON struct {
+		Name         string `json:"name"`
+		ReadBPS      int64  `json:"readBPS"`
+		WriteBPS     int64  `json:"writeBPS"`
+		PacketSize   uint64 `json:"packetSize"`
+		BytesRead    uint64 `json:"bytesRead"`
+		BytesWritten uint64 `json:"bytesWritten"`
+		ActiveOps    int    `json:"activeOps"`
+	}
+)
+
+// RateLimitHandler returns a http middleware which limits the responses of
+// the wrapped handler by the write limit of the global rate limiter. If the
+// underlying http.ResponseWriter implements http.Flusher, so does the wrapped
+// one. Closing cancel interrupts all pending writes.
+func RateLimitHandler(rl Limiter, cancel <-chan struct{}) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rlw := &rlResponseWriter{
+				ResponseWriter: w,
+				rlw:            NewRLWriter(w, rl, cancel),
+			}
+			if f, ok := w.(http.Flusher); ok {
+				h.ServeHTTP(rlFlushResponseWriter{rlw, f}, r)
+				return
+			}
+			h.ServeHTTP(rlw, r)
+		})
+	}
+}
+
+// NewRLRoundTripper wraps a http.RoundTripper into a rlRoundTripper. The
+// bodies of outgoing requests are limited by the write limit and the bodies of
+// incoming responses are limited by the read limit of the global rate
+// limiter. Closing cancel interrupts all pending reads and writes. If rt is
+// nil, http.DefaultTransport is used.
+func NewRLRoundTripper(rt http.RoundTripper, rl Limiter, cancel <-chan struct{}) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &rlRoundTripper{
+		rt:     rt,
+		rl:     rl,
+		cancel: cancel,
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (rt *rlRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper shouldn't modify the request so we wrap the body of a
+	// shallow copy.
+	if req.Body != nil && req.Body != http.NoBody {
+		r := new(http.Request)
+		*r = *req
+		r.Body = rt.wrapBody(req.Body, DirectionWrite)
+		if getBody := req.GetBody; getBody != nil {
+			r.GetBody = func() (io.ReadCloser, error) {
+				body, err := getBody()
+				if err != nil || body == nil || body == http.NoBody {
+					return body, err
+				}
+				return rt.wrapBody(body, DirectionWrite), nil
+			}
+		}
+		req = r
+	}
+	resp, err := rt.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = rt.wrapBody(resp.Body, DirectionRead)
+	return resp, nil
+}
+
+// wrapBody wraps a http body into a rlBody for the given direction.
+func (rt *rlRoundTripper) wrapBody(body io.ReadCloser, dir Direction) *rlBody {
+	return &rlBody{
+		ReadCloser: body,
+		rlrw:       NewRLReadWriter(nil, rt.rl, rt.cancel),
+		dir:        dir,
+	}
+}
+
+// Read reads up to a single packet worth of data from the body with the
+// maximum possible speed allowed by the rateLimit.
+func (b *rlBody) Read(p []byte) (int, error) {
+	if packetSize := b.rlrw.packetSize(b.dir); packetSize > 0 && uint64(len(p)) > packetSize {
+		p = p[:packetSize]
+	}
+	defer b.rlrw.end(b.rlrw.begin())
+	return b.rlrw.transferPacket(b.dir, p, b.ReadCloser.Read)
+}
+
+// Write writes to the response with the maximum possible speed allowed by the
+// rateLimit.
+func (w *rlResponseWriter) Write(b []byte) (int, error) {
+	return w.rlw.Write(b)
+}
+
+// StatsHandler returns a read-only http.Handler which serves the current
+// limits and Stats of rl as JSON. Only GET and HEAD requests are allowed.
+func StatsHandler(rl *RateLimit) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		readBPS, writeBPS, packetSize := rl.Limits()
+		stats := rl.Stats()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statsJSON{
+			Name:         rl.Name(),
+			ReadBPS:      readBPS,
+			WriteBPS:     writeBPS,
+			PacketSize:   packetSize,
+			BytesRead:    stats.BytesRead,
+			BytesWritten: stats.BytesWritten,
+			ActiveOps:    rl.ActiveOps(),
+		})
+	})
+}
@@ -0,0 +1,184 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+)
+
+// TestRLRoundTripper tests that a rlRoundTripper limits both request and
+// response bodies.
+func TestRLRoundTripper(t *testing.T) {
+	// Create a server that echoes the request body.
+	data := fastrand.Bytes(500)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength != int64(len(data)) {
+			t.Error("wrong content length", r.ContentLength)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	// Create a rate-limited client.
+	packetSize := uint64(100)
+	bps := int64(1000)
+	rl := NewRateLimit(bps, bps, packetSize)
+	client := &http.Client{
+		Transport: NewRLRoundTripper(http.DefaultTransport, rl, nil),
+	}
+
+	// Post the data and read the response.
+	start := time.Now()
+	resp, err := client.Post(server.URL, "application/octet-stream", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d := time.Since(start)
+
+	// Both the upload and the download should have been paced.
+	if !bytes.Equal(body, data) {
+		t.Fatal("response doesn't match request")
+	}
+	if min := 2 * float64(uint64(len(data))-packetSize) / float64(bps); d.Seconds() < min {
+		t.Fatalf("transfer should take at least %v seconds but took %v", min, d.Seconds())
+	}
+	if stats := rl.Stats(); stats.BytesWritten != uint64(len(data)) || stats.BytesRead != uint64(len(data)) {
+		t.Fatal("wrong stats", stats)
+	}
+}
+
+// TestRateLimitHandler tests that the RateLimitHandler limits responses and
+// forwards flushes.
+func TestRateLimitHandler(t *testing.T) {
+	packetSize := uint64(100)
+	bps := int64(1000)
+	rl := NewRateLimit(bps, bps, packetSize)
+
+	// Create a server that flushes a header before writing the rest of the
+	// response once the client received the header.
+	header := []byte("header")
+	data := fastrand.Bytes(500)
+	received := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write(header)
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Error("ResponseWriter doesn't implement http.Flusher")
+			return
+		}
+		f.Flush()
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Error("client didn't receive the flushed header")
+			return
+		}
+		w.Write(data)
+	})
+	server := httptest.NewServer(RateLimitHandler(rl, nil)(handler))
+	defer server.Close()
+
+	// Download the response.
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Fatal("header wasn't forwarded")
+	}
+	buf := make([]byte, len(header))
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, header) {
+		t.Fatal("wrong header")
+	}
+	close(received)
+	start := time.Now()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, data) {
+		t.Fatal("wrong body")
+	}
+
+	// The body should have been paced.
+	if d := time.Since(start); d.Seconds() < float64(uint64(len(data))-packetSize)/float64(bps) {
+		t.Fatal("response wasn't paced", d)
+	}
+}
+
+// TestStatsHandler tests that the StatsHandler serves the limits and Stats of
+// a RateLimit.
+func TestStatsHandler(t *testing.T) {
+	rl := NewRateLimit(1000, 2000, 100)
+	rl.SetName("stats")
+	rlc := NewRLReadWriter(new(bytes.Buffer), rl, nil)
+	if _, err := rlc.Write(make([]byte, 150)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rlc.Read(make([]byte, 50)); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(StatsHandler(rl))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatal("wrong response", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var stats statsJSON
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	expected := statsJSON{
+		Name:         "stats",
+		ReadBPS:      1000,
+		WriteBPS:     2000,
+		PacketSize:   100,
+		BytesRead:    50,
+		BytesWritten: 150,
+		ActiveOps:    0,
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatal("wrong stats", stats)
+	}
+
+	// The handler is read-only.
+	resp, err = http.Post(server.URL, "application/json", bytes.NewReader([]byte("{}")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal("wrong status", resp.StatusCode)
+	}
+}
@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// errAggregateChanged is returned when unmarshaling into a RateLimit in use
+// would change whether reads and writes share a single limit.
+var errAggregateChanged = errors.New("can't change the aggregate mode of a RateLimit in use")
+
+// rateLimitJSON is the JSON representation of a RateLimit's configuration.
+type rateLimitJSON struct {
+	ReadBPS         int64  `json:"readbps"`
+	WriteBPS        int64  `json:"writebps"`
+	PacketSize      uint64 `json:"packetsize"`
+	ReadPacketSize  uint64 `json:"readpacketsize"`
+	WritePacketSize uint64 `json:"writepacketsize"`
+	Burst           uint64 `json:"burst"`
+	Aggregate       bool   `json:"aggregate"`
+	WritePPS        int64  `json:"writepps"`
+	Name            string `json:"name"`
+}
+
+// MarshalJSON implements the json.Marshaler interface. Only the configuration
+// of the RateLimit is marshaled. The pacing state and the Stats are not.
+func (rl *RateLimit) MarshalJSON() ([]byte, error) {
+	return json.Marshal(rateLimitJSON{
+		ReadBPS:         rl.ReadBPS(),
+		WriteBPS:        rl.WriteBPS(),
+		PacketSize:      rl.PacketSize(),
+		ReadPacketSize:  rl.ReadPacketSize(),
+		WritePacketSize: rl.WritePacketSize(),
+		Burst:           rl.read.burstSize(),
+		Aggregate:       rl.read == rl.write,
+		WritePPS:        rl.WritePPS(),
+		Name:            rl.Name(),
+	})
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface. Unmarshaling into
+// a RateLimit that is in use updates its configuration like SetLimits, except
+// for the aggregate mode which can't be changed. A zero value RateLimit is
+// initialized like NewRateLimitWithOptions with the unmarshaled
+// configuration. If the JSON only contains a single packet size, it is used
+// for reads and writes.
+func (rl *RateLimit) UnmarshalJSON(b []byte) error {
+	var rlj rateLimitJSON
+	if err := json.Unmarshal(b, &rlj); err != nil {
+		return err
+	}
+	if rlj.ReadPacketSize == 0 && rlj.WritePacketSize == 0 {
+		rlj.ReadPacketSize, rlj.WritePacketSize = rlj.PacketSize, rlj.PacketSize
+	}
+	if rl.read == nil || rl.write == nil {
+		opts := []Option{
+			WithPacketSizes(rlj.ReadPacketSize, rlj.WritePacketSize),
+			WithBurst(rlj.Burst),
+			WithWritePPS(rlj.WritePPS),
+			WithName(rlj.Name),
+		}
+		if rlj.Aggregate {
+			opts = append(opts, WithAggregateBPS(rlj.ReadBPS))
+		} else {
+			opts = append(opts, WithReadBPS(rlj.ReadBPS), WithWriteBPS(rlj.WriteBPS))
+		}
+		rl.init(newOptions(opts))
+		return nil
+	}
+	if rlj.Aggregate != (rl.read == rl.write) {
+		return errAggregateChanged
+	}
+	rl.read.setBurst(rlj.Burst)
+	rl.write.setBurst(rlj.Burst)
+	rl.SetReadBPS(rlj.ReadBPS)
+	if !rlj.Aggregate {
+		rl.SetWriteBPS(rlj.WriteBPS)
+	}
+	rl.SetPacketSizes(rlj.ReadPacketSize, rlj.WritePacketSize)
+	rl.SetWritePPS(rlj.WritePPS)
+	rl.SetName(rlj.Name)
+	return nil
+}
@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestJSON tests marshaling and unmarshaling a RateLimit.
+func TestJSON(t *testing.T) {
+	rl := NewRateLimitBurst(100, 200, 300, 400)
+	rl.ReserveRead(100)
+	b, err := json.Marshal(rl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the configuration is marshaled.
+	expected := `{"readbps":100,"writebps":200,"packetsize":300,"readpacketsize":300,"writepacketsize":300,"burst":400,"aggregate":false,"writepps":0,"name":""}`
+	if string(b) != expected {
+		t.Fatal("wrong json", string(b))
+	}
+
+	// Unmarshal into a fresh RateLimit.
+	var rl2 RateLimit
+	if err := json.Unmarshal(b, &rl2); err != nil {
+		t.Fatal(err)
+	}
+	if rl2.ReadBPS() != 100 || rl2.WriteBPS() != 200 || rl2.PacketSize() != 300 {
+		t.Fatal("wrong limits", rl2.ReadBPS(), rl2.WriteBPS(), rl2.PacketSize())
+	}
+	if rl2.read.burstSize() != 400 || rl2.write.burstSize() != 400 {
+		t.Fatal("wrong burst", rl2.read.burstSize(), rl2.write.burstSize())
+	}
+	if rl2.Stats() != (Stats{}) {
+		t.Fatal("stats shouldn't be unmarshaled", rl2.Stats())
+	}
+
+	// Unmarshal into an existing RateLimit.
+	rl3 := NewRateLimit(1, 2, 3)
+	if err := json.Unmarshal(b, rl3); err != nil {
+		t.Fatal(err)
+	}
+	if rl3.ReadBPS() != 100 || rl3.WriteBPS() != 200 || rl3.PacketSize() != 300 {
+		t.Fatal("wrong limits", rl3.ReadBPS(), rl3.WriteBPS(), rl3.PacketSize())
+	}
+	if rl3.read.burstSize() != 400 || rl3.write.burstSize() != 400 {
+		t.Fatal("wrong burst", rl3.read.burstSize(), rl3.write.burstSize())
+	}
+
+	// JSON with a single packet size uses it for reads and writes.
+	var rl4 RateLimit
+	if err := json.Unmarshal([]byte(`{"readbps":100,"writebps":200,"packetsize":300}`), &rl4); err != nil {
+		t.Fatal(err)
+	}
+	if rl4.ReadPacketSize() != 300 || rl4.WritePacketSize() != 300 {
+		t.Fatal("wrong packet sizes", rl4.ReadPacketSize(), rl4.WritePacketSize())
+	}
+
+	// Invalid json returns an error.
+	if err := json.Unmarshal([]byte(`{"readbps":"fast"}`), rl3); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// TestJSONRoundTrip tests that marshaling and unmarshaling a RateLimit
+// preserves its whole configuration.
+func TestJSONRoundTrip(t *testing.T) {
+	tests := []*RateLimit{
+		NewRateLimitWithOptions(
+			WithReadBPS(100),
+			WithWriteBPS(200),
+			WithPacketSizes(300, 400),
+			WithBurst(500),
+			WithWritePPS(10),
+			WithName("split"),
+		),
+		NewRateLimitWithOptions(
+			WithAggregateBPS(1000),
+			WithPacketSize(100),
+			WithName("aggregate"),
+		),
+	}
+	for _, rl := range tests {
+		b, err := json.Marshal(rl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rl2 RateLimit
+		if err := json.Unmarshal(b, &rl2); err != nil {
+			t.Fatal(err)
+		}
+		b2, err := json.Marshal(&rl2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != string(b2) {
+			t.Fatalf("configuration changed: %s != %s", b, b2)
+		}
+		if (rl2.read == rl2.write) != (rl.read == rl.write) {
+			t.Fatal("aggregate mode wasn't preserved", rl.Name())
+		}
+		if rl2.messages == nil || rl2.backpressure == nil || rl2.logger == nil {
+			t.Fatal("RateLimit wasn't fully initialized", rl.Name())
+		}
+
+		// The configuration can be applied to a RateLimit in use as long as
+		// the aggregate mode matches.
+		rl3 := NewRateLimitWithOptions(WithReadBPS(1), WithWriteBPS(2))
+		if rl.read == rl.write {
+			if err := json.Unmarshal(b, rl3); err != errAggregateChanged {
+				t.Fatal("expected errAggregateChanged but got", err)
+			}
+			continue
+		}
+		if err := json.Unmarshal(b, rl3); err != nil {
+			t.Fatal(err)
+		}
+		if b3, _ := json.Marshal(rl3); string(b3) != string(b) {
+			t.Fatalf("configuration wasn't applied: %s != %s", b, b3)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type (
+	// LeakyBucketLimiter is a Limiter which smooths out bursts. Reads and
+	// writes fill up a bucket of a fixed depth which leaks at a constant
+	// rate. As long as the bucket has room, reads and writes are accepted
+	// right away. Once it is full, they have to wait for the bucket to leak.
+	LeakyBucketLimiter struct {
+		read  *leakyBucket
+		write *leakyBucket
+		untracked
+	}
+
+	// leakyBucket is the bucket of a LeakyBucketLimiter for a single
+	// direction.
+	leakyBucket struct {
+		rate  int64
+		depth uint64
+		clock Clock
+
+		mu    sync.Mutex
+		empty time.Time // the time at which the bucket will be empty.
+	}
+)
+
+// NewLeakyBucketLimiter creates a new LeakyBucketLimiter which leaks at rate
+// bytes per second in each direction and can hold up to depth bytes. A rate of
+// 0 means that reads and writes are unlimited.
+func NewLeakyBucketLimiter(rate int64, depth uint64) *LeakyBucketLimiter {
+	return &LeakyBucketLimiter{
+		read:  newLeakyBucket(rate, depth, realClock{}),
+		write: newLeakyBucket(rate, depth, realClock{}),
+	}
+}
+
+// newLeakyBucket creates a new, empty leakyBucket.
+func newLeakyBucket(rate int64, depth uint64, clock Clock) *leakyBucket {
+	return &leakyBucket{
+		rate:  rate,
+		depth: depth,
+		clock: clock,
+		empty: clock.Now(),
+	}
+}
+
+// PacketSize returns the depth of the buckets. Reads and writes of a
+// RLReadWriter are split up into packets that fit into a bucket.
+func (l *LeakyBucketLimiter) PacketSize() uint64 {
+	return l.read.depth
+}
+
+// WaitRead blocks until n bytes fit into the read bucket.
+func (l *LeakyBucketLimiter) WaitRead(ctx context.Context, n int) error {
+	_, err := l.read.wait(ctx, n, nil)
+	return err
+}
+
+// WaitWrite blocks until n bytes fit into the write bucket.
+func (l *LeakyBucketLimiter) WaitWrite(ctx context.Context, n int) error {
+	_, err := l.write.wait(ctx, n, nil)
+	return err
+}
+
+// bucket returns the bucket for the given direction.
+func (l *LeakyBucketLimiter) bucket(dir Direction) *leakyBucket {
+	if dir == DirectionRead {
+		return l.read
+	}
+	return l.write
+}
+
+// wait waits until n bytes fit into the bucket for the given direction.
+func (l *LeakyBucketLimiter) wait(ctx context.Context, dir Direction, n int, expired <-chan struct{}, _ *flow) (time.Duration, error) {
+	return l.bucket(dir).wait(ctx, n, expired)
+}
+
+// refund removes n bytes that weren't transferred from the bucket for the
+// given direction.
+func (l *LeakyBucketLimiter) refund(dir Direction, n int, _ *flow) {
+	l.bucket(dir).refund(n)
+}
+
+// try adds n bytes to the bucket for the given direction if they fit right
+// away and returns whether it did.
+func (l *LeakyBucketLimiter) try(dir Direction, n int, _ *flow) bool {
+	return l.bucket(dir).try(n)
+}
+
+// eta returns how long it takes until n bytes fit into the bucket for the
+// given direction.
+func (l *LeakyBucketLimiter) eta(dir Direction, n int) time.Duration {
+	return l.bucket(dir).eta(n)
+}
+
+// wait blocks until n bytes fit into the bucket and returns how long that
+// took. Callers are served in the order they arrive. More than depth bytes are
+// added in chunks of depth bytes, each of which waits for the bucket to have
+// room. If ctx is done or expired is closed before all chunks fit, none of the
+// n bytes remain in the bucket.
+func (lb *leakyBucket) wait(ctx context.Context, n int, expired <-chan struct{}) (time.Duration, error) {
+	if lb.rate <= 0 || n <= 0 {
+		return 0, nil
+	}
+	start := lb.clock.Now()
+	for added := 0; added < n; {
+		chunk := n - added
+		if lb.depth > 0 && uint64(chunk) > lb.depth {
+			chunk = int(lb.depth)
+		}
+		wait := lb.add(chunk)
+		added += chunk
+		if wait <= 0 {
+			continue
+		}
+		timer := lb.clock.NewTimer(wait)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			lb.refund(added)
+			return lb.clock.Now().Sub(start), ctx.Err()
+		case <-expired:
+			timer.Stop()
+			lb.refund(added)
+			return lb.clock.Now().Sub(start), ErrDeadlineExceeded
+		}
+	}
+	return lb.clock.Now().Sub(start), nil
+}
+
+// add adds n bytes to the bucket and returns how long it takes until they
+// fit.
+func (lb *leakyBucket) add(n int) time.Duration {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	now := lb.clock.Now()
+	ready := lb.ready(now, n)
+	lb.empty = lb.empty.Add(duration(uint64(n), lb.rate))
+	return ready.Sub(now)
+}
+
+// try adds n bytes to the bucket if they fit right away and returns whether
+// it did. More than depth bytes never fit right away.
+func (lb *leakyBucket) try(n int) bool {
+	if lb.rate <= 0 {
+		return true
+	}
+	if lb.depth > 0 && uint64(n) > lb.depth {
+		return false
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	now := lb.clock.Now()
+	if lb.ready(now, n).After(now) {
+		return false
+	}
+	lb.empty = lb.empty.Add(duration(uint64(n), lb.rate))
+	return true
+}
+
+// eta returns how long it takes until n bytes fit into the bucket. More than
+// depth bytes fit once the bucket leaked the bytes exceeding the depth.
+func (lb *leakyBucket) eta(n int) time.Duration {
+	if lb.rate <= 0 || n <= 0 {
+		return 0
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	now := lb.clock.Now()
+	var ready time.Time
+	if lb.depth > 0 && uint64(n) > lb.depth {
+		ready = lb.ready(now, int(lb.depth)).Add(duration(uint64(n)-lb.depth, lb.rate))
+	} else {
+		ready = lb.ready(now, n)
+	}
+	if d := ready.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// refund removes n bytes that were added but not transferred from the
+// bucket.
+func (lb *leakyBucket) refund(n int) {
+	if lb.rate <= 0 {
+		return
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.empty = lb.empty.Add(-duration(uint64(n), lb.rate))
+}
+
+// ready returns the time at which n bytes fit into the bucket. The bytes of
+// the past are leaked before. lb.mu must be held by the caller.
+func (lb *leakyBucket) ready(now time.Time, n int) time.Time {
+	if lb.empty.Before(now) {
+		lb.empty = now
+	}
+	if uint64(n) < lb.depth {
+		return lb.empty.Add(-duration(lb.depth-uint64(n), lb.rate))
+	}
+	return lb.empty
+}
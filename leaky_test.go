@@ -0,0 +1,114 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+)
+
+// TestLeakyBucketLimiter tests the burst absorption and the long-run rate of
+// a LeakyBucketLimiter.
+func TestLeakyBucketLimiter(t *testing.T) {
+	rate := int64(10000)
+	depth := uint64(1000)
+	chunk := fastrand.Bytes(100)
+
+	// writeChunks writes n chunks and returns how long it took.
+	writeChunks := func(l Limiter, n int) time.Duration {
+		rlc := NewRLReadWriter(bytes.NewBuffer(nil), l, nil)
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			if _, err := rlc.Write(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return time.Since(start)
+	}
+
+	// A burst that fits into the bucket is absorbed right away while the
+	// strict limiter paces it.
+	if d := writeChunks(NewLeakyBucketLimiter(rate, depth), 10); d > 20*time.Millisecond {
+		t.Fatal("burst wasn't absorbed", d)
+	}
+	if d := writeChunks(NewRateLimit(rate, rate, 0), 10); d < 80*time.Millisecond {
+		t.Fatal("strict limiter didn't pace the burst", d)
+	}
+
+	// In the long run the bucket leaks at the configured rate.
+	d := writeChunks(NewLeakyBucketLimiter(rate, depth), 60)
+	expected := time.Duration(6000-depth) * time.Second / time.Duration(rate)
+	if d < expected || d > expected+200*time.Millisecond {
+		t.Fatal("wrong long-run rate", d, expected)
+	}
+
+	// Writes larger than the bucket are added in chunks of depth bytes. The
+	// second chunk waits for the first one to leak.
+	l := NewLeakyBucketLimiter(rate, depth)
+	start := time.Now()
+	if err := l.WaitWrite(context.Background(), 2000); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 90*time.Millisecond || d > 190*time.Millisecond {
+		t.Fatal("large write wasn't split up", d)
+	}
+	start = time.Now()
+	if err := l.WaitWrite(context.Background(), 2000); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 190*time.Millisecond {
+		t.Fatal("large write didn't wait for the bucket to leak", d)
+	}
+
+	// Waiting can be cancelled.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.WaitWrite(ctx, 2000); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected context.DeadlineExceeded but got", err)
+	}
+
+	// Reads use their own bucket and a rate of 0 is unlimited.
+	if err := l.WaitRead(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewLeakyBucketLimiter(0, 0).WaitWrite(context.Background(), 1<<30); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLeakyBucketShortRead tests that a LeakyBucketLimiter splits up reads
+// into packets that fit into the bucket and only keeps the bytes that were
+// actually read.
+func TestLeakyBucketShortRead(t *testing.T) {
+	rate := int64(10000)
+	depth := uint64(1000)
+	l := NewLeakyBucketLimiter(rate, depth)
+	cr := &chunkReader{chunk: 50}
+	cr.Write(fastrand.Bytes(100))
+	rlc := NewRLReadWriter(cr, l, nil)
+
+	// A read returning 50 bytes leaves room for another 950 bytes.
+	n, err := rlc.Read(make([]byte, 5000))
+	if err != nil || n != cr.chunk {
+		t.Fatal("unexpected read", n, err)
+	}
+	if d := l.eta(DirectionRead, 950); d > 0 {
+		t.Fatal("bucket was charged for the whole buffer", d)
+	}
+	if d := l.eta(DirectionRead, int(depth)); d <= 0 || d > 5*time.Millisecond {
+		t.Fatal("bucket wasn't charged for the read bytes", d)
+	}
+
+	// Writes are split up into packets of depth bytes.
+	spy := &spyReadWriter{}
+	start := time.Now()
+	if _, err := NewRLReadWriter(spy, l, nil).Write(make([]byte, 3000)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 190*time.Millisecond || d > 300*time.Millisecond {
+		t.Fatal("write wasn't paced", d)
+	}
+}
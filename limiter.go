@@ -0,0 +1,279 @@
+package ratelimit
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// Limiter paces the reads and writes of a RLReadWriter. WaitRead and
+	// WaitWrite block until n bytes may be read or written respectively. If
+	// ctx is done before that, they return an error. RateLimit is the default
+	// implementation.
+	Limiter interface {
+		WaitRead(ctx context.Context, n int) error
+		WaitWrite(ctx context.Context, n int) error
+	}
+
+	// packetSizer is implemented by Limiters which want reads and writes to
+	// be split up into packets.
+	packetSizer interface {
+		PacketSize() uint64
+	}
+
+	// dirPacketSizer is implemented by Limiters which split up reads and
+	// writes into packets of different sizes.
+	dirPacketSizer interface {
+		packetSize(dir Direction) uint64
+	}
+
+	// bucketHolder is implemented by Limiters whose buckets tag the
+	// transfers of flows.
+	bucketHolder interface {
+		holds(b *bucket) bool
+	}
+
+	// rateLimiter is implemented by the Limiters of this package. They can
+	// watch deadlines without spawning a goroutine, don't charge for bytes
+	// that weren't transferred and keep track of the transferred bytes.
+	rateLimiter interface {
+		Limiter
+		wait(ctx context.Context, dir Direction, n int, expired <-chan struct{}, f *flow) (time.Duration, error)
+		refund(dir Direction, n int, f *flow)
+		try(dir Direction, n int, f *flow) bool
+		eta(dir Direction, n int) time.Duration
+		begin()
+		end()
+		throttled(dir Direction, waited time.Duration, n int)
+		transferred(dir Direction, n int)
+	}
+
+	// untracked implements the bookkeeping methods of the rateLimiter
+	// interface for Limiters which don't keep Stats or call back on
+	// throttling.
+	untracked struct{}
+
+	// limiterRef is the Limiter of a RLReadWriter. It is replaced as a whole
+	// when the Limiter changes.
+	limiterRef struct {
+		limiter Limiter
+		rl      rateLimiter // the limiter if it is one of this package.
+	}
+)
+
+// begin implements the rateLimiter interface.
+func (untracked) begin() {}
+
+// end implements the rateLimiter interface.
+func (untracked) end() {}
+
+// throttled implements the rateLimiter interface.
+func (untracked) throttled(Direction, time.Duration, int) {}
+
+// transferred implements the rateLimiter interface.
+func (untracked) transferred(Direction, int) {}
+
+// WaitRead blocks until n bytes may be read according to the read limit of
+// the global rate limiter.
+func (rl *RateLimit) WaitRead(ctx context.Context, n int) error {
+	waited, err := rl.wait(ctx, DirectionRead, n, nil, nil)
+	rl.throttled(DirectionRead, waited, n)
+	return err
+}
+
+// WaitWrite blocks until n bytes may be written according to the write limit
+// of the global rate limiter.
+func (rl *RateLimit) WaitWrite(ctx context.Context, n int) error {
+	waited, err := rl.wait(ctx, DirectionWrite, n, nil, nil)
+	rl.throttled(DirectionWrite, waited, n)
+	return err
+}
+
+// holds returns whether b is one of the buckets of the RateLimit or the
+// RateLimits it was derived from.
+func (rl *RateLimit) holds(b *bucket) bool {
+	for ; rl != nil; rl = rl.parent {
+		if b == rl.read || b == rl.write || b == rl.messages {
+			return true
+		}
+	}
+	return false
+}
+
+// wait waits until n bytes may be transferred in the given direction as part
+// of flow f. If expired is closed before that, ErrDeadlineExceeded is
+// returned. Derived RateLimits also wait for their parent.
+func (rl *RateLimit) wait(ctx context.Context, dir Direction, n int, expired <-chan struct{}, f *flow) (time.Duration, error) {
+	if rl.watchdog != nil {
+		defer rl.watchdog.watch(rl, dir, n)()
+	}
+	rl.touch()
+	waited, err := rl.bucket(dir).wait(ctx, n, expired, f)
+	if err != nil || rl.parent == nil {
+		return waited, err
+	}
+	parentWaited, err := rl.parent.wait(ctx, dir, n, expired, f)
+	if err != nil {
+		rl.bucket(dir).refund(n)
+	}
+	return waited + parentWaited, err
+}
+
+// refund returns n bytes that were waited for but not transferred in the
+// given direction as part of flow f.
+func (rl *RateLimit) refund(dir Direction, n int, f *flow) {
+	rl.bucket(dir).refund(n)
+	if rl.parent != nil {
+		rl.parent.refund(dir, n, f)
+	}
+}
+
+// try charges the bucket for the given direction for n bytes if they may be
+// transferred right away as part of flow f and returns whether it did.
+func (rl *RateLimit) try(dir Direction, n int, f *flow) bool {
+	rl.touch()
+	if !rl.bucket(dir).try(n) {
+		return false
+	}
+	if rl.parent != nil && !rl.parent.try(dir, n, f) {
+		rl.bucket(dir).refund(n)
+		return false
+	}
+	return true
+}
+
+// eta returns how long it takes until n bytes may be transferred in the given
+// direction without waiting. Derived RateLimits also take their parent into
+// account.
+func (rl *RateLimit) eta(dir Direction, n int) time.Duration {
+	d := rl.bucket(dir).eta(int64(n))
+	if rl.parent != nil {
+		if parentD := rl.parent.eta(dir, n); parentD > d {
+			d = parentD
+		}
+	}
+	return d
+}
+
+// waitLimiter waits for the provided Limiter of the RLReadWriter to allow
+// transferring n bytes in the given direction. If expired is closed before
+// that, ErrDeadlineExceeded is returned.
+func (l *RLReadWriter) waitLimiter(lim *limiterRef, dir Direction, n int, expired <-chan struct{}) (time.Duration, error) {
+	// The Limiters of this package can watch the deadline themselves.
+	if lim.rl != nil {
+		return lim.rl.wait(l.ctxs[dir], dir, n, expired, l.flows[dir])
+	}
+
+	// Other Limiters only know about contexts.
+	ctx, cancel := context.WithCancel(l.ctxs[dir])
+	defer cancel()
+	go func() {
+		select {
+		case <-expired:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	start := time.Now()
+	var err error
+	if dir == DirectionRead {
+		err = lim.limiter.WaitRead(ctx, n)
+	} else {
+		err = lim.limiter.WaitWrite(ctx, n)
+	}
+	if err != nil && isClosed(expired) && l.ctxs[dir].Err() == nil {
+		err = ErrDeadlineExceeded
+	}
+	return time.Since(start), err
+}
+
+// packetSize returns the packet size of the RLReadWriter's current Limiter for
+// the given direction. Limiters that don't implement a PacketSize method don't
+// have a packet size and neither do directions without a bandwidth limit,
+// which are transferred as a whole. Only RLReadWriters with a progress callback
+// split up unlimited transfers to report every packet.
+func (l *RLReadWriter) packetSize(dir Direction) uint64 {
+	if l.unlimited(dir) {
+		return 0
+	}
+	switch ps := l.current().limiter.(type) {
+	case dirPacketSizer:
+		return ps.packetSize(dir)
+	case packetSizer:
+		return ps.PacketSize()
+	}
+	return 0
+}
+
+// unlimited returns whether neither the RateLimit of the RLReadWriter, nor the
+// RateLimits it was derived from, nor the limit of the connection limit the
+// bandwidth in the given direction and there is no progress to report.
+func (l *RLReadWriter) unlimited(dir Direction) bool {
+	rl, ok := l.current().limiter.(*RateLimit)
+	if !ok || l.onProgress != nil {
+		return false
+	}
+	for ; rl != nil; rl = rl.parent {
+		if rl.bucket(dir).bps() != 0 {
+			return false
+		}
+	}
+	return l.connRL == nil || l.connRL.bucket(dir).bps() == 0
+}
+
+// SetRateLimit replaces the RateLimit governing the RLReadWriter with rl. It
+// takes effect with the next packet. Packets that are already waiting or being
+// transferred are still limited by the previous RateLimit. rl must not be nil.
+func (l *RLReadWriter) SetRateLimit(rl *RateLimit) {
+	l.setLimiter(rl)
+}
+
+// SetEnabled enables or disables the limits of the RLReadWriter. While they are
+// disabled, reads and writes neither wait for the limits nor count towards
+// the Stats of the Limiter. Once they are enabled again, the next packet is
+// limited by the current state of the Limiter. Packets that are already
+// waiting or being transferred are not affected. The quotas of the
+// RLReadWriter still apply while the limits are disabled.
+func (l *RLReadWriter) SetEnabled(enabled bool) {
+	var disabled int32
+	if !enabled {
+		disabled = 1
+	}
+	atomic.StoreInt32(&l.atomicDisabled, disabled)
+}
+
+// disabled returns whether the limits of the RLReadWriter are disabled, either
+// explicitly or because the TLS handshake of the connection is in progress.
+func (l *RLReadWriter) disabled() bool {
+	return atomic.LoadInt32(&l.atomicDisabled) == 1 || l.handshake.exempt()
+}
+
+// setLimiter replaces the Limiter of the RLReadWriter. The flows of the
+// RLReadWriter forget their finish times in the buckets of previous Limiters
+// to not keep them alive.
+func (l *RLReadWriter) setLimiter(limiter Limiter) {
+	lim := &limiterRef{limiter: limiter}
+	lim.rl, _ = limiter.(rateLimiter)
+	l.atomicLimiter.Store(lim)
+
+	holder, _ := limiter.(bucketHolder)
+	for _, f := range l.flows {
+		f.prune(func(b *bucket) bool {
+			return holder != nil && holder.holds(b)
+		})
+	}
+}
+
+// current returns the current Limiter of the RLReadWriter.
+func (l *RLReadWriter) current() *limiterRef {
+	return l.atomicLimiter.Load().(*limiterRef)
+}
+
+// throttled calls the throttle callback of the Limiter if it is one of this
+// package.
+func (lim *limiterRef) throttled(dir Direction, waited time.Duration, n int) {
+	if lim.rl != nil {
+		lim.rl.throttled(dir, waited, n)
+	}
+}
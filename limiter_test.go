@@ -0,0 +1,216 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+)
+
+type (
+	// recordingLimiter is a Limiter that records the calls to WaitRead and
+	// WaitWrite without limiting anything.
+	recordingLimiter struct {
+		mu     sync.Mutex
+		reads  []int
+		writes []int
+	}
+
+	// packetLimiter is a recordingLimiter with a packet size.
+	packetLimiter struct {
+		*recordingLimiter
+		packetSize uint64
+	}
+
+	// blockingLimiter is a Limiter that blocks until the context is done.
+	blockingLimiter struct{}
+)
+
+// WaitRead implements the Limiter interface.
+func (rl *recordingLimiter) WaitRead(ctx context.Context, n int) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.reads = append(rl.reads, n)
+	return nil
+}
+
+// WaitWrite implements the Limiter interface.
+func (rl *recordingLimiter) WaitWrite(ctx context.Context, n int) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.writes = append(rl.writes, n)
+	return nil
+}
+
+// PacketSize returns the packet size of the packetLimiter.
+func (pl packetLimiter) PacketSize() uint64 { return pl.packetSize }
+
+// WaitRead implements the Limiter interface.
+func (blockingLimiter) WaitRead(ctx context.Context, n int) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// WaitWrite implements the Limiter interface.
+func (blockingLimiter) WaitWrite(ctx context.Context, n int) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// TestCustomLimiter tests using a custom Limiter with a RLReadWriter.
+func TestCustomLimiter(t *testing.T) {
+	// Without a packet size every read and write is a single call.
+	rl := &recordingLimiter{}
+	rlc := NewRLReadWriter(bytes.NewBuffer(nil), rl, nil)
+	data := fastrand.Bytes(1000)
+	if _, err := rlc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rlc.Read(make([]byte, 600)); err != nil {
+		t.Fatal(err)
+	}
+	if len(rl.writes) != 1 || rl.writes[0] != 1000 {
+		t.Fatal("wrong writes", rl.writes)
+	}
+	if len(rl.reads) != 1 || rl.reads[0] != 600 {
+		t.Fatal("wrong reads", rl.reads)
+	}
+
+	// With a packet size the calls are split up into packets.
+	pl := packetLimiter{&recordingLimiter{}, 300}
+	rlc = NewRLReadWriter(bytes.NewBuffer(nil), pl, nil)
+	if _, err := rlc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(pl.writes) != 4 || pl.writes[0] != 300 || pl.writes[3] != 100 {
+		t.Fatal("wrong writes", pl.writes)
+	}
+
+	// A blocking limiter is interrupted by deadlines.
+	rlc = NewRLReadWriter(bytes.NewBuffer(nil), blockingLimiter{}, nil)
+	rlc.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := rlc.Write(data)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatal("expected timeout but got", err)
+	}
+
+	// And by the context.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	rlc = NewRLReadWriterCtx(bytes.NewBuffer(nil), blockingLimiter{}, ctx)
+	if _, err := rlc.Write(data); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected context.DeadlineExceeded but got", err)
+	}
+}
+
+// TestRateLimitWait tests the Limiter implementation of RateLimit.
+func TestRateLimitWait(t *testing.T) {
+	rl := NewRateLimit(1000, 1000, 0)
+	var l Limiter = rl
+
+	// The first call goes through right away and the second one needs to
+	// wait for it.
+	start := time.Now()
+	if err := l.WaitWrite(context.Background(), 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.WaitWrite(context.Background(), 100); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatal("WaitWrite didn't wait", d)
+	}
+
+	// A cancelled context interrupts the wait.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.WaitWrite(ctx, 100); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected context.Canceled but got", err)
+	}
+	if err := l.WaitRead(context.Background(), 100); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSetRateLimit tests swapping the RateLimit of a RLReadWriter in the
+// middle of a write.
+func TestSetRateLimit(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	packetSize := 1000
+	slow := NewRateLimit(0, 10*int64(packetSize), uint64(packetSize))
+	fast := NewRateLimit(0, 1000*int64(packetSize), uint64(packetSize))
+	rw := &spyReadWriter{}
+	rlc := NewRLReadWriter(rw, slow, nil)
+
+	// At the slow rate, the write would take 2 seconds.
+	start := time.Now()
+	done := make(chan error)
+	go func() {
+		_, err := rlc.Write(make([]byte, 20*packetSize))
+		done <- err
+	}()
+	time.Sleep(300 * time.Millisecond)
+	if written := atomic.LoadUint64(&rw.written); written >= uint64(10*packetSize) {
+		t.Fatal("first half was written too fast", written)
+	}
+	rlc.SetRateLimit(fast)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("second half wasn't sped up", elapsed)
+	}
+
+	// Both RateLimits were charged for their part of the write and the
+	// operation was ended with the RateLimit it was started with.
+	slowWritten, fastWritten := slow.Stats().BytesWritten, fast.Stats().BytesWritten
+	if slowWritten == 0 || fastWritten == 0 || slowWritten+fastWritten != uint64(20*packetSize) {
+		t.Fatal("wrong stats", slowWritten, fastWritten)
+	}
+	if slow.ActiveOps() != 0 || fast.ActiveOps() != 0 {
+		t.Fatal("operations weren't ended", slow.ActiveOps(), fast.ActiveOps())
+	}
+}
+
+// TestSetEnabled tests disabling and re-enabling the limits of a RLReadWriter
+// during a transfer.
+func TestSetEnabled(t *testing.T) {
+	rl := NewRateLimit(0, 1000, 100)
+	spy := &spyReadWriter{}
+	rlc := NewRLReadWriter(spy, rl, nil)
+
+	// At 1000 bytes per second the write would take 5 seconds but the limits
+	// are disabled after 200ms.
+	time.AfterFunc(200*time.Millisecond, func() { rlc.SetEnabled(false) })
+	start := time.Now()
+	if _, err := rlc.Write(make([]byte, 5000)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatal("disabling the limits didn't speed up the write", d)
+	}
+	if atomic.LoadUint64(&spy.written) != 5000 {
+		t.Fatal("wrong number of bytes written", spy.written)
+	}
+	if written := rl.Stats().BytesWritten; written == 0 || written >= 1000 {
+		t.Fatal("bytes written while disabled were accounted for", written)
+	}
+
+	// Once enabled again, the writes are paced again.
+	rlc.SetEnabled(true)
+	start = time.Now()
+	if _, err := rlc.Write(make([]byte, 300)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatal("write wasn't paced after enabling the limits", d)
+	}
+}
@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// LimiterMap is a collection of RateLimits identified by a key, e.g. the IP
+// address of a client. The RateLimits are created lazily and share the same
+// configuration.
+//
+// A LimiterMap created with NewLimiterMap never removes RateLimits unless
+// Delete is called. A LimiterMap created with NewLimiterMapTTL removes
+// RateLimits that were idle for a while and needs to be closed.
+type LimiterMap struct {
+	opts  []Option
+	ttl   time.Duration
+	clock Clock
+
+	mu       sync.Mutex
+	limiters map[string]*RateLimit
+
+	closeOnce sync.Once
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewLimiterMap creates a new LimiterMap which creates its RateLimits using
+// the provided options.
+func NewLimiterMap(opts ...Option) *LimiterMap {
+	return &LimiterMap{
+		opts:     append([]Option(nil), opts...),
+		clock:    newOptions(opts).clock,
+		limiters: make(map[string]*RateLimit),
+		stop:     make(chan struct{}),
+	}
+}
+
+// NewLimiterMapTTL creates a new LimiterMap like NewLimiterMap which also
+// removes RateLimits that didn't read or write anything for ttl. RateLimits
+// with reads or writes in progress are never removed, even if they are
+// blocked for longer than ttl. Removed
+// RateLimits are replaced by new ones the next time they are requested. The
+// LimiterMap needs to be closed to stop removing RateLimits.
+func NewLimiterMapTTL(ttl time.Duration, opts ...Option) *LimiterMap {
+	lm := NewLimiterMap(opts...)
+	lm.ttl = ttl
+	lm.wg.Add(1)
+	go lm.threadedSweep()
+	return lm
+}
+
+// Close stops removing idle RateLimits.
+func (lm *LimiterMap) Close() error {
+	lm.closeOnce.Do(func() {
+		close(lm.stop)
+	})
+	lm.wg.Wait()
+	return nil
+}
+
+// Get returns the RateLimit for the provided key. If there is none yet, a new
+// one is created.
+func (lm *LimiterMap) Get(key string) *RateLimit {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	rl, ok := lm.limiters[key]
+	if !ok {
+		rl = NewRateLimitWithOptions(lm.opts...)
+		lm.limiters[key] = rl
+	}
+	rl.touch()
+	return rl
+}
+
+// Delete removes the RateLimit for the provided key. RLReadWriters that still
+// use the RateLimit are not affected but a subsequent call to Get returns a
+// new RateLimit.
+func (lm *LimiterMap) Delete(key string) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	delete(lm.limiters, key)
+}
+
+// Len returns the number of RateLimits in the map.
+func (lm *LimiterMap) Len() int {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	return len(lm.limiters)
+}
+
+// sweep removes all the RateLimits that were idle for at least the ttl and
+// have no reads or writes in progress.
+func (lm *LimiterMap) sweep() {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	for key, rl := range lm.limiters {
+		if rl.ActiveOps() == 0 && rl.idle() >= lm.ttl {
+			delete(lm.limiters, key)
+		}
+	}
+}
+
+// threadedSweep periodically removes idle RateLimits until the LimiterMap is
+// closed.
+func (lm *LimiterMap) threadedSweep() {
+	defer lm.wg.Done()
+	interval := lm.ttl / 2
+	if interval <= 0 {
+		interval = time.Millisecond
+	}
+	timer := lm.clock.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-lm.stop:
+			return
+		case <-timer.C():
+		}
+		lm.sweep()
+		timer.Reset(interval)
+	}
+}
@@ -0,0 +1,140 @@
+package ratelimit
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+)
+
+// TestLimiterMap tests that the keys of a LimiterMap get independent
+// RateLimits.
+func TestLimiterMap(t *testing.T) {
+	lm := NewLimiterMap(WithWriteBPS(1000), WithPacketSize(100))
+
+	// The same key returns the same RateLimit.
+	a, b := lm.Get("a"), lm.Get("b")
+	if lm.Get("a") != a || a == b {
+		t.Fatal("wrong RateLimits")
+	}
+	if a.WriteBPS() != 1000 || b.PacketSize() != 100 || lm.Len() != 2 {
+		t.Fatal("wrong configuration", a.WriteBPS(), b.PacketSize(), lm.Len())
+	}
+
+	// Writing 500 bytes to each key at the same time shouldn't take longer
+	// than writing them to a single key.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			rlc := NewRLReadWriter(bytes.NewBuffer(nil), lm.Get(key), nil)
+			if _, err := rlc.Write(fastrand.Bytes(500)); err != nil {
+				t.Error(err)
+			}
+		}(key)
+	}
+	wg.Wait()
+	if d := time.Since(start); d < 400*time.Millisecond || d > 700*time.Millisecond {
+		t.Fatal("keys interfered with each other", d)
+	}
+	if a.Stats().BytesWritten != 500 || b.Stats().BytesWritten != 500 {
+		t.Fatal("wrong stats", a.Stats(), b.Stats())
+	}
+
+	// Deleting a key creates a new RateLimit the next time.
+	lm.Delete("a")
+	if lm.Len() != 1 || lm.Get("a") == a {
+		t.Fatal("RateLimit wasn't deleted")
+	}
+}
+
+// TestLimiterMapTTL tests that idle RateLimits are removed from a LimiterMap.
+func TestLimiterMapTTL(t *testing.T) {
+	clock := newFakeClock()
+	lm := NewLimiterMapTTL(time.Minute, WithWriteBPS(1000), WithClock(clock))
+	defer lm.Close()
+
+	idle, active := lm.Get("idle"), lm.Get("active")
+	rlc := NewRLReadWriter(bytes.NewBuffer(nil), active, nil)
+
+	// Keep one of the RateLimits busy while the other one stays idle.
+	for i := 0; i < 4; i++ {
+		clock.Advance(20 * time.Second)
+		if _, err := rlc.Write(fastrand.Bytes(10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Wait for the sweeper to wait for its next sweep and trigger it.
+	for clock.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(30 * time.Second)
+
+	// Wait for the sweeper to remove the idle RateLimit.
+	for start := time.Now(); lm.Len() != 1; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("idle RateLimit wasn't removed", lm.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if lm.Get("active") != active {
+		t.Fatal("active RateLimit was removed")
+	}
+	if lm.Get("idle") == idle {
+		t.Fatal("idle RateLimit wasn't replaced")
+	}
+
+	// Closing the LimiterMap stops the sweeper.
+	if err := lm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	lm.sweep()
+	if lm.Len() != 0 {
+		t.Fatal("manual sweep should remove idle RateLimits", lm.Len())
+	}
+}
+
+// TestLimiterMapTTLBlocked tests that a RateLimit isn't removed from a
+// LimiterMap while a write is blocked for longer than the ttl.
+func TestLimiterMapTTLBlocked(t *testing.T) {
+	clock := newFakeClock()
+	lm := NewLimiterMapTTL(time.Minute, WithWriteBPS(1000), WithClock(clock))
+	defer lm.Close()
+
+	// Block a write until the RateLimit is resumed.
+	busy := lm.Get("busy")
+	busy.Pause()
+	done := make(chan error, 1)
+	go func() {
+		_, err := NewRLReadWriter(bytes.NewBuffer(nil), busy, nil).Write(fastrand.Bytes(10))
+		done <- err
+	}()
+	for busy.ActiveOps() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The blocked write outlives the ttl without the RateLimit being
+	// removed.
+	clock.Advance(2 * time.Minute)
+	lm.sweep()
+	if lm.Len() != 1 || lm.Get("busy") != busy {
+		t.Fatal("RateLimit was removed while in use", lm.Len())
+	}
+
+	// Once the write is done, the RateLimit can be removed.
+	busy.Resume()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Minute)
+	lm.sweep()
+	if lm.Len() != 0 {
+		t.Fatal("idle RateLimit wasn't removed", lm.Len())
+	}
+}
@@ -0,0 +1,31 @@
+package ratelimit
+
+import "net"
+
+// rlListener is a rate-limiting wrapper for the net.Listener interface.
+type rlListener struct {
+	net.Listener
+	rl     Limiter
+	cancel <-chan struct{}
+}
+
+// NewRLListener wraps a net.Listener into a rlListener. All the connections
+// accepted by the rlListener are wrapped using NewRLConn and share the
+// provided rate limiter. Closing cancel interrupts all pending reads and
+// writes of the accepted connections.
+func NewRLListener(l net.Listener, rl Limiter, cancel <-chan struct{}) net.Listener {
+	return &rlListener{
+		Listener: l,
+		rl:       rl,
+		cancel:   cancel,
+	}
+}
+
+// Accept waits for and returns the next rate-limited connection.
+func (l *rlListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewRLConn(conn, l.rl, l.cancel), nil
+}
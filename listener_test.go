@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+)
+
+// TestRLListener tests that the connections accepted by a rlListener share
+// the same limit.
+func TestRLListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetSize := uint64(100)
+	bps := int64(1000)
+	rl := NewRateLimit(bps, bps, packetSize)
+	rll := NewRLListener(ln, rl, nil)
+	defer rll.Close()
+	if rll.Addr() != ln.Addr() {
+		t.Fatal("wrong address", rll.Addr())
+	}
+
+	// Connect two clients which both send some data.
+	numConns := 2
+	data := fastrand.Bytes(500)
+	for i := 0; i < numConns; i++ {
+		go func() {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			if _, err := conn.Write(data); err != nil {
+				t.Error(err)
+			}
+			io.Copy(ioutil.Discard, conn)
+		}()
+	}
+
+	// Receive the data from both clients at the same time.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < numConns; i++ {
+		conn, err := rll.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := conn.(*rlConn); !ok {
+			t.Fatal("accepted conn isn't rate-limited")
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			if _, err := io.ReadFull(conn, make([]byte, len(data))); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Both connections were limited by the shared limit.
+	expected := time.Duration(uint64(numConns*len(data))-packetSize) * time.Second / time.Duration(bps)
+	if d := time.Since(start); d < expected {
+		t.Fatal("connections weren't limited by the shared limit", d, expected)
+	}
+	if rl.Stats().BytesRead != uint64(numConns*len(data)) {
+		t.Fatal("wrong stats", rl.Stats())
+	}
+
+	// Closing the listener closes the underlying listener.
+	rll.Close()
+	if _, err := ln.Accept(); err == nil {
+		t.Fatal("underlying listener wasn't closed")
+	}
+}
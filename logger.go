@@ -0,0 +1,12 @@
+package ratelimit
+
+import "github.com/uplo-tech/log"
+
+// debugf logs a debug message prefixed with the name of the RateLimit. It must
+// not be called while holding the lock of a bucket.
+func (rl *RateLimit) debugf(format string, v ...interface{}) {
+	if rl.logger == nil || rl.logger == log.DiscardLogger {
+		return
+	}
+	rl.logger.Debugf("ratelimit %q: "+format, append([]interface{}{rl.Name()}, v...)...)
+}
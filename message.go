@@ -0,0 +1,30 @@
+package ratelimit
+
+import (
+	"io"
+
+	"github.com/uplo-tech/uplomux"
+)
+
+// NewRLReadWriterMessages wraps a io.ReadWriter into a RLReadWriter which
+// treats every write as a single message. Instead of splitting a write up into
+// packets, the whole message waits for the limits at once and is then written
+// with a single write to the underlying io.ReadWriter. That way a message is
+// never interrupted by a wait in the middle. Reads are split up into packets
+// as usual.
+func NewRLReadWriterMessages(rw io.ReadWriter, rl Limiter, cancel <-chan struct{}) *RLReadWriter {
+	l := NewRLReadWriter(rw, rl, cancel)
+	l.wholeWrites = true
+	return l
+}
+
+// NewRLStreamMessages wraps a uplomux.Stream into a RLReadWriter like
+// NewRLReadWriterMessages. This keeps partial frames from appearing on the
+// wire while the stream is throttled. Closing cancel interrupts all pending
+// reads and writes.
+func NewRLStreamMessages(stream uplomux.Stream, rl Limiter, cancel <-chan struct{}) *RLStream {
+	return &RLStream{
+		Stream: stream,
+		rlrw:   NewRLReadWriterMessages(stream, rl, cancel),
+	}
+}
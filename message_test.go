@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+	"github.com/uplo-tech/log"
+	"github.com/uplo-tech/uplomux"
+)
+
+// recordStream is a uplomux.Stream that records the size of every write.
+type recordStream struct {
+	uplomux.Stream
+	mu     sync.Mutex
+	writes []int
+}
+
+// Write implements io.Writer.
+func (s *recordStream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	s.writes = append(s.writes, len(b))
+	s.mu.Unlock()
+	return s.Stream.Write(b)
+}
+
+// TestRLStreamMessages tests that a RLStream in message mode writes messages
+// whole while still pacing them.
+func TestRLStreamMessages(t *testing.T) {
+	sm, err := uplomux.New("localhost:0", "localhost:0", log.DiscardLogger, filepath.Join(os.TempDir(), t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sm.Close()
+
+	// Read all the messages on the other end.
+	messages := [][]byte{fastrand.Bytes(250), fastrand.Bytes(250), fastrand.Bytes(250)}
+	received := make(chan []byte, 1)
+	err = sm.NewListener("test", func(stream uplomux.Stream) {
+		defer stream.Close()
+		data := make([]byte, 3*250)
+		if _, err := io.ReadFull(stream, data); err != nil {
+			t.Error(err)
+		}
+		received <- data
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := sm.NewStream("test", sm.Address().String(), sm.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	// Write the messages with a packet size that would split them up. Every
+	// message after the first has to wait for the previous one.
+	rs := &recordStream{Stream: stream}
+	rls := NewRLStreamMessages(rs, NewRateLimit(0, 1000, 100), nil)
+	start := time.Now()
+	for _, msg := range messages {
+		if _, err := rls.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 450*time.Millisecond {
+		t.Fatal("messages weren't paced", d)
+	}
+	rs.mu.Lock()
+	writes := rs.writes
+	rs.mu.Unlock()
+	if len(writes) != len(messages) {
+		t.Fatal("messages were fragmented", writes)
+	}
+	for _, n := range writes {
+		if n != 250 {
+			t.Fatal("messages were fragmented", writes)
+		}
+	}
+	if data := <-received; !bytes.Equal(data, bytes.Join(messages, nil)) {
+		t.Fatal("wrong data received")
+	}
+}
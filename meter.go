@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// throughputWindow is the time constant of the moving average used to
+	// measure the throughput of a RateLimit. Transfers lose about 63% of
+	// their weight in the average after throughputWindow and 95% after three
+	// times that.
+	throughputWindow = 5 * time.Second
+
+	// meterInterval is how often the bytes transferred are added to the
+	// moving average at most. In between they are only counted.
+	meterInterval = 10 * time.Millisecond
+)
+
+// meter measures the throughput in a single direction as an exponentially
+// weighted moving average of the transferred bytes per second. Times are
+// passed to the meter as the time elapsed since the creation of the RateLimit.
+type meter struct {
+	atomicPending uint64 // the bytes not added to the average yet.
+	atomicLast    int64  // the time of the last update of the average.
+
+	mu   sync.Mutex
+	rate float64 // the average as of atomicLast.
+}
+
+// update counts n bytes transferred at now and updates the average if it
+// wasn't updated for meterInterval.
+func (m *meter) update(now time.Duration, n int) {
+	atomic.AddUint64(&m.atomicPending, uint64(n))
+	if now-time.Duration(atomic.LoadInt64(&m.atomicLast)) < meterInterval {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fold(now)
+}
+
+// throughput returns the average as of now in bytes per second.
+func (m *meter) throughput(now time.Duration) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fold(now)
+	return m.rate
+}
+
+// fold decays the average to now and adds the pending bytes to it. m.mu must
+// be held by the caller.
+func (m *meter) fold(now time.Duration) {
+	last := time.Duration(atomic.LoadInt64(&m.atomicLast))
+	if dt := now - last; dt > 0 {
+		m.rate *= math.Exp(-float64(dt) / float64(throughputWindow))
+		atomic.StoreInt64(&m.atomicLast, int64(now))
+	}
+	m.rate += float64(atomic.SwapUint64(&m.atomicPending, 0)) / throughputWindow.Seconds()
+}
@@ -0,0 +1,42 @@
+package ratelimit
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+// TestThroughput tests that the measured throughput converges to the rate at
+// which data is transferred.
+func TestThroughput(t *testing.T) {
+	clock := newFakeClock()
+	rl := NewRateLimitWithOptions(WithClock(clock))
+	rlc := NewRLReadWriter(bytes.NewBuffer(nil), rl, nil)
+
+	// Write 10,000 bytes per second for 6 time constants.
+	rate := 10000.0
+	data := make([]byte, int(rate/10))
+	for i := 0; i < 300; i++ {
+		if _, err := rlc.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(100 * time.Millisecond)
+	}
+	if tp := rl.ThroughputWrite(); math.Abs(tp-rate)/rate > 0.05 {
+		t.Fatal("wrong write throughput", tp)
+	}
+	if tp := rl.ThroughputRead(); tp != 0 {
+		t.Fatal("wrong read throughput", tp)
+	}
+
+	// The throughput goes down while idle.
+	clock.Advance(throughputWindow)
+	if tp := rl.ThroughputWrite(); math.Abs(tp-rate/math.E)/rate > 0.05 {
+		t.Fatal("wrong write throughput", tp)
+	}
+	clock.Advance(10 * throughputWindow)
+	if tp := rl.ThroughputWrite(); tp > rate/1000 {
+		t.Fatal("throughput should have decayed", tp)
+	}
+}
@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"net"
+
+	"github.com/uplo-tech/uplomux"
+	"github.com/uplo-tech/uplomux/mux"
+)
+
+// RLMux is a rate-limiting wrapper for a uplomux.UploMux. Every stream that is
+// opened or accepted through it is wrapped into a RLStream which shares the
+// RLMux's Limiter. Streams should only be opened and accepted through the
+// RLMux to make sure none of them escapes the limit.
+type RLMux struct {
+	sm     *uplomux.UploMux
+	rl     Limiter
+	cancel <-chan struct{}
+}
+
+// NewRLMux wraps a uplomux.UploMux into a RLMux. Closing cancel interrupts all
+// pending reads and writes of the streams.
+func NewRLMux(sm *uplomux.UploMux, rl Limiter, cancel <-chan struct{}) *RLMux {
+	return &RLMux{
+		sm:     sm,
+		rl:     rl,
+		cancel: cancel,
+	}
+}
+
+// Address returns the address of the underlying uplomux.UploMux.
+func (m *RLMux) Address() net.Addr {
+	return m.sm.Address()
+}
+
+// PublicKey returns the public key of the underlying uplomux.UploMux.
+func (m *RLMux) PublicKey() mux.ED25519PublicKey {
+	return m.sm.PublicKey()
+}
+
+// Close closes the underlying uplomux.UploMux.
+func (m *RLMux) Close() error {
+	return m.sm.Close()
+}
+
+// NewListener registers a listener like uplomux.UploMux.NewListener. The
+// handler is called with the accepted streams wrapped into RLStreams.
+func (m *RLMux) NewListener(name string, handler uplomux.Handler) error {
+	return m.sm.NewListener(name, func(stream uplomux.Stream) {
+		handler(NewRLStream(stream, m.rl, m.cancel))
+	})
+}
+
+// CloseListener closes a listener like uplomux.UploMux.CloseListener.
+func (m *RLMux) CloseListener(name string) error {
+	return m.sm.CloseListener(name)
+}
+
+// NewStream opens a new stream like uplomux.UploMux.NewStream and wraps it into
+// a RLStream.
+func (m *RLMux) NewStream(subscriber, address string, expectedPubKey mux.ED25519PublicKey) (uplomux.Stream, error) {
+	stream, err := m.sm.NewStream(subscriber, address, expectedPubKey)
+	if err != nil {
+		return nil, err
+	}
+	return NewRLStream(stream, m.rl, m.cancel), nil
+}
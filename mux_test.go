@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+	"github.com/uplo-tech/log"
+	"github.com/uplo-tech/uplomux"
+)
+
+// TestRLMux tests that all the streams of a RLMux share its RateLimit.
+func TestRLMux(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	sm, err := uplomux.New("localhost:0", "localhost:0", log.DiscardLogger, filepath.Join(os.TempDir(), t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sm.Close()
+
+	// Only limit the writes to see the limit on the dialing side.
+	bps := int64(1000)
+	rl := NewRateLimit(0, bps, 100)
+	m := NewRLMux(sm, rl, nil)
+
+	// Accept streams and read everything that is sent.
+	data := fastrand.Bytes(500)
+	var wg sync.WaitGroup
+	err = m.NewListener("test", func(stream uplomux.Stream) {
+		defer wg.Done()
+		defer stream.Close()
+		if _, ok := stream.(*RLStream); !ok {
+			t.Error("accepted stream wasn't wrapped")
+		}
+		if _, err := io.ReadFull(stream, make([]byte, 2*len(data))); err != nil {
+			t.Error(err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write on two streams at once. Together they write 2000 bytes which
+	// takes at least 1.9 seconds at 1000 bytes per second since only the
+	// first packet doesn't have to wait.
+	start := time.Now()
+	var writers sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		stream, err := m.NewStream("test", m.Address().String(), m.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for j := 0; j < 2; j++ {
+				if _, err := stream.Write(data); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	writers.Wait()
+	wg.Wait()
+	if d := time.Since(start); d < 1900*time.Millisecond {
+		t.Fatal("streams weren't limited together", d)
+	}
+	if stats := rl.Stats(); stats.BytesWritten != 4*uint64(len(data)) {
+		t.Fatal("wrong number of bytes written", stats.BytesWritten)
+	}
+}
@@ -0,0 +1,267 @@
+package ratelimit
+
+import (
+	"time"
+
+	"github.com/uplo-tech/log"
+)
+
+// DefaultPacketSize is the packet size of a RateLimit created with
+// NewRateLimitWithOptions if no packet size is specified.
+const DefaultPacketSize = 1 << 12
+
+type (
+	// Option configures a RateLimit created with NewRateLimitWithOptions.
+	Option func(*options)
+
+	// options contains the configuration of a new RateLimit.
+	options struct {
+		readBPS         int64
+		writeBPS        int64
+		writePPS        int64
+		readPacketSize  uint64
+		writePacketSize uint64
+		burst           uint64
+		startFull       bool
+		name            string
+		clock           Clock
+		aggregate       bool
+		maxBlock        time.Duration
+		jitter          float64
+		minSleep        time.Duration
+
+		exemptBelow  int
+		exemptBudget uint64
+		exemptWindow time.Duration
+
+		watchdogThreshold time.Duration
+		watchdogLogger    *log.Logger
+
+		logger *log.Logger
+	}
+)
+
+// NewRateLimitWithOptions creates a new rateLimit object that is configured
+// by the provided options. By default reads and writes are unlimited, the
+// packet size is DefaultPacketSize, there is no burst and the RateLimit uses
+// the system clock.
+func NewRateLimitWithOptions(opts ...Option) *RateLimit {
+	rl := new(RateLimit)
+	rl.init(newOptions(opts))
+	return rl
+}
+
+// init initializes a zero value RateLimit with the provided options.
+func (rl *RateLimit) init(o options) {
+	rl.atomicReadPacketSize = o.readPacketSize
+	rl.atomicWritePacketSize = o.writePacketSize
+	rl.read = newBucket(o.readBPS, o.burst, o.clock)
+	rl.write = newBucket(o.writeBPS, o.burst, o.clock)
+	rl.messages = newBucket(o.writePPS, 0, o.clock)
+	rl.clock = o.clock
+	rl.created = o.clock.Now()
+	rl.backpressure = make(chan struct{}, 1)
+	rl.logger = o.logger
+	rl.name.Store(o.name)
+	if o.aggregate {
+		rl.write = rl.read
+	}
+	rl.read.maxBlock = o.maxBlock
+	rl.write.maxBlock = o.maxBlock
+	rl.read.jitter = o.jitter
+	rl.write.jitter = o.jitter
+	rl.read.minSleep = o.minSleep
+	rl.write.minSleep = o.minSleep
+	if o.startFull {
+		rl.read.fill()
+		rl.write.fill()
+	}
+	rl.exemptBelow = o.exemptBelow
+	if o.exemptBudget > 0 && o.exemptWindow > 0 {
+		rl.exemptBudget = newSlidingWindow(o.exemptBudget, o.exemptWindow, o.clock)
+	}
+	if o.watchdogThreshold > 0 && o.watchdogLogger != nil {
+		rl.watchdog = &watchdog{
+			threshold: o.watchdogThreshold,
+			logger:    o.watchdogLogger,
+		}
+	}
+}
+
+// newOptions applies opts to the default options.
+func newOptions(opts []Option) options {
+	o := options{
+		readPacketSize:  DefaultPacketSize,
+		writePacketSize: DefaultPacketSize,
+		clock:           realClock{},
+		logger:          log.DiscardLogger,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithReadBPS sets the read limit of the RateLimit. A bps of 0 means that
+// reads are unlimited.
+func WithReadBPS(bps int64) Option {
+	return func(o *options) {
+		o.readBPS = bps
+	}
+}
+
+// WithWriteBPS sets the write limit of the RateLimit. A bps of 0 means that
+// writes are unlimited.
+func WithWriteBPS(bps int64) Option {
+	return func(o *options) {
+		o.writeBPS = bps
+	}
+}
+
+// WithAggregateBPS sets a single limit which is shared by reads and writes.
+// Reading reduces the bandwidth available for writing and vice versa. It
+// overrides WithReadBPS and WithWriteBPS. A bps of 0 means that reads and
+// writes are unlimited.
+func WithAggregateBPS(bps int64) Option {
+	return func(o *options) {
+		o.readBPS = bps
+		o.writeBPS = bps
+		o.aggregate = true
+	}
+}
+
+// WithPacketSize sets the packet size of the RateLimit. A packetSize of 0
+// means that reads and writes are not split up into packets.
+func WithPacketSize(packetSize uint64) Option {
+	return WithPacketSizes(packetSize, packetSize)
+}
+
+// WithPacketSizes sets different packet sizes for reads and writes of the
+// RateLimit. A packet size of 0 means that reads or writes respectively are
+// not split up into packets.
+func WithPacketSizes(readPacket, writePacket uint64) Option {
+	return func(o *options) {
+		o.readPacketSize = readPacket
+		o.writePacketSize = writePacket
+	}
+}
+
+// WithBurst sets the number of bytes of unused bandwidth the RateLimit can
+// accumulate in each direction while idle.
+func WithBurst(burst uint64) Option {
+	return func(o *options) {
+		o.burst = burst
+	}
+}
+
+// WithStartFull makes the RateLimit start as if it had been idle. Instead of
+// pacing from the first byte, it allows for an initial burst of the larger of
+// the burst set by WithBurst and one second's worth of bytes in each
+// direction. Once the initial burst is used up, it only accumulates up to the
+// regular burst while idle.
+func WithStartFull(full bool) Option {
+	return func(o *options) {
+		o.startFull = full
+	}
+}
+
+// WithName sets the name of the RateLimit which identifies it in logs and
+// metrics.
+func WithName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// WithClock sets the Clock the RateLimit or VolumeCap uses to pace reads and
+// writes. This is mostly useful for testing.
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// WithMaxBlock limits how long a single read or write waits for the RateLimit
+// to d. If honoring the limits would require waiting for longer, e.g. because
+// the packet size is too large for the limits, the read or write fails with
+// ErrLimitTooLow instead of blocking. A d of 0 means that waits are not
+// limited.
+func WithMaxBlock(d time.Duration) Option {
+	return func(o *options) {
+		o.maxBlock = d
+	}
+}
+
+// WithPacingJitter randomizes the time every packet is charged for by up to
+// the provided fraction in either direction. That way many connections that
+// start at the same time don't keep sending their packets in lockstep, which
+// smooths out their aggregate traffic. The randomization averages out, so the
+// throughput stays the same in the long run. The fraction is limited to
+// [0, 1] and 0 disables the jitter.
+func WithPacingJitter(fraction float64) Option {
+	return func(o *options) {
+		switch {
+		case !(fraction > 0):
+			fraction = 0
+		case fraction > 1:
+			fraction = 1
+		}
+		o.jitter = fraction
+	}
+}
+
+// WithMinSleep coalesces waits shorter than d. Instead of sleeping for a tiny
+// amount of time before every packet, reads and writes go ahead until they
+// are at least d ahead of the limit and then sleep for the whole time at once.
+// This reduces the timer churn caused by small packets at high limits. The
+// limits still hold in the long run but a burst of up to d worth of bytes can
+// be transferred early.
+func WithMinSleep(d time.Duration) Option {
+	return func(o *options) {
+		o.minSleep = d
+	}
+}
+
+// WithExemptBelow exempts every single Write of fewer than size bytes from the
+// limits of the RateLimit. Such writes neither wait nor use up any bandwidth,
+// which is useful for small control messages sharing a connection with bulk
+// data. They still count towards the Stats. Reads, ReadFrom and WriteBuffers
+// are never exempt.
+//
+// Note that without WithExemptBudget, a caller can evade the limits by
+// splitting a large payload into many small writes.
+func WithExemptBelow(size int) Option {
+	return func(o *options) {
+		o.exemptBelow = size
+	}
+}
+
+// WithExemptBudget limits the writes exempted by WithExemptBelow to a total of
+// maxBytes within any window of the provided duration. Small writes exceeding
+// the budget are limited like any other write.
+func WithExemptBudget(maxBytes uint64, window time.Duration) Option {
+	return func(o *options) {
+		o.exemptBudget = maxBytes
+		o.exemptWindow = window
+	}
+}
+
+// WithWatchdog logs a warning to logger whenever a single read or write waits
+// for the RateLimit for longer than threshold. The warning is logged while the
+// read or write is still waiting and contains its direction and size. The
+// watchdog is purely diagnostic and doesn't affect the wait.
+func WithWatchdog(threshold time.Duration, logger *log.Logger) Option {
+	return func(o *options) {
+		o.watchdogThreshold = threshold
+		o.watchdogLogger = logger
+	}
+}
+
+// WithLogger sets the logger the RateLimit logs significant events like limit
+// changes, pauses and throttled reads and writes to at debug level. By default
+// nothing is logged.
+func WithLogger(logger *log.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
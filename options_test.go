@@ -0,0 +1,296 @@
+package ratelimit
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+	"github.com/uplo-tech/log"
+)
+
+// TestNewRateLimitWithOptions tests creating a RateLimit with options.
+func TestNewRateLimitWithOptions(t *testing.T) {
+	// Without options the RateLimit is unlimited.
+	rl := NewRateLimitWithOptions()
+	if rl.ReadBPS() != 0 || rl.WriteBPS() != 0 {
+		t.Fatal("RateLimit should be unlimited", rl.ReadBPS(), rl.WriteBPS())
+	}
+	if rl.PacketSize() != DefaultPacketSize {
+		t.Fatal("wrong default packet size", rl.PacketSize())
+	}
+	if rl.read.burst != 0 || rl.write.burst != 0 || rl.Name() != "" {
+		t.Fatal("wrong defaults", rl.read.burst, rl.write.burst, rl.Name())
+	}
+
+	// Only set some of the options.
+	rl = NewRateLimitWithOptions(WithWriteBPS(1000), WithName("test"))
+	if rl.ReadBPS() != 0 || rl.WriteBPS() != 1000 {
+		t.Fatal("wrong limits", rl.ReadBPS(), rl.WriteBPS())
+	}
+	if rl.PacketSize() != DefaultPacketSize || rl.Name() != "test" {
+		t.Fatal("wrong options", rl.PacketSize(), rl.Name())
+	}
+
+	// Set all the options.
+	rl = NewRateLimitWithOptions(WithReadBPS(100), WithWriteBPS(200), WithPacketSize(0), WithBurst(300), WithName("all"))
+	if rl.ReadBPS() != 100 || rl.WriteBPS() != 200 || rl.PacketSize() != 0 {
+		t.Fatal("wrong limits", rl.ReadBPS(), rl.WriteBPS(), rl.PacketSize())
+	}
+	if rl.read.burst != 300 || rl.write.burst != 300 || rl.Name() != "all" {
+		t.Fatal("wrong options", rl.read.burst, rl.write.burst, rl.Name())
+	}
+
+	// The positional constructor shouldn't use the defaults.
+	rl = NewRateLimit(1, 2, 0)
+	if rl.ReadBPS() != 1 || rl.WriteBPS() != 2 || rl.PacketSize() != 0 {
+		t.Fatal("wrong limits", rl.ReadBPS(), rl.WriteBPS(), rl.PacketSize())
+	}
+}
+
+// TestMaxBlock tests that waits longer than the maximum block duration fail
+// with ErrLimitTooLow instead of blocking.
+func TestMaxBlock(t *testing.T) {
+	clock := newFakeClock()
+	bps := int64(1000)
+	rl := NewRateLimitWithOptions(WithWriteBPS(bps), WithPacketSize(uint64(2*bps)), WithMaxBlock(time.Second), WithClock(clock))
+	buf := bytes.NewBuffer(nil)
+	rlc := NewRLReadWriter(buf, rl, nil)
+
+	// A packet that takes 2 seconds to transfer can never be allowed.
+	n, err := rlc.Write(fastrand.Bytes(int(2 * bps)))
+	if !errors.Is(err, ErrLimitTooLow) || n != 0 || buf.Len() != 0 {
+		t.Fatal("expected ErrLimitTooLow", n, err)
+	}
+	if avail := rl.AvailableWrite(); avail != 0 {
+		t.Fatal("the RateLimit shouldn't have been charged", avail)
+	}
+
+	// Smaller packets are fine unless the RateLimit owes too much time
+	// already.
+	rl.SetPacketSize(100)
+	rl.ReserveWrite(1500)
+	if _, err := rlc.Write(fastrand.Bytes(100)); !errors.Is(err, ErrLimitTooLow) {
+		t.Fatal("expected ErrLimitTooLow", err)
+	}
+	clock.Advance(time.Second)
+	done := make(chan error)
+	go func() {
+		_, err := rlc.Write(fastrand.Bytes(100))
+		done <- err
+	}()
+	for clock.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(500 * time.Millisecond)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWithLogger tests that a RateLimit logs significant events to its logger
+// at debug level.
+func TestWithLogger(t *testing.T) {
+	buf := &syncBuffer{}
+	logger, err := log.NewLogger(buf, log.Options{Debug: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := NewRateLimitWithOptions(WithName("test"), WithLogger(logger))
+	rl.SetReadBPS(1234)
+	if logged := buf.String(); !strings.Contains(logged, `ratelimit "test": set read limit to 1234 bps`) {
+		t.Fatal("limit change wasn't logged", logged)
+	}
+
+	// Without a logger, nothing is logged.
+	if rl := NewRateLimitWithOptions(); rl.logger != log.DiscardLogger {
+		t.Fatal("wrong default logger")
+	}
+}
+
+// TestSetName tests that the name of a RateLimit round-trips and is used in its
+// log lines.
+func TestSetName(t *testing.T) {
+	buf := &syncBuffer{}
+	logger, err := log.NewLogger(buf, log.Options{Debug: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := NewRateLimitWithOptions(WithLogger(logger))
+	if rl.Name() != "" {
+		t.Fatal("wrong default name", rl.Name())
+	}
+	rl.SetName("uploads")
+	if rl.Name() != "uploads" {
+		t.Fatal("wrong name", rl.Name())
+	}
+	rl.SetWriteBPS(100)
+	if logged := buf.String(); !strings.Contains(logged, `ratelimit "uploads": set write limit to 100 bps`) {
+		t.Fatal("name wasn't logged", logged)
+	}
+
+	// The zero value has an empty name too.
+	if name := new(RateLimit).Name(); name != "" {
+		t.Fatal("wrong name", name)
+	}
+}
+
+// TestWithStartFull tests that a RateLimit which starts full allows for an
+// immediate burst while one that starts empty paces from the first byte.
+func TestWithStartFull(t *testing.T) {
+	clock := newFakeClock()
+	bps := int64(1000)
+	full := NewRateLimitWithOptions(WithWriteBPS(bps), WithPacketSize(100), WithClock(clock), WithStartFull(true))
+	empty := NewRateLimitWithOptions(WithWriteBPS(bps), WithPacketSize(100), WithClock(clock))
+	if avail := full.AvailableWrite(); avail != bps {
+		t.Fatal("wrong initial fill", avail)
+	}
+	if avail := empty.AvailableWrite(); avail != 0 {
+		t.Fatal("bucket should start empty", avail)
+	}
+
+	// One second's worth of bytes is written without waiting.
+	if _, err := NewRLReadWriter(new(bytes.Buffer), full, nil).Write(make([]byte, bps)); err != nil {
+		t.Fatal(err)
+	}
+	if avail := full.AvailableWrite(); avail != 0 {
+		t.Fatal("the initial fill wasn't used up", avail)
+	}
+
+	// Without the fill, the same write is paced after the first packet.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := NewRLReadWriter(new(bytes.Buffer), empty, nil).Write(make([]byte, bps)); err != nil {
+			t.Error(err)
+		}
+	}()
+	for i := 0; i < 9; i++ {
+		for clock.Pending() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(100 * time.Millisecond)
+	}
+	<-done
+
+	// Once the fill is used up, only the regular burst accumulates.
+	clock.Advance(10 * time.Second)
+	if avail := full.AvailableWrite(); avail != 0 {
+		t.Fatal("bucket shouldn't refill beyond the burst", avail)
+	}
+
+	// A larger burst is filled completely.
+	rl := NewRateLimitWithOptions(WithWriteBPS(bps), WithBurst(uint64(3*bps)), WithClock(clock), WithStartFull(true))
+	if avail := rl.AvailableWrite(); avail != 3*bps {
+		t.Fatal("wrong initial fill", avail)
+	}
+}
+
+// TestWithPacingJitter tests that jitter spreads out the packets of RateLimits
+// that start at the same time without changing their throughput.
+func TestWithPacingJitter(t *testing.T) {
+	const (
+		limiters = 100
+		packets  = 50
+		bin      = 10 * time.Millisecond
+	)
+
+	// spread charges the packets of many RateLimits which start at the same
+	// time and returns the mean time it took them to charge all the packets
+	// together with the variance of the number of packets per bin.
+	spread := func(jitter float64) (time.Duration, float64) {
+		clock := newFakeClock()
+		start := clock.Now()
+		counts := make(map[int64]int)
+		var total time.Duration
+		for i := 0; i < limiters; i++ {
+			rl := NewRateLimitWithOptions(WithWriteBPS(1000), WithPacketSize(100), WithClock(clock), WithPacingJitter(jitter))
+			b := rl.write
+			b.mu.Lock()
+			for j := 0; j < packets; j++ {
+				counts[int64(b.block.Sub(start)/bin)]++
+				b.charge(100)
+			}
+			total += b.block.Sub(start)
+			b.mu.Unlock()
+		}
+		mean := float64(limiters*packets) / float64(5*time.Second/bin)
+		var variance float64
+		for i := int64(0); i < int64(5*time.Second/bin); i++ {
+			variance += (float64(counts[i]) - mean) * (float64(counts[i]) - mean)
+		}
+		return total / limiters, variance / float64(5*time.Second/bin)
+	}
+
+	// Without jitter, every RateLimit takes exactly 5 seconds and all the
+	// packets start at the same time.
+	d, lockstep := spread(0)
+	if d != 5*time.Second {
+		t.Fatal("wrong duration", d)
+	}
+	d, jittered := spread(0.5)
+	if d < 4900*time.Millisecond || d > 5100*time.Millisecond {
+		t.Fatal("jitter changed the throughput", d)
+	}
+	if jittered > lockstep/2 {
+		t.Fatal("jitter didn't spread out the packets", jittered, lockstep)
+	}
+
+	// The fraction is limited.
+	if rl := NewRateLimitWithOptions(WithPacingJitter(2)); rl.read.jitter != 1 {
+		t.Fatal("jitter wasn't limited", rl.read.jitter)
+	}
+}
+
+// TestWithMinSleep tests that tiny waits are coalesced into sleeps of at least
+// the minimum without changing the throughput.
+func TestWithMinSleep(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	minSleep := 10 * time.Millisecond
+	rl := NewRateLimitWithOptions(WithWriteBPS(1e6), WithPacketSize(100), WithClock(clock), WithMinSleep(minSleep))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := NewRLReadWriter(new(bytes.Buffer), rl, nil).Write(make([]byte, 1e6)); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// Advance the clock to the expiry of every sleep.
+	var sleeps int
+	for {
+		select {
+		case <-done:
+		default:
+			clock.mu.Lock()
+			var sleep time.Duration
+			if len(clock.timers) > 0 {
+				sleep = clock.timers[0].when.Sub(clock.now)
+			}
+			clock.mu.Unlock()
+			if sleep == 0 {
+				time.Sleep(time.Microsecond)
+				continue
+			}
+			if sleep < minSleep {
+				t.Fatal("sleep shorter than the minimum", sleep)
+			}
+			sleeps++
+			clock.Advance(sleep)
+			continue
+		}
+		break
+	}
+
+	// Without coalescing, every packet after the first would sleep for
+	// 100µs. The 1MB still take about a second.
+	if sleeps == 0 || sleeps > 100 {
+		t.Fatal("wrong number of sleeps", sleeps)
+	}
+	if d := clock.Now().Sub(start); d < time.Second-minSleep || d > time.Second {
+		t.Fatal("wrong duration", d)
+	}
+}
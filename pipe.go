@@ -0,0 +1,56 @@
+package ratelimit
+
+import "io"
+
+type (
+	// PipeReader is the read half of a rate-limited pipe created with
+	// RateLimitedPipe. It behaves like an io.PipeReader.
+	PipeReader struct {
+		*io.PipeReader
+	}
+
+	// PipeWriter is the write half of a rate-limited pipe created with
+	// RateLimitedPipe. It behaves like an io.PipeWriter but its writes are
+	// paced by the write limit of the pipe's Limiter.
+	PipeWriter struct {
+		pw   *io.PipeWriter
+		rlrw *RLReadWriter
+	}
+)
+
+// RateLimitedPipe creates a synchronous in-memory pipe like io.Pipe whose
+// writes are limited by the write limit of the global rate limiter. Closing
+// either half of the pipe behaves like closing the corresponding half of an
+// io.Pipe. Closing cancel interrupts all pending writes.
+func RateLimitedPipe(rl Limiter, cancel <-chan struct{}) (*PipeReader, *PipeWriter) {
+	pr, pw := io.Pipe()
+	return &PipeReader{PipeReader: pr}, &PipeWriter{
+		pw: pw,
+		rlrw: NewRLReadWriter(struct {
+			io.Reader
+			io.Writer
+		}{Writer: pw}, rl, cancel),
+	}
+}
+
+// Write writes b to the pipe with the maximum possible speed allowed by the
+// rate limit. It blocks until the reader consumed all the data or the pipe
+// was closed.
+func (w *PipeWriter) Write(b []byte) (int, error) {
+	return w.rlrw.Write(b)
+}
+
+// Close closes the writer. Subsequent reads from the read half of the pipe
+// return no bytes and io.EOF. Pending writes are interrupted.
+func (w *PipeWriter) Close() error {
+	return w.CloseWithError(nil)
+}
+
+// CloseWithError closes the writer. Subsequent reads from the read half of the
+// pipe return no bytes and err, or io.EOF if err is nil. Pending writes are
+// interrupted.
+func (w *PipeWriter) CloseWithError(err error) error {
+	closeErr := w.pw.CloseWithError(err)
+	w.rlrw.writeDeadline.close()
+	return closeErr
+}
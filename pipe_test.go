@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+)
+
+// TestRateLimitedPipe tests that the data written to a rate-limited pipe is
+// delivered to the reader at the rate of the limit.
+func TestRateLimitedPipe(t *testing.T) {
+	rl := NewRateLimit(0, 1000, 100)
+	pr, pw := RateLimitedPipe(rl, nil)
+	data := fastrand.Bytes(500)
+	go func() {
+		if _, err := pw.Write(data); err != nil {
+			t.Error(err)
+		}
+		pw.Close()
+	}()
+
+	// Reading 5 packets waits for 4 of them.
+	start := time.Now()
+	received, err := ioutil.ReadAll(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("wrong data received")
+	}
+	if d := time.Since(start); d < 400*time.Millisecond || d > 700*time.Millisecond {
+		t.Fatal("wrong delivery rate", d)
+	}
+}
+
+// TestRateLimitedPipeClose tests that closing a rate-limited pipe behaves like
+// closing an io.Pipe.
+func TestRateLimitedPipeClose(t *testing.T) {
+	// Closing the writer with an error passes it on to the reader.
+	pr, pw := RateLimitedPipe(NewRateLimit(0, 0, 100), nil)
+	errFailed := errors.New("failed")
+	pw.CloseWithError(errFailed)
+	if _, err := pr.Read(make([]byte, 1)); err != errFailed {
+		t.Fatal("expected error from writer", err)
+	}
+
+	// Closing the reader fails subsequent writes.
+	pr, pw = RateLimitedPipe(NewRateLimit(0, 0, 100), nil)
+	pr.Close()
+	if _, err := pw.Write([]byte{1}); err != io.ErrClosedPipe {
+		t.Fatal("expected io.ErrClosedPipe", err)
+	}
+
+	// Closing the writer interrupts pending writes.
+	pr, pw = RateLimitedPipe(NewRateLimit(0, 10, 10), nil)
+	go ioutil.ReadAll(pr)
+	time.AfterFunc(50*time.Millisecond, func() { pw.Close() })
+	if n, err := pw.Write(make([]byte, 100)); err == nil || n >= 100 {
+		t.Fatal("write wasn't interrupted", n, err)
+	}
+}
@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// WithWritePPS limits the number of writes per second in addition to the
+// bytes per second. Every call to Write or WriteBuffers and every chunk that
+// ReadFrom writes counts as a single message regardless of its size, so a
+// write has to wait for whichever of the two limits allows it later. A pps of
+// 0 means that the number of writes is not limited.
+func WithWritePPS(pps int64) Option {
+	return func(o *options) {
+		o.writePPS = pps
+	}
+}
+
+// WritePPS returns the current limit on the number of writes per second.
+func (rl *RateLimit) WritePPS() int64 {
+	if rl.messages == nil {
+		return 0
+	}
+	return rl.messages.bps()
+}
+
+// SetWritePPS changes the limit on the number of writes per second. Writes
+// that are already waiting pick up the new limit immediately.
+func (rl *RateLimit) SetWritePPS(pps int64) {
+	if rl.messages == nil {
+		return
+	}
+	rl.messages.setBPS(pps)
+	rl.debugf("set write limit to %v pps", pps)
+}
+
+// waitMessage waits for the packets-per-second limit to allow another write.
+// Derived RateLimits also wait for their parent.
+func (rl *RateLimit) waitMessage(ctx context.Context, expired <-chan struct{}, f *flow) (time.Duration, error) {
+	var waited time.Duration
+	if rl.messages != nil {
+		var err error
+		if waited, err = rl.messages.wait(ctx, 1, expired, f); err != nil {
+			return waited, err
+		}
+	}
+	if rl.parent == nil {
+		return waited, nil
+	}
+	parentWaited, err := rl.parent.waitMessage(ctx, expired, f)
+	if err != nil && rl.messages != nil {
+		rl.messages.refund(1)
+	}
+	return waited + parentWaited, err
+}
+
+// tryMessage charges the packets-per-second limit for another write if it is
+// allowed right away and returns whether it did.
+func (rl *RateLimit) tryMessage() bool {
+	if rl.messages != nil && !rl.messages.try(1) {
+		return false
+	}
+	if rl.parent != nil && !rl.parent.tryMessage() {
+		if rl.messages != nil {
+			rl.messages.refund(1)
+		}
+		return false
+	}
+	return true
+}
+
+// etaMessage returns how long it takes until the packets-per-second limit
+// allows another write. Derived RateLimits also take their parent into
+// account.
+func (rl *RateLimit) etaMessage() time.Duration {
+	var d time.Duration
+	if rl.messages != nil {
+		d = rl.messages.untilReady()
+	}
+	if rl.parent != nil {
+		if parentD := rl.parent.etaMessage(); parentD > d {
+			d = parentD
+		}
+	}
+	return d
+}
+
+// tryMessage charges the packets-per-second limit of the RLReadWriter's
+// Limiter for another write if it is allowed right away. Otherwise it returns
+// ErrDropped together with the time until another write is allowed.
+func (l *RLReadWriter) tryMessage() (time.Duration, error) {
+	rl, ok := l.current().limiter.(*RateLimit)
+	if !ok || l.disabled() || rl.tryMessage() {
+		return 0, nil
+	}
+	return rl.etaMessage(), ErrDropped
+}
+
+// waitMessage waits for the packets-per-second limit of the RLReadWriter's
+// Limiter to allow another write. In drop mode it returns ErrDropped instead
+// of waiting. Only a RateLimit can limit the number of writes and only while
+// the limits of the RLReadWriter are enabled.
+func (l *RLReadWriter) waitMessage() error {
+	rl, ok := l.current().limiter.(*RateLimit)
+	if !ok || l.disabled() {
+		return nil
+	}
+	if l.drop {
+		_, err := l.tryMessage()
+		return err
+	}
+	d := l.deadline(DirectionWrite)
+	expired := d.wait()
+	if isClosed(expired) {
+		return d.err()
+	}
+	if _, err := rl.waitMessage(l.ctxs[DirectionWrite], expired, l.flows[DirectionWrite]); err != nil {
+		return l.waitErr(DirectionWrite, d, err)
+	}
+	return nil
+}
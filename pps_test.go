@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestWritePPS tests that many small writes are paced by the packets per
+// second rather than the bytes per second.
+func TestWritePPS(t *testing.T) {
+	rl := NewRateLimitWithOptions(WithWriteBPS(1e6), WithWritePPS(100))
+	if rl.WritePPS() != 100 {
+		t.Fatal("wrong pps", rl.WritePPS())
+	}
+
+	// 50 writes at 100 writes per second take about half a second while
+	// the bps alone would allow them to finish right away. The first write
+	// doesn't wait.
+	buf := new(bytes.Buffer)
+	rlc := NewRLReadWriter(buf, rl, nil)
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		if _, err := rlc.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 450*time.Millisecond || d > 700*time.Millisecond {
+		t.Fatal("writes weren't paced by the pps", d)
+	}
+	if buf.Len() != 50 {
+		t.Fatal("wrong number of bytes written", buf.Len())
+	}
+
+	// In drop mode, writes exceeding the pps are dropped.
+	drop := NewRLReadWriterDrop(buf, rl, nil)
+	time.Sleep(20 * time.Millisecond)
+	if _, err := drop.Write([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := drop.Write([]byte{2}); !errors.Is(err, ErrDropped) || n != 0 {
+		t.Fatal("expected ErrDropped", n, err)
+	}
+
+	// Without a pps limit, the writes aren't paced.
+	rl.SetWritePPS(0)
+	start = time.Now()
+	for i := 0; i < 50; i++ {
+		if _, err := rlc.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatal("writes shouldn't be paced", d)
+	}
+}
+
+// TestWritePPSReadFromBuffers tests that ReadFrom and WriteBuffers count
+// towards the packets per second.
+func TestWritePPSReadFromBuffers(t *testing.T) {
+	rl := NewRateLimitWithOptions(WithWriteBPS(1e6), WithWritePPS(100))
+	buf := new(bytes.Buffer)
+	rlc := NewRLReadWriter(buf, rl, nil)
+
+	// Every chunk written by ReadFrom is a single write.
+	cr := &chunkReader{chunk: 1}
+	cr.Write(make([]byte, 25))
+	start := time.Now()
+	if n, err := rlc.ReadFrom(cr); err != nil || n != 25 {
+		t.Fatal("unexpected ReadFrom", n, err)
+	}
+	if d := time.Since(start); d < 220*time.Millisecond || d > 450*time.Millisecond {
+		t.Fatal("ReadFrom wasn't paced by the pps", d)
+	}
+
+	// Every call to WriteBuffers is a single write regardless of the number
+	// of buffers.
+	start = time.Now()
+	for i := 0; i < 25; i++ {
+		if _, err := rlc.WriteBuffers(net.Buffers{{1}, {2}, {3}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 230*time.Millisecond || d > 450*time.Millisecond {
+		t.Fatal("WriteBuffers wasn't paced by the pps", d)
+	}
+	if buf.Len() != 100 {
+		t.Fatal("wrong number of bytes written", buf.Len())
+	}
+}
+
+// TestWritePPSTryWrite tests that TryWrite counts towards the packets per
+// second and reports when the next write is allowed.
+func TestWritePPSTryWrite(t *testing.T) {
+	rl := NewRateLimitWithOptions(WithWriteBPS(1e6), WithWritePPS(10))
+	buf := new(bytes.Buffer)
+	rlc := NewRLReadWriter(buf, rl, nil)
+
+	if n, _, err := rlc.TryWrite([]byte{1, 2, 3}); err != nil || n != 3 {
+		t.Fatal("unexpected TryWrite", n, err)
+	}
+
+	// The next write exceeds the pps and nothing is written.
+	n, retryAfter, err := rlc.TryWrite([]byte{4, 5, 6})
+	if !errors.Is(err, ErrDropped) || n != 0 {
+		t.Fatal("expected ErrDropped", n, err)
+	}
+	if retryAfter < 50*time.Millisecond || retryAfter > 100*time.Millisecond {
+		t.Fatal("wrong retryAfter", retryAfter)
+	}
+
+	// Once retryAfter passed, writing is allowed again.
+	time.Sleep(retryAfter)
+	if n, _, err := rlc.TryWrite([]byte{7}); err != nil || n != 1 {
+		t.Fatal("unexpected TryWrite", n, err)
+	}
+	if buf.Len() != 4 {
+		t.Fatal("wrong number of bytes written", buf.Len())
+	}
+}
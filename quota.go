@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrQuotaExceeded is returned by a RLReadWriter once its quota for reads or
+// writes is used up.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// quota is the number of bytes a RLReadWriter may still transfer in a single
+// direction.
+type quota struct {
+	atomicRemaining uint64
+}
+
+// newQuota creates a new quota of n bytes. A quota of 0 means that there is
+// no quota and nil is returned.
+func newQuota(n uint64) *quota {
+	if n == 0 {
+		return nil
+	}
+	return &quota{atomicRemaining: n}
+}
+
+// take takes up to n bytes from the quota and returns how many it took.
+func (q *quota) take(n int) int {
+	for {
+		remaining := atomic.LoadUint64(&q.atomicRemaining)
+		taken := uint64(n)
+		if taken > remaining {
+			taken = remaining
+		}
+		if atomic.CompareAndSwapUint64(&q.atomicRemaining, remaining, remaining-taken) {
+			return int(taken)
+		}
+	}
+}
+
+// give gives n bytes that were taken but not transferred back to the quota.
+func (q *quota) give(n int) {
+	if n > 0 {
+		atomic.AddUint64(&q.atomicRemaining, uint64(n))
+	}
+}
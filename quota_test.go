@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+)
+
+// TestQuota tests the read and write quotas of a RLReadWriter.
+func TestQuota(t *testing.T) {
+	rl := NewRateLimit(0, 0, 100)
+	buf := bytes.NewBuffer(nil)
+	rlc := NewRLReadWriterQuota(buf, rl, 250, 150, nil)
+
+	// Writes within the quota succeed.
+	data := fastrand.Bytes(200)
+	if n, err := rlc.Write(data); err != nil || n != 200 {
+		t.Fatal(n, err)
+	}
+
+	// The write that exceeds the quota writes the remaining allowance.
+	n, err := rlc.Write(data)
+	if !errors.Is(err, ErrQuotaExceeded) || n != 50 {
+		t.Fatal(n, err)
+	}
+	if buf.Len() != 250 || !bytes.Equal(buf.Bytes()[200:], data[:50]) {
+		t.Fatal("wrong data written", buf.Len())
+	}
+
+	// Subsequent writes fail.
+	if n, err := rlc.Write(data[:1]); !errors.Is(err, ErrQuotaExceeded) || n != 0 {
+		t.Fatal(n, err)
+	}
+
+	// Reads return up to the quota and fail afterwards.
+	readData := make([]byte, 200)
+	if n, err := rlc.Read(readData); !errors.Is(err, ErrQuotaExceeded) || n != 150 {
+		t.Fatal(n, err)
+	}
+	if n, err := rlc.Read(readData); !errors.Is(err, ErrQuotaExceeded) || n != 0 {
+		t.Fatal(n, err)
+	}
+
+	// Without a quota there is no limit.
+	rlc = NewRLReadWriterQuota(bytes.NewBuffer(nil), rl, 0, 0, nil)
+	if n, err := rlc.Write(fastrand.Bytes(10000)); err != nil || n != 10000 {
+		t.Fatal(n, err)
+	}
+}
+
+// TestQuotaShortWrite tests that bytes that weren't written don't count
+// towards the quota.
+func TestQuotaShortWrite(t *testing.T) {
+	rl := NewRateLimit(0, 0, 0)
+	sw := &shortWriter{max: 10, fail: true}
+	rlc := NewRLReadWriterQuota(sw, rl, 100, 0, nil)
+
+	// Every write only writes 10 bytes.
+	for i := 0; i < 9; i++ {
+		if n, err := rlc.Write(fastrand.Bytes(50)); n != 10 || !errors.Is(err, io.ErrShortWrite) {
+			t.Fatal(n, err)
+		}
+	}
+
+	// The last 10 bytes of the quota are written.
+	if n, err := rlc.Write(fastrand.Bytes(50)); n != 10 || !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatal(n, err)
+	}
+	if n, err := rlc.Write(fastrand.Bytes(50)); n != 0 || !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatal(n, err)
+	}
+}
+
+// TestGrace tests that the grace bytes of a RLReadWriter aren't limited.
+func TestGrace(t *testing.T) {
+	clock := newFakeClock()
+	rl := NewRateLimitWithOptions(WithWriteBPS(1000), WithPacketSize(100), WithClock(clock))
+	rlc := NewRLReadWriterGrace(bytes.NewBuffer(nil), rl, 1000, nil)
+
+	// Writing the grace bytes doesn't wait or charge the RateLimit. Since the
+	// clock doesn't advance, any wait would block forever.
+	if _, err := rlc.Write(fastrand.Bytes(1000)); err != nil {
+		t.Fatal(err)
+	}
+	if n := rl.AvailableWrite(); n != 0 {
+		t.Fatal("grace bytes were charged", n)
+	}
+
+	// Afterwards writes are paced again.
+	done := make(chan error)
+	go func() {
+		_, err := rlc.Write(fastrand.Bytes(300))
+		done <- err
+	}()
+	for i := 0; i < 2; i++ {
+		for clock.Pending() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(100 * time.Millisecond)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if stats := rl.Stats(); stats.BytesWritten != 1300 {
+		t.Fatal("wrong number of bytes written", stats.BytesWritten)
+	}
+
+	// Packets that are partially covered by grace bytes are charged for the
+	// rest.
+	rl = NewRateLimitWithOptions(WithWriteBPS(1000), WithPacketSize(100), WithClock(clock))
+	rlc = NewRLReadWriterGrace(bytes.NewBuffer(nil), rl, 150, nil)
+	if _, err := rlc.Write(fastrand.Bytes(200)); err != nil {
+		t.Fatal(err)
+	}
+	if n := rl.AvailableWrite(); n != -50 {
+		t.Fatal("wrong charge", n)
+	}
+}
@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// prefixes maps the lowercase unit prefixes understood by ParseRate to their
+// multiplier.
+var prefixes = map[string]float64{
+	"": 1,
+
+	"k": 1e3,
+	"m": 1e6,
+	"g": 1e9,
+	"t": 1e12,
+
+	"ki": 1 << 10,
+	"mi": 1 << 20,
+	"gi": 1 << 30,
+	"ti": 1 << 40,
+}
+
+// NewRateLimitString creates a new rateLimit object like NewRateLimit but the
+// limits are parsed using ParseRate and the packet size is parsed like a rate
+// without the "/s" suffix, e.g. "4KiB".
+func NewRateLimitString(read, write, packet string) (*RateLimit, error) {
+	readBPS, err := ParseRate(read)
+	if err != nil {
+		return nil, fmt.Errorf("invalid read limit: %v", err)
+	}
+	writeBPS, err := ParseRate(write)
+	if err != nil {
+		return nil, fmt.Errorf("invalid write limit: %v", err)
+	}
+	packetSize, err := parseBytes(packet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid packet size: %v", err)
+	}
+	return NewRateLimit(readBPS, writeBPS, uint64(packetSize)), nil
+}
+
+// ParseRate parses a human-readable rate like "10MB/s", "512KiB/s" or
+// "1.5Gbit/s" and returns it in bytes per second. It understands SI and binary
+// byte units as well as bit units. Like in networking, an uppercase "B" stands
+// for bytes and a lowercase "b" for bits, so "10Mb/s" are 10 megabits per
+// second. The prefixes and "bit" are case-insensitive. The "/s" suffix is
+// optional and a rate without a unit is interpreted as bytes per second.
+// Positive rates that round to 0 bytes per second are rejected because a rate
+// of 0 means unlimited.
+func ParseRate(s string) (int64, error) {
+	return parseBytes(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+}
+
+// parseBytes parses a human-readable number of bytes like "4KiB" or "1Mbit".
+func parseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	// Split the number from the unit.
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.' && r != '-' && r != '+'
+	})
+	if i == -1 {
+		i = len(s)
+	}
+	number, unit := s[:i], strings.TrimSpace(s[i:])
+	if number == "" {
+		return 0, fmt.Errorf("missing number in %q", s)
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number in %q: %v", s, err)
+	}
+	if value < 0 {
+		return 0, fmt.Errorf("negative value %q", s)
+	}
+	size, ok := unitSize(unit)
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q in %q", unit, s)
+	}
+	bytes := math.Round(value * size)
+	if bytes >= math.MaxInt64 {
+		return 0, fmt.Errorf("value %q is too large", s)
+	}
+	// A value of 0 means unlimited, so a tiny value must not round to it.
+	if bytes == 0 && value > 0 {
+		return 0, fmt.Errorf("value %q is less than a byte", s)
+	}
+	return int64(bytes), nil
+}
+
+// unitSize returns the size of unit in bytes. The unit is a prefix followed by
+// "B" for bytes or by "b" or "bit" for bits. An empty unit means bytes.
+func unitSize(unit string) (float64, bool) {
+	if unit == "" {
+		return 1, true
+	}
+	var prefix string
+	var size float64
+	switch {
+	case strings.HasSuffix(strings.ToLower(unit), "bit"):
+		prefix, size = unit[:len(unit)-3], 1.0/8
+	case strings.HasSuffix(unit, "B"):
+		prefix, size = unit[:len(unit)-1], 1
+	case strings.HasSuffix(unit, "b"):
+		prefix, size = unit[:len(unit)-1], 1.0/8
+	default:
+		return 0, false
+	}
+	multiplier, ok := prefixes[strings.ToLower(prefix)]
+	return multiplier * size, ok
+}
@@ -0,0 +1,94 @@
+package ratelimit
+
+import "testing"
+
+// TestParseRate tests parsing human-readable rates.
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		s     string
+		bps   int64
+		valid bool
+	}{
+		// Plain bytes.
+		{"0", 0, true},
+		{"100", 100, true},
+		{"100B/s", 100, true},
+		{" 100 B/s ", 100, true},
+
+		// SI units.
+		{"10KB/s", 10e3, true},
+		{"10MB/s", 10e6, true},
+		{"1.5GB/s", 15e8, true},
+		{"2TB/s", 2e12, true},
+		{"10mB/s", 10e6, true},
+		{"10MB", 10e6, true},
+
+		// Binary units.
+		{"512KiB/s", 512 << 10, true},
+		{"10MiB/s", 10 << 20, true},
+		{"1GiB/s", 1 << 30, true},
+		{"1TiB/s", 1 << 40, true},
+
+		// Bit units.
+		{"8bit/s", 1, true},
+		{"1Kbit/s", 125, true},
+		{"100Mbit/s", 125e5, true},
+		{"1.5Gbit/s", 1875e5, true},
+		{"1Tbit/s", 125e9, true},
+		{"1Mibit/s", 1 << 17, true},
+		{"8Mb/s", 1e6, true},
+		{"8mb/s", 1e6, true},
+		{"8Mb", 1e6, true},
+		{"8MBIT/s", 1e6, true},
+		{"8Kib/s", 1 << 10, true},
+		{"8b/s", 1, true},
+
+		// Malformed inputs.
+		{"", 0, false},
+		{"MB/s", 0, false},
+		{"-10MB/s", 0, false},
+		{"10XB/s", 0, false},
+		{"10Mbyte/s", 0, false},
+		{"10M/s", 0, false},
+		{"10MB/h", 0, false},
+		{"1.2.3MB/s", 0, false},
+		{"10 MB / s", 0, false},
+		{"1e20TB/s", 0, false},
+		{"1bit/s", 0, false},
+		{"0.4B/s", 0, false},
+		{"0B/s", 0, true},
+	}
+	for _, test := range tests {
+		bps, err := ParseRate(test.s)
+		if test.valid && err != nil {
+			t.Errorf("%q: unexpected error: %v", test.s, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%q: expected error", test.s)
+		} else if bps != test.bps {
+			t.Errorf("%q: expected %v but got %v", test.s, test.bps, bps)
+		}
+	}
+}
+
+// TestNewRateLimitString tests creating a RateLimit from human-readable
+// strings.
+func TestNewRateLimitString(t *testing.T) {
+	rl, err := NewRateLimitString("1MiB/s", "8Mbit/s", "4KiB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rl.ReadBPS() != 1<<20 || rl.WriteBPS() != 1e6 || rl.PacketSize() != 4<<10 {
+		t.Fatal("wrong limits", rl.ReadBPS(), rl.WriteBPS(), rl.PacketSize())
+	}
+
+	// Invalid inputs.
+	if _, err := NewRateLimitString("1MiB", "-1MB/s", "4KiB"); err == nil {
+		t.Fatal("expected error for invalid write limit")
+	}
+	if _, err := NewRateLimitString("1MiB", "1MB/s", "4KiB/s"); err == nil {
+		t.Fatal("expected error for invalid packet size")
+	}
+	if _, err := NewRateLimitString("fast", "1MB/s", "4KiB"); err == nil {
+		t.Fatal("expected error for invalid read limit")
+	}
+}
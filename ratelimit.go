@@ -1,161 +1,957 @@
 package ratelimit
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/uplo-tech/log"
 	"github.com/uplo-tech/uplomux"
 )
 
 type (
 	// RateLimit declares the global rate limit for read and write operations
 	// on a io.ReadWriter. Whenever a caller wants to read or write, they have
-	// to wait until readBlock/writeBlock to start the actual read or write
-	// operation. Each caller also pushes these timestamps into the future to
-	// prevent other callers to read or write prematurely.
+	// to wait for their turn in the corresponding bucket to start the actual
+	// read or write operation. Each caller also pushes the bucket's block into
+	// the future to prevent other callers to read or write prematurely.
 	RateLimit struct {
-		atomicPacketSize uint64 // the maximum amount of data a caller can read/write at once
-		atomicWriteBPS   int64  // the bytes per second that can be written.
-		atomicReadBPS    int64  // the bytes per second that can be read.
+		atomicReadPacketSize  uint64 // the maximum amount of data a caller can read at once
+		atomicWritePacketSize uint64 // the maximum amount of data a caller can write at once
+		atomicBytesRead       uint64 // the total number of bytes read.
+		atomicBytesWritten    uint64 // the total number of bytes written.
+		atomicLastActive      int64  // the time of the last read or write relative to created.
+		atomicActiveOps       int64  // the number of reads and writes in progress.
 
-		wmu        sync.Mutex // locks writeBlock.
-		writeBlock time.Time  // timestamp before which no new write can start.
+		atomicWaits         [len(waitBounds)]uint64 // the histogram of the waits.
+		atomicWaitTotal     int64                   // the sum of the waits.
+		atomicLastThrottled [2]int64                // the time of the last wait in each direction relative to created.
 
-		rmu       sync.Mutex // locks readBlock.
-		readBlock time.Time  // timestamp before which no new read can start.
+		read  *bucket // paces the read operations.
+		write *bucket // paces the write operations.
+
+		messages *bucket // paces the number of writes.
+
+		readMeter  meter // measures the read throughput.
+		writeMeter meter // measures the write throughput.
+
+		onThrottle   atomic.Value  // the callback called after waiting.
+		backpressure chan struct{} // signaled after waiting.
+
+		name    atomic.Value // identifies the RateLimit in logs and metrics.
+		clock   Clock        // the source of time for pacing.
+		created time.Time    // the time the RateLimit was created.
+
+		drainMu sync.Mutex
+		drained chan struct{} // closed once there are no reads or writes in progress.
+
+		parent   *RateLimit  // the RateLimit this one was derived from.
+		fraction float64     // the fraction of the parent's limits.
+		group    *splitGroup // the group of RateLimits this one was split into.
+
+		childrenMu sync.Mutex
+		children   []*RateLimit // the RateLimits derived from this one.
+
+		exemptBelow  int            // writes smaller than this aren't limited.
+		exemptBudget *slidingWindow // optional budget for exempt writes.
+
+		boostMu sync.Mutex
+		boost   *boost // the pending revert of a Boost.
+
+		watchdog *watchdog   // optionally logs waits that take too long.
+		logger   *log.Logger // logs significant events at debug level.
 	}
 
-	// rlReadWriter is a rate-limiting wrapper for the io.ReadWriter interface.
-	rlReadWriter struct {
+	// Direction is the direction of a rate-limited operation.
+	Direction int
+
+	// Stats contains the number of bytes that were transferred by all the
+	// readers and writers sharing a RateLimit.
+	Stats struct {
+		BytesRead    uint64
+		BytesWritten uint64
+	}
+
+	// RLReadWriter is a rate-limiting wrapper for the io.ReadWriter interface.
+	RLReadWriter struct {
 		io.ReadWriter
-		rl     *RateLimit
-		cancel <-chan struct{}
+		atomicLimiter  atomic.Value // the *limiterRef governing the RLReadWriter.
+		atomicDisabled int32        // whether the limits are bypassed, 1 if they are.
+		connRL         *RateLimit   // optional limit for this connection only.
+
+		readQuota  *quota // optional quota for reads.
+		writeQuota *quota // optional quota for writes.
+
+		onProgress  func(dir Direction, n int) // optional callback after every packet.
+		drop        bool                       // whether writes are dropped instead of waiting.
+		wholeWrites bool                       // whether writes are paced as whole messages.
+		grace       *quota                     // optional bytes that don't have to wait.
+		handshake   *handshake                 // optional handshake that doesn't have to wait.
+		flows       [2]*flow                   // the reads and writes competing for the limiter.
+		ctxs        [2]context.Context         // cancel the reads and writes respectively.
+
+		suspendMu sync.Mutex
+		resumed   chan struct{} // closed on Resume, nil unless suspended.
+
+		readDeadline  *deadline
+		writeDeadline *deadline
+	}
+	// rlReader is a rate-limiting wrapper for the io.Reader interface.
+	rlReader struct {
+		rlrw *RLReadWriter
+	}
+	// rlWriter is a rate-limiting wrapper for the io.Writer interface.
+	rlWriter struct {
+		rlrw *RLReadWriter
 	}
-	// rlStream is a rate-limiting wrapper for the uplomux.Stream interface.
-	rlStream struct {
+	// RLStream is a rate-limiting wrapper for the uplomux.Stream interface.
+	RLStream struct {
 		uplomux.Stream
-		rlrw rlReadWriter
+		rlrw *RLReadWriter
 	}
 	// rlConn is a rate-limiting wrapper for the net.Conn interface.
 	rlConn struct {
 		net.Conn
-		rlrw rlReadWriter
+		rlrw *RLReadWriter
 	}
 )
 
+// transferMode determines whether a packet waits for the limits.
+type transferMode int
+
+const (
+	// transferWait waits for the limits unless the RLReadWriter is in drop
+	// mode.
+	transferWait transferMode = iota
+	// transferTry transfers the packet only if the limits allow it right
+	// away.
+	transferTry
+	// transferExempt doesn't wait for the limits at all.
+	transferExempt
+)
+
+// maxInt is the largest value of an int.
+const maxInt = int(^uint(0) >> 1)
+
+// defaultCopyBufferSize is the size of the buffer used for copying data if the
+// RateLimit doesn't have a packet size.
+const defaultCopyBufferSize = 32 << 10
+
+// saturationWindow is how long a RateLimit is considered saturated in a
+// direction after a read or write had to wait for it.
+const saturationWindow = time.Second
+
+const (
+	// DirectionRead is the direction of read operations.
+	DirectionRead Direction = iota
+	// DirectionWrite is the direction of write operations.
+	DirectionWrite
+)
+
+// String implements the fmt.Stringer interface.
+func (d Direction) String() string {
+	switch d {
+	case DirectionRead:
+		return "read"
+	case DirectionWrite:
+		return "write"
+	default:
+		return "unknown"
+	}
+}
+
 // NewRateLimit creates a new rateLimit object that can be used to initialize
-// rate-limited readers and writers.
+// rate-limited readers and writers. A readBPS or writeBPS of 0 means that
+// reads or writes respectively are unlimited. Negative limits are invalid, see
+// NewRateLimitChecked. A packetSize of 0 means that reads and writes are not
+// split up into packets.
 func NewRateLimit(readBPS, writeBPS int64, packetSize uint64) *RateLimit {
-	return &RateLimit{
-		atomicPacketSize: packetSize,
-		atomicWriteBPS:   writeBPS,
-		atomicReadBPS:    readBPS,
+	return NewRateLimitPackets(readBPS, writeBPS, packetSize, packetSize)
+}
+
+// NewRateLimitPackets creates a new rateLimit object like NewRateLimit but
+// reads and writes are split up into packets of different sizes. A
+// readPacket or writePacket of 0 means that reads or writes respectively are
+// not split up into packets.
+func NewRateLimitPackets(readBPS, writeBPS int64, readPacket, writePacket uint64) *RateLimit {
+	return NewRateLimitWithOptions(
+		WithReadBPS(readBPS),
+		WithWriteBPS(writeBPS),
+		WithPacketSizes(readPacket, writePacket),
+	)
+}
+
+// NewRateLimitBurst creates a new rateLimit object like NewRateLimit but it
+// also allows for accumulating up to burst bytes of unused bandwidth in each
+// direction while idle. The accumulated bandwidth can then be used by
+// subsequent reads and writes without waiting.
+func NewRateLimitBurst(readBPS, writeBPS int64, packetSize, burst uint64) *RateLimit {
+	return NewRateLimitWithOptions(
+		WithReadBPS(readBPS),
+		WithWriteBPS(writeBPS),
+		WithPacketSize(packetSize),
+		WithBurst(burst),
+	)
+}
+
+// NewRateLimitAggregate creates a new rateLimit object like NewRateLimit but
+// reads and writes share a single limit of totalBPS. Reading reduces the
+// bandwidth available for writing and vice versa. Setting either the read or
+// the write limit changes the shared limit.
+func NewRateLimitAggregate(totalBPS int64, packetSize uint64) *RateLimit {
+	return NewRateLimitWithOptions(
+		WithAggregateBPS(totalBPS),
+		WithPacketSize(packetSize),
+	)
+}
+
+// NopRateLimit creates a new rateLimit object that doesn't limit reads and
+// writes at all. They are neither paced nor split up into packets but the
+// transferred bytes are still counted in the Stats. The limits can be changed
+// later like the ones of any other RateLimit.
+func NopRateLimit() *RateLimit {
+	return NewRateLimit(0, 0, 0)
+}
+
+// ErrPacketSizeTooLarge is returned by NewRateLimitChecked if a single packet
+// would exceed the bytes allowed per second.
+var ErrPacketSizeTooLarge = errors.New("packet size exceeds the limit")
+
+// NewRateLimitChecked creates a new rateLimit object like NewRateLimit but it
+// validates the limits first. A readBPS or writeBPS of 0 means unlimited while
+// negative limits are invalid. The packetSize can't exceed the maximum size of
+// a slice or the smallest non-zero limit.
+func NewRateLimitChecked(readBPS, writeBPS int64, packetSize uint64) (*RateLimit, error) {
+	if readBPS < 0 {
+		return nil, fmt.Errorf("invalid read limit %v: limit can't be negative", readBPS)
+	}
+	if writeBPS < 0 {
+		return nil, fmt.Errorf("invalid write limit %v: limit can't be negative", writeBPS)
 	}
+	if packetSize > uint64(maxInt) {
+		return nil, fmt.Errorf("invalid packet size %v: packet size can't exceed %v", packetSize, uint64(maxInt))
+	}
+	for _, bps := range []int64{readBPS, writeBPS} {
+		if bps > 0 && packetSize > uint64(bps) {
+			return nil, fmt.Errorf("invalid packet size %v: %w of %v bps", packetSize, ErrPacketSizeTooLarge, bps)
+		}
+	}
+	return NewRateLimit(readBPS, writeBPS, packetSize), nil
+}
+
+// NewRLReadWriter wraps a io.ReadWriter into a RLReadWriter. Closing cancel
+// interrupts all pending reads and writes.
+func NewRLReadWriter(rw io.ReadWriter, rl Limiter, cancel <-chan struct{}) *RLReadWriter {
+	return NewRLReadWriterCtx(rw, rl, chanContext(cancel))
 }
 
-// NewRLReadWriter wraps a io.ReadWriter into a rlReadWriter.
-func NewRLReadWriter(rw io.ReadWriter, rl *RateLimit, cancel <-chan struct{}) io.ReadWriter {
-	return &rlReadWriter{
-		rw,
-		rl,
-		cancel,
+// NewRLReadWriterCtx wraps a io.ReadWriter into a RLReadWriter. Cancelling ctx
+// interrupts all pending reads and writes.
+func NewRLReadWriterCtx(rw io.ReadWriter, rl Limiter, ctx context.Context) *RLReadWriter {
+	l := &RLReadWriter{
+		ReadWriter:    rw,
+		ctxs:          [2]context.Context{ctx, ctx},
+		flows:         [2]*flow{newFlow(1), newFlow(1)},
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
 	}
+	l.setLimiter(rl)
+	return l
 }
 
-// NewRLConn wraps a net.Conn into a rlReadWriter.
-func NewRLConn(conn net.Conn, rl *RateLimit, cancel <-chan struct{}) net.Conn {
+// NewRLReadWriterSplit wraps a io.ReadWriter into a RLReadWriter with separate
+// cancel channels for each direction. Closing readCancel only interrupts the
+// pending reads while closing writeCancel only interrupts the pending writes.
+func NewRLReadWriterSplit(rw io.ReadWriter, rl Limiter, readCancel, writeCancel <-chan struct{}) *RLReadWriter {
+	l := NewRLReadWriter(rw, rl, readCancel)
+	l.ctxs[DirectionWrite] = chanContext(writeCancel)
+	return l
+}
+
+// NewRLReadWriterLimited wraps a io.ReadWriter into a RLReadWriter which is
+// limited by both the global rate limiter and a limit of perConnBPS for this
+// connection only. A perConnBPS of 0 means that the connection is only limited
+// by the global rate limiter.
+func NewRLReadWriterLimited(rw io.ReadWriter, rl Limiter, perConnBPS int64, cancel <-chan struct{}) *RLReadWriter {
+	l := NewRLReadWriter(rw, rl, cancel)
+	var clock Clock = realClock{}
+	if r, ok := rl.(*RateLimit); ok {
+		clock = r.clock
+	}
+	l.connRL = NewRateLimitWithOptions(WithReadBPS(perConnBPS), WithWriteBPS(perConnBPS), WithPacketSize(0), WithClock(clock))
+	return l
+}
+
+// NewRLReadWriterWeighted wraps a io.ReadWriter into a RLReadWriter which gets
+// a share of the bandwidth of the global rate limiter proportional to weight
+// while competing with other RLReadWriters. RLReadWriters created by the other
+// constructors have a weight of 1. Weights that aren't positive are treated as
+// 1.
+func NewRLReadWriterWeighted(rw io.ReadWriter, rl Limiter, weight float64, cancel <-chan struct{}) *RLReadWriter {
+	l := NewRLReadWriter(rw, rl, cancel)
+	l.flows = [2]*flow{newFlow(weight), newFlow(weight)}
+	return l
+}
+
+// NewRLReadWriterPriority wraps a io.ReadWriter into a RLReadWriter whose reads
+// and writes get in line in front of the ones with a lower priority while
+// competing with other RLReadWriters for the global rate limiter. To prevent
+// starvation, waiting reads and writes can only be overtaken a limited number
+// of times. RLReadWriters created by the other constructors have the priority
+// PriorityNormal.
+func NewRLReadWriterPriority(rw io.ReadWriter, rl Limiter, priority Priority, cancel <-chan struct{}) *RLReadWriter {
+	l := NewRLReadWriter(rw, rl, cancel)
+	for _, f := range l.flows {
+		f.priority = priority
+	}
+	return l
+}
+
+// NewRLReadWriterGrace wraps a io.ReadWriter into a RLReadWriter whose first
+// graceBytes bytes are neither limited by the global rate limiter nor by the
+// limit of the connection. Reads and writes share the grace bytes. After they
+// are used up, reads and writes are limited as usual.
+func NewRLReadWriterGrace(rw io.ReadWriter, rl Limiter, graceBytes uint64, cancel <-chan struct{}) *RLReadWriter {
+	l := NewRLReadWriter(rw, rl, cancel)
+	l.grace = newQuota(graceBytes)
+	return l
+}
+
+// NewRLReadWriterQuota wraps a io.ReadWriter into a RLReadWriter which can
+// only write writeQuota bytes and read readQuota bytes in total. Once a quota
+// is used up, reads or writes respectively fail with ErrQuotaExceeded. A
+// quota of 0 means that there is no quota.
+func NewRLReadWriterQuota(rw io.ReadWriter, rl Limiter, writeQuota, readQuota uint64, cancel <-chan struct{}) *RLReadWriter {
+	l := NewRLReadWriter(rw, rl, cancel)
+	l.readQuota = newQuota(readQuota)
+	l.writeQuota = newQuota(writeQuota)
+	return l
+}
+
+// NewRLReadWriterProgress wraps a io.ReadWriter into a RLReadWriter which
+// calls onProgress with the number of bytes transferred every time a packet
+// was read or written.
+func NewRLReadWriterProgress(rw io.ReadWriter, rl Limiter, cancel <-chan struct{}, onProgress func(dir Direction, n int)) *RLReadWriter {
+	l := NewRLReadWriter(rw, rl, cancel)
+	l.onProgress = onProgress
+	return l
+}
+
+// NewRLReader wraps a io.Reader into a rlReader which is only limited by the
+// read limit of the global rate limiter. Closing cancel interrupts all pending
+// reads.
+func NewRLReader(r io.Reader, rl Limiter, cancel <-chan struct{}) io.Reader {
+	return &rlReader{
+		rlrw: NewRLReadWriter(struct {
+			io.Reader
+			io.Writer
+		}{Reader: r}, rl, cancel),
+	}
+}
+
+// NewRLWriter wraps a io.Writer into a rlWriter which is only limited by the
+// write limit of the global rate limiter. Closing cancel interrupts all pending
+// writes.
+func NewRLWriter(w io.Writer, rl Limiter, cancel <-chan struct{}) io.Writer {
+	return &rlWriter{
+		rlrw: NewRLReadWriter(struct {
+			io.Reader
+			io.Writer
+		}{Writer: w}, rl, cancel),
+	}
+}
+
+// NewRLConn wraps a net.Conn into a RLReadWriter. Closing cancel interrupts
+// all pending reads and writes.
+func NewRLConn(conn net.Conn, rl Limiter, cancel <-chan struct{}) net.Conn {
+	return NewRLConnCtx(conn, rl, chanContext(cancel))
+}
+
+// NewRLConnCtx wraps a net.Conn into a RLReadWriter. Cancelling ctx interrupts
+// all pending reads and writes.
+func NewRLConnCtx(conn net.Conn, rl Limiter, ctx context.Context) net.Conn {
 	return &rlConn{
 		Conn: conn,
-		rlrw: rlReadWriter{
-			ReadWriter: conn,
-			rl:         rl,
-			cancel:     cancel,
-		},
+		rlrw: NewRLReadWriterCtx(conn, rl, ctx),
+	}
+}
+
+// NewRLStream wraps a uplomux.Stream into a RLReadWriter. Closing cancel
+// interrupts all pending reads and writes.
+func NewRLStream(stream uplomux.Stream, rl Limiter, cancel <-chan struct{}) *RLStream {
+	return NewRLStreamCtx(stream, rl, chanContext(cancel))
+}
+
+// NewRLStreamCtx wraps a uplomux.Stream into a RLReadWriter. Cancelling ctx
+// interrupts all pending reads and writes.
+func NewRLStreamCtx(stream uplomux.Stream, rl Limiter, ctx context.Context) *RLStream {
+	return &RLStream{
+		Stream: stream,
+		rlrw:   NewRLReadWriterCtx(stream, rl, ctx),
 	}
 }
 
-// NewRLStream wraps a net.Conn into a rlReadWriter.
-func NewRLStream(stream uplomux.Stream, rl *RateLimit, cancel <-chan struct{}) uplomux.Stream {
-	return &rlStream{
+// NewRLStreamWeighted wraps a uplomux.Stream into a RLReadWriter like
+// NewRLReadWriterWeighted. Closing cancel interrupts all pending reads and
+// writes.
+func NewRLStreamWeighted(stream uplomux.Stream, rl Limiter, weight float64, cancel <-chan struct{}) *RLStream {
+	return &RLStream{
 		Stream: stream,
-		rlrw: rlReadWriter{
-			ReadWriter: stream,
-			rl:         rl,
-			cancel:     cancel,
-		},
+		rlrw:   NewRLReadWriterWeighted(stream, rl, weight, cancel),
 	}
 }
 
-// Limits gets the current limits for the global rate limiter.
+// Limits gets the current limits for the global rate limiter. The packet size
+// is the one returned by PacketSize.
 func (rl *RateLimit) Limits() (int64, int64, uint64) {
-	readBPS := atomic.LoadInt64(&rl.atomicReadBPS)
-	writeBPS := atomic.LoadInt64(&rl.atomicWriteBPS)
-	packetSize := atomic.LoadUint64(&rl.atomicPacketSize)
+	readBPS := rl.read.bps()
+	writeBPS := rl.write.bps()
+	packetSize := rl.PacketSize()
 	return readBPS, writeBPS, packetSize
 }
 
+// Name returns the name of the global rate limiter. The default name is the
+// empty string.
+func (rl *RateLimit) Name() string {
+	name, _ := rl.name.Load().(string)
+	return name
+}
+
+// SetName changes the name of the global rate limiter which identifies it in
+// logs and metrics.
+func (rl *RateLimit) SetName(name string) {
+	rl.name.Store(name)
+}
+
+// ReadBPS returns the current read limit of the global rate limiter.
+func (rl *RateLimit) ReadBPS() int64 {
+	return rl.read.bps()
+}
+
+// WriteBPS returns the current write limit of the global rate limiter.
+func (rl *RateLimit) WriteBPS() int64 {
+	return rl.write.bps()
+}
+
+// PacketSize returns the current packet size of the global rate limiter. If
+// reads and writes use different packet sizes, the smaller one is returned
+// unless it is 0.
+func (rl *RateLimit) PacketSize() uint64 {
+	readPacket, writePacket := rl.ReadPacketSize(), rl.WritePacketSize()
+	if readPacket == 0 || (writePacket > 0 && writePacket < readPacket) {
+		return writePacket
+	}
+	return readPacket
+}
+
+// ReadPacketSize returns the current packet size of reads.
+func (rl *RateLimit) ReadPacketSize() uint64 {
+	return atomic.LoadUint64(&rl.atomicReadPacketSize)
+}
+
+// WritePacketSize returns the current packet size of writes.
+func (rl *RateLimit) WritePacketSize() uint64 {
+	return atomic.LoadUint64(&rl.atomicWritePacketSize)
+}
+
+// packetSize returns the current packet size for the given direction.
+func (rl *RateLimit) packetSize(dir Direction) uint64 {
+	if dir == DirectionRead {
+		return rl.ReadPacketSize()
+	}
+	return rl.WritePacketSize()
+}
+
+// AvailableRead returns the number of bytes the global rate limiter has
+// accumulated for reading while being idle. A negative value means that
+// readers have to wait before they can read again.
+func (rl *RateLimit) AvailableRead() int64 {
+	return rl.read.available()
+}
+
+// AvailableWrite returns the number of bytes the global rate limiter has
+// accumulated for writing while being idle. A negative value means that
+// writers have to wait before they can write again.
+func (rl *RateLimit) AvailableWrite() int64 {
+	return rl.write.available()
+}
+
+// AllowRead consumes n bytes of the global rate limiter's read budget if they
+// are available right away. Otherwise it returns false without consuming
+// anything.
+func (rl *RateLimit) AllowRead(n int) bool {
+	return rl.read.allow(n)
+}
+
+// AllowWrite consumes n bytes of the global rate limiter's write budget if
+// they are available right away. Otherwise it returns false without consuming
+// anything.
+func (rl *RateLimit) AllowWrite(n int) bool {
+	return rl.write.allow(n)
+}
+
+// ReserveRead reserves n bytes of the global rate limiter's read budget and
+// returns how long the caller needs to wait before reading them. A reservation
+// that isn't used should be returned using CancelRead.
+func (rl *RateLimit) ReserveRead(n int) time.Duration {
+	return rl.read.reserve(n)
+}
+
+// ReserveWrite reserves n bytes of the global rate limiter's write budget and
+// returns how long the caller needs to wait before writing them. A
+// reservation that isn't used should be returned using CancelWrite.
+func (rl *RateLimit) ReserveWrite(n int) time.Duration {
+	return rl.write.reserve(n)
+}
+
+// CancelRead returns n previously reserved bytes to the global rate limiter's
+// read budget.
+func (rl *RateLimit) CancelRead(n int) {
+	rl.read.refund(n)
+}
+
+// CancelWrite returns n previously reserved bytes to the global rate
+// limiter's write budget.
+func (rl *RateLimit) CancelWrite(n int) {
+	rl.write.refund(n)
+}
+
+// ETARead estimates how long it takes to read n bytes at the current read
+// limit of the global rate limiter, taking the accumulated bytes into account.
+// It returns 0 if reads are unlimited.
+func (rl *RateLimit) ETARead(n int64) time.Duration {
+	return rl.read.eta(n)
+}
+
+// ETAWrite estimates how long it takes to write n bytes at the current write
+// limit of the global rate limiter, taking the accumulated bytes into account.
+// It returns 0 if writes are unlimited.
+func (rl *RateLimit) ETAWrite(n int64) time.Duration {
+	return rl.write.eta(n)
+}
+
+// Stats returns the number of bytes that were read and written by all the
+// readers and writers sharing the global rate limiter.
+func (rl *RateLimit) Stats() Stats {
+	return Stats{
+		BytesRead:    atomic.LoadUint64(&rl.atomicBytesRead),
+		BytesWritten: atomic.LoadUint64(&rl.atomicBytesWritten),
+	}
+}
+
+// Reset resets the pacing state of the global rate limiter as if it was newly
+// created. The time owed for previous reads and writes as well as any
+// accumulated burst are discarded. The limits and the Stats remain unchanged.
+func (rl *RateLimit) Reset() {
+	rl.read.reset()
+	rl.write.reset()
+	rl.debugf("reset")
+}
+
+// SetOnThrottle sets a callback that is called whenever a read or write had to
+// wait for the global rate limiter. The callback is called from the goroutine
+// of the read or write after it is done waiting. Passing nil removes the
+// callback.
+func (rl *RateLimit) SetOnThrottle(cb func(dir Direction, waited time.Duration, bytes int)) {
+	rl.onThrottle.Store(cb)
+}
+
+// BackpressureC returns a channel which is signaled whenever a read or write
+// had to wait for the global rate limiter. Signals are coalesced, so a single
+// signal may stand for many waits since the channel was last received from.
+// Receiving signals in quick succession means that the RateLimit is saturated.
+func (rl *RateLimit) BackpressureC() <-chan struct{} {
+	return rl.backpressure
+}
+
+// throttled is called after a read or write of n bytes waited for the rate
+// limit. The wait is added to the wait histogram even if it was 0.
+func (rl *RateLimit) throttled(dir Direction, waited time.Duration, n int) {
+	if rl.parent != nil {
+		rl.parent.throttled(dir, waited, n)
+	}
+	rl.recordWait(waited)
+	if waited <= 0 {
+		return
+	}
+	atomic.StoreInt64(&rl.atomicLastThrottled[dir], int64(rl.elapsed()))
+	if rl.logger != log.DiscardLogger {
+		rl.debugf("%v of %v bytes waited for %v", dir, n, waited)
+	}
+	select {
+	case rl.backpressure <- struct{}{}:
+	default:
+	}
+	if cb, _ := rl.onThrottle.Load().(func(Direction, time.Duration, int)); cb != nil {
+		cb(dir, waited, n)
+	}
+}
+
+// bucket returns the bucket for the given direction.
+func (rl *RateLimit) bucket(dir Direction) *bucket {
+	if dir == DirectionRead {
+		return rl.read
+	}
+	return rl.write
+}
+
+// transferred updates the stats after n bytes were transferred in the given
+// direction.
+func (rl *RateLimit) transferred(dir Direction, n int) {
+	if rl.parent != nil {
+		rl.parent.transferred(dir, n)
+	}
+	now := rl.elapsed()
+	atomic.StoreInt64(&rl.atomicLastActive, int64(now))
+	if dir == DirectionRead {
+		atomic.AddUint64(&rl.atomicBytesRead, uint64(n))
+		rl.readMeter.update(now, n)
+	} else {
+		atomic.AddUint64(&rl.atomicBytesWritten, uint64(n))
+		rl.writeMeter.update(now, n)
+	}
+}
+
+// ThroughputRead returns the bytes per second read by all the readers sharing
+// the global rate limiter. It is a moving average over roughly the last 5
+// seconds and can be lower than the limit if the readers don't read as fast
+// as they are allowed to.
+func (rl *RateLimit) ThroughputRead() float64 {
+	return rl.readMeter.throughput(rl.elapsed())
+}
+
+// ThroughputWrite returns the bytes per second written by all the writers
+// sharing the global rate limiter. It is a moving average over roughly the
+// last 5 seconds and can be lower than the limit if the writers don't write
+// as fast as they are allowed to.
+func (rl *RateLimit) ThroughputWrite() float64 {
+	return rl.writeMeter.throughput(rl.elapsed())
+}
+
+// SaturatedRead returns whether a read had to wait for the global rate limiter
+// within the last saturationWindow, i.e. whether the read limit is currently
+// the bottleneck.
+func (rl *RateLimit) SaturatedRead() bool {
+	return rl.saturated(DirectionRead)
+}
+
+// SaturatedWrite returns whether a write had to wait for the global rate
+// limiter within the last saturationWindow, i.e. whether the write limit is
+// currently the bottleneck.
+func (rl *RateLimit) SaturatedWrite() bool {
+	return rl.saturated(DirectionWrite)
+}
+
+// saturated returns whether a read or write in the given direction had to wait
+// within the last saturationWindow.
+func (rl *RateLimit) saturated(dir Direction) bool {
+	last := atomic.LoadInt64(&rl.atomicLastThrottled[dir])
+	return last != 0 && rl.elapsed()-time.Duration(last) < saturationWindow
+}
+
+// ActiveOps returns the number of reads and writes using the RateLimit that
+// are currently in progress, including the ones waiting for their turn.
+func (rl *RateLimit) ActiveOps() int {
+	return int(atomic.LoadInt64(&rl.atomicActiveOps))
+}
+
+// Drain blocks until all the reads and writes that are in progress are done.
+// If ctx is done before that, ctx.Err() is returned.
+func (rl *RateLimit) Drain(ctx context.Context) error {
+	rl.drainMu.Lock()
+	if atomic.LoadInt64(&rl.atomicActiveOps) == 0 {
+		rl.drainMu.Unlock()
+		return nil
+	}
+	if rl.drained == nil {
+		rl.drained = make(chan struct{})
+	}
+	drained := rl.drained
+	rl.drainMu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// begin marks the start of a read or write operation.
+func (rl *RateLimit) begin() {
+	if rl.parent != nil {
+		rl.parent.begin()
+	}
+	atomic.AddInt64(&rl.atomicActiveOps, 1)
+}
+
+// end marks the end of a read or write operation and wakes up callers of
+// Drain once the last operation is done.
+func (rl *RateLimit) end() {
+	if rl.parent != nil {
+		defer rl.parent.end()
+	}
+	if atomic.AddInt64(&rl.atomicActiveOps, -1) != 0 {
+		return
+	}
+	rl.drainMu.Lock()
+	defer rl.drainMu.Unlock()
+	if rl.drained != nil && atomic.LoadInt64(&rl.atomicActiveOps) == 0 {
+		close(rl.drained)
+		rl.drained = nil
+	}
+}
+
+// touch marks the RateLimit as active.
+func (rl *RateLimit) touch() {
+	atomic.StoreInt64(&rl.atomicLastActive, int64(rl.elapsed()))
+}
+
+// elapsed returns the time since the RateLimit was created.
+func (rl *RateLimit) elapsed() time.Duration {
+	return rl.clock.Now().Sub(rl.created)
+}
+
+// idle returns for how long the RateLimit hasn't been active.
+func (rl *RateLimit) idle() time.Duration {
+	lastActive := time.Duration(atomic.LoadInt64(&rl.atomicLastActive))
+	if idle := rl.elapsed() - lastActive; idle > 0 {
+		return idle
+	}
+	return 0
+}
+
 // SetLimits sets new limits for the global rate limiter.
 func (rl *RateLimit) SetLimits(readBPS, writeBPS int64, packetSize uint64) {
-	atomic.StoreInt64(&rl.atomicReadBPS, readBPS)
-	atomic.StoreInt64(&rl.atomicWriteBPS, writeBPS)
-	atomic.StoreUint64(&rl.atomicPacketSize, packetSize)
+	rl.read.setBPS(readBPS)
+	rl.write.setBPS(writeBPS)
+	rl.SetPacketSize(packetSize)
+	rl.updateChildren()
+	rl.debugf("set limits to %v/%v bps", readBPS, writeBPS)
+}
+
+// Pause stops all reads and writes sharing the global rate limiter until
+// Resume is called. Reads and writes that are waiting for their turn or start
+// while paused block until then unless they are canceled or their deadline
+// expires. Packets that are already being transferred are finished. The time
+// spent paused doesn't count towards the limits, so transfers continue at the
+// same pace after resuming.
+func (rl *RateLimit) Pause() {
+	rl.read.setPaused(true)
+	rl.write.setPaused(true)
+	rl.debugf("paused")
+}
+
+// Resume resumes the reads and writes sharing the global rate limiter after a
+// call to Pause.
+func (rl *RateLimit) Resume() {
+	rl.read.setPaused(false)
+	rl.write.setPaused(false)
+	rl.debugf("resumed")
+}
+
+// SetPacketSize sets a new packet size for the global rate limiter. Reads and
+// writes that are in progress use the new packet size starting with their next
+// packet. A packetSize of 0 means that reads and writes are not split up.
+func (rl *RateLimit) SetPacketSize(packetSize uint64) {
+	rl.SetPacketSizes(packetSize, packetSize)
+}
+
+// SetPacketSizes is like SetPacketSize but sets different packet sizes for
+// reads and writes.
+func (rl *RateLimit) SetPacketSizes(readPacket, writePacket uint64) {
+	atomic.StoreUint64(&rl.atomicReadPacketSize, readPacket)
+	atomic.StoreUint64(&rl.atomicWritePacketSize, writePacket)
+	rl.debugf("set packet sizes to %v/%v bytes", readPacket, writePacket)
+}
+
+// SetReadBPS sets a new read limit for the global rate limiter. The new limit
+// applies to all readers sharing the RateLimit, including the ones that are
+// currently blocked. A bps of 0 removes the limit.
+func (rl *RateLimit) SetReadBPS(bps int64) {
+	rl.read.setBPS(bps)
+	rl.updateChildren()
+	rl.debugf("set read limit to %v bps", bps)
+}
+
+// SetWriteBPS sets a new write limit for the global rate limiter. The new
+// limit applies to all writers sharing the RateLimit, including the ones that
+// are currently blocked. A bps of 0 removes the limit.
+func (rl *RateLimit) SetWriteBPS(bps int64) {
+	rl.write.setBPS(bps)
+	rl.updateChildren()
+	rl.debugf("set write limit to %v bps", bps)
+}
+
+// SetDeadline sets the read and write deadlines of the connection and of the
+// rate limit.
+func (c *rlConn) SetDeadline(t time.Time) error {
+	c.rlrw.SetDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection and of the rate
+// limit.
+func (c *rlConn) SetReadDeadline(t time.Time) error {
+	c.rlrw.SetReadDeadline(t)
+	return c.Conn.SetReadDeadline(t)
 }
 
-// Read is a pass-through to the rlReadWriter's rate-limited Read method.
+// SetWriteDeadline sets the write deadline of the connection and of the rate
+// limit.
+func (c *rlConn) SetWriteDeadline(t time.Time) error {
+	c.rlrw.SetWriteDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Read is a pass-through to the RLReadWriter's rate-limited Read method.
+func (r *rlReader) Read(b []byte) (n int, err error) { return r.rlrw.Read(b) }
+
+// Write is a pass-through to the RLReadWriter's rate-limited Write method.
+func (w *rlWriter) Write(b []byte) (n int, err error) { return w.rlrw.Write(b) }
+
+// Close closes the connection and interrupts all pending reads and writes.
+func (c *rlConn) Close() error { return c.rlrw.Close() }
+
+// Read is a pass-through to the RLReadWriter's rate-limited Read method.
 func (c *rlConn) Read(b []byte) (n int, err error) { return c.rlrw.Read(b) }
 
-// Write is a pass-through to the rlReadWriter's rate-limited Write method.
+// Write is a pass-through to the RLReadWriter's rate-limited Write method.
 func (c *rlConn) Write(b []byte) (n int, err error) { return c.rlrw.Write(b) }
 
-// Read is a pass-through to the rlReadWriter's rate-limited Read method.
-func (s *rlStream) Read(b []byte) (n int, err error) { return s.rlrw.Read(b) }
+// SetDeadline sets the read and write deadlines of the stream and of the
+// rate limit.
+func (s *RLStream) SetDeadline(t time.Time) error {
+	s.rlrw.SetDeadline(t)
+	return s.Stream.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the stream and of the rate limit.
+func (s *RLStream) SetReadDeadline(t time.Time) error {
+	s.rlrw.SetReadDeadline(t)
+	return s.Stream.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the stream and of the rate
+// limit.
+func (s *RLStream) SetWriteDeadline(t time.Time) error {
+	s.rlrw.SetWriteDeadline(t)
+	return s.Stream.SetWriteDeadline(t)
+}
+
+// Close closes the stream and interrupts all pending reads and writes.
+func (s *RLStream) Close() error { return s.rlrw.Close() }
+
+// Read is a pass-through to the RLReadWriter's rate-limited Read method.
+func (s *RLStream) Read(b []byte) (n int, err error) { return s.rlrw.Read(b) }
+
+// Write is a pass-through to the RLReadWriter's rate-limited Write method.
+func (s *RLStream) Write(b []byte) (n int, err error) { return s.rlrw.Write(b) }
+
+// SetRateLimit is a pass-through to the RLReadWriter's SetRateLimit method.
+func (s *RLStream) SetRateLimit(rl *RateLimit) { s.rlrw.SetRateLimit(rl) }
 
-// Write is a pass-through to the rlReadWriter's rate-limited Write method.
-func (s *rlStream) Write(b []byte) (n int, err error) { return s.rlrw.Write(b) }
+// SetEnabled is a pass-through to the RLReadWriter's SetEnabled method.
+func (s *RLStream) SetEnabled(enabled bool) { s.rlrw.SetEnabled(enabled) }
+
+// Suspend is a pass-through to the RLReadWriter's Suspend method.
+func (s *RLStream) Suspend() { s.rlrw.Suspend() }
+
+// Resume is a pass-through to the RLReadWriter's Resume method.
+func (s *RLStream) Resume() { s.rlrw.Resume() }
+
+// SetDeadline sets the deadline for future and pending reads and writes that
+// are waiting for the rate limit. A zero value for t means that reads and
+// writes will not time out.
+func (l *RLReadWriter) SetDeadline(t time.Time) error {
+	l.readDeadline.set(t)
+	l.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for future and pending reads that are
+// waiting for the rate limit. A zero value for t means that reads will not
+// time out.
+func (l *RLReadWriter) SetReadDeadline(t time.Time) error {
+	l.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future and pending writes that are
+// waiting for the rate limit. A zero value for t means that writes will not
+// time out.
+func (l *RLReadWriter) SetWriteDeadline(t time.Time) error {
+	l.writeDeadline.set(t)
+	return nil
+}
 
 // Read reads from the underlying readWriter with the maximum possible speed
-// allowed by the rateLimit.
-func (l *rlReadWriter) Read(b []byte) (n int, err error) {
-	packetSize := atomic.LoadUint64(&l.rl.atomicPacketSize)
-	if packetSize == 0 {
-		return l.readPacket(b)
-	}
+// allowed by the rateLimit. It returns as soon as the underlying readWriter
+// returns less data than requested and is only charged for the data that was
+// actually read. If the read is interrupted, n is the number of bytes that were
+// read from the underlying readWriter before.
+func (l *RLReadWriter) Read(b []byte) (n int, err error) {
+	defer l.end(l.begin())
+	return l.read(b)
+}
+
+// read is the implementation of Read without tracking the operation.
+func (l *RLReadWriter) read(b []byte) (n int, err error) {
 	for len(b) > 0 {
-		var data []byte
-		if uint64(len(b)) > packetSize {
-			data = b[:packetSize]
-			b = b[packetSize:]
-		} else {
-			data = b
-			b = b[:0]
+		// The packet size is looked up for every packet to pick up changes
+		// made while reading.
+		data := b
+		if packetSize := l.packetSize(DirectionRead); packetSize > 0 && uint64(len(data)) > packetSize {
+			data = data[:packetSize]
 		}
 		var read int
-		for len(data) > 0 {
-			read, err = l.readPacket(data)
-			data = data[read:]
-			n += read
-			if err != nil {
-				return
-			}
+		read, err = l.readPacket(data)
+		b = b[read:]
+		n += read
+		// Return what we got if the underlying reader didn't fill the whole
+		// packet. More data might not be available yet.
+		if err != nil || read < len(data) {
+			return
 		}
 	}
 	return
 }
 
 // Write writes to the underlying readWriter with the maximum possible speed
-// allowed by the rateLimit.
-func (l *rlReadWriter) Write(b []byte) (n int, err error) {
-	packetSize := atomic.LoadUint64(&l.rl.atomicPacketSize)
-	if packetSize == 0 {
-		return l.writePacket(b)
+// allowed by the rateLimit. If the write is interrupted, n is the number of
+// bytes that were written to the underlying readWriter before. Writes that are
+// exempt from the limits of the rateLimit are written right away.
+func (l *RLReadWriter) Write(b []byte) (n int, err error) {
+	defer l.end(l.begin())
+	if l.exempt(len(b)) {
+		return l.transferPacketN(DirectionWrite, len(b), transferExempt, func(size int) (int, error) {
+			return l.ReadWriter.Write(b[:size])
+		})
+	}
+	if len(b) > 0 {
+		if err := l.waitMessage(); err != nil {
+			return 0, err
+		}
 	}
+	return l.write(b)
+}
+
+// write is the implementation of Write without tracking the operation.
+func (l *RLReadWriter) write(b []byte) (n int, err error) {
 	for len(b) > 0 {
+		// The packet size is looked up for every packet to pick up changes
+		// made while writing. Whole messages aren't split up.
+		packetSize := l.packetSize(DirectionWrite)
+		if l.wholeWrites {
+			packetSize = 0
+		}
 		var data []byte
-		if uint64(len(b)) > packetSize {
+		if packetSize > 0 && uint64(len(b)) > packetSize {
 			data = b[:packetSize]
 			b = b[packetSize:]
 		} else {
@@ -175,72 +971,276 @@ func (l *rlReadWriter) Write(b []byte) (n int, err error) {
 	return
 }
 
-// readPacket is a helper function that reads up to a single packet worth of
-// data.
-func (l *rlReadWriter) readPacket(b []byte) (n int, err error) {
-	// Get the current max bandwidth.
-	rl := l.rl
-	bps := time.Duration(atomic.LoadInt64(&rl.atomicReadBPS))
+// ReadFrom implements the io.ReaderFrom interface. It reads from r until EOF
+// and writes the data to the underlying readWriter with the maximum possible
+// speed allowed by the rateLimit. Every chunk read from r counts as a single
+// write towards WithWritePPS.
+func (l *RLReadWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	defer l.end(l.begin())
+	buf := make([]byte, l.copyBufferSize(DirectionWrite))
+	for {
+		// Check for cancellation between chunks.
+		if err := l.ctxs[DirectionWrite].Err(); err != nil {
+			return n, l.canceledErr(DirectionWrite, err)
+		}
+		read, readErr := r.Read(buf)
+		if read > 0 {
+			if err := l.waitMessage(); err != nil {
+				return n, err
+			}
+			written, err := l.write(buf[:read])
+			n += int64(written)
+			if err != nil {
+				return n, err
+			}
+		}
+		if readErr == io.EOF {
+			return n, nil
+		}
+		if readErr != nil {
+			return n, readErr
+		}
+	}
+}
 
-	// If bps is 0 there is no limit.
-	if bps == 0 {
-		return l.ReadWriter.Read(b)
+// WriteTo implements the io.WriterTo interface. It reads from the underlying
+// readWriter with the maximum possible speed allowed by the rateLimit until EOF
+// and writes the data to w.
+func (l *RLReadWriter) WriteTo(w io.Writer) (n int64, err error) {
+	defer l.end(l.begin())
+	buf := make([]byte, l.copyBufferSize(DirectionRead))
+	for {
+		// Check for cancellation between chunks.
+		if err := l.ctxs[DirectionRead].Err(); err != nil {
+			return n, l.canceledErr(DirectionRead, err)
+		}
+		read, readErr := l.read(buf)
+		if read > 0 {
+			written, err := w.Write(buf[:read])
+			n += int64(written)
+			if err != nil {
+				return n, err
+			}
+			if written < read {
+				return n, io.ErrShortWrite
+			}
+		}
+		if readErr == io.EOF {
+			return n, nil
+		}
+		if readErr != nil {
+			return n, readErr
+		}
+	}
+}
+
+// copyBufferSize returns the size of the buffer used by ReadFrom and WriteTo
+// for the given direction. It is a single packet unless there is no packet
+// size.
+func (l *RLReadWriter) copyBufferSize(dir Direction) uint64 {
+	if packetSize := l.packetSize(dir); packetSize > 0 {
+		return packetSize
 	}
+	return defaultCopyBufferSize
+}
 
-	rl.rmu.Lock()
-	// Calculate how long we can take for our read.
-	timeForRead := time.Second / bps * time.Duration(len(b))
+// Close closes the underlying readWriter if it implements io.Closer and
+// interrupts all pending reads and writes. If the underlying readWriter
+// doesn't implement io.Closer, Close is a no-op.
+func (l *RLReadWriter) Close() error {
+	c, ok := l.ReadWriter.(io.Closer)
+	if !ok {
+		return nil
+	}
+	err := c.Close()
+	l.readDeadline.close()
+	l.writeDeadline.close()
+	return err
+}
 
-	// If the readBlock is in the past we reset it to time.Now() +
-	// timeForRead. Otherwise we just add to the timestamp.
-	wb := rl.readBlock
-	if rl.readBlock.After(time.Now()) {
-		rl.readBlock = rl.readBlock.Add(timeForRead)
-	} else {
-		rl.readBlock = time.Now().Add(timeForRead)
+// waitErr translates an error returned by a Limiter while waiting for the rate
+// limit. If the deadline was exceeded, the error is reported by the deadline.
+// If the RLReadWriter was cancelled, the error is wrapped to match ErrCanceled.
+func (l *RLReadWriter) waitErr(dir Direction, d *deadline, err error) error {
+	if err == ErrDeadlineExceeded {
+		return d.err()
 	}
-	rl.rmu.Unlock()
+	return l.canceledErr(dir, err)
+}
 
-	// Sleep until it is safe to read.
-	select {
-	case <-time.After(time.Until(wb)):
-	case <-l.cancel:
-		return 0, errors.New("read cancelled due to interrupt")
+// canceledErr wraps err to match ErrCanceled if it is caused by the
+// RLReadWriter's context for the given direction being done.
+func (l *RLReadWriter) canceledErr(dir Direction, err error) error {
+	if ctxErr := l.ctxs[dir].Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+		return canceledError{err: err}
 	}
-	return l.ReadWriter.Read(b)
+	return err
+}
+
+// readPacket is a helper function that reads up to a single packet worth of
+// data.
+func (l *RLReadWriter) readPacket(b []byte) (n int, err error) {
+	return l.transferPacket(DirectionRead, b, l.ReadWriter.Read)
 }
 
 // writePacket is a helper function that writes up to a single packet worth of
 // data.
-func (l *rlReadWriter) writePacket(b []byte) (n int, err error) {
-	// Get the current max bandwidth.
-	rl := l.rl
-	bps := time.Duration(atomic.LoadInt64(&rl.atomicWriteBPS))
+func (l *RLReadWriter) writePacket(b []byte) (n int, err error) {
+	return l.transferPacket(DirectionWrite, b, l.ReadWriter.Write)
+}
+
+// transferPacket is a helper function that waits until it is safe to transfer
+// up to a single packet worth of data in the given direction and then
+// transfers it using the provided transfer function.
+func (l *RLReadWriter) transferPacket(dir Direction, b []byte, transfer func([]byte) (int, error)) (int, error) {
+	return l.transferPacketN(dir, len(b), transferWait, func(size int) (int, error) {
+		return transfer(b[:size])
+	})
+}
 
-	// If bps is 0 there is no limit.
-	if bps == 0 {
-		return l.ReadWriter.Write(b)
+// waitPacket waits until size bytes may be transferred in the given direction
+// according to both the limit of the connection and the provided Limiter.
+func (l *RLReadWriter) waitPacket(lim *limiterRef, dir Direction, size int, d *deadline, expired <-chan struct{}) error {
+	var waited time.Duration
+	if l.connRL != nil {
+		var err error
+		waited, err = l.connRL.bucket(dir).wait(l.ctxs[dir], size, expired, nil)
+		if err != nil {
+			lim.throttled(dir, waited, size)
+			return l.waitErr(dir, d, err)
+		}
+	}
+	globalWaited, err := l.waitLimiter(lim, dir, size, expired)
+	lim.throttled(dir, waited+globalWaited, size)
+	if err != nil {
+		return l.waitErr(dir, d, err)
 	}
+	return nil
+}
 
-	rl.wmu.Lock()
-	// Calculate how long we can take for our write.
-	timeForWrite := time.Second / bps * time.Duration(len(b))
+// transferPacketN is like transferPacket but for a packet of size bytes which
+// isn't necessarily a single slice. The transfer function is called with the
+// number of bytes it may transfer which is at most size. The mode determines
+// whether the packet waits for the limits.
+func (l *RLReadWriter) transferPacketN(dir Direction, size int, mode transferMode, transfer func(int) (int, error)) (n int, err error) {
+	// The whole packet is limited by the Limiter that is current when it
+	// starts, even if it is replaced in the meantime.
+	lim := l.current()
 
-	// If the writeBlock is in the past we reset it to time.Now() +
-	// timeForWrite. Otherwise we just add to the timestamp.
-	wb := rl.writeBlock
-	if rl.writeBlock.After(time.Now()) {
-		rl.writeBlock = rl.writeBlock.Add(timeForWrite)
-	} else {
-		rl.writeBlock = time.Now().Add(timeForWrite)
+	// Check for cancellation first. Packets that don't have to wait wouldn't
+	// notice otherwise, e.g. if the cancel channel was closed before.
+	if err := l.ctxs[dir].Err(); err != nil {
+		return 0, l.canceledErr(dir, err)
+	}
+	// Wait until it is safe to transfer.
+	d := l.deadline(dir)
+	expired := d.wait()
+	if isClosed(expired) {
+		return 0, d.err()
+	}
+	// A suspended RLReadWriter waits before it charges anything.
+	if err := l.waitResumed(dir, d, expired); err != nil {
+		return 0, err
+	}
+	// Don't exceed the quota. The part of the quota that isn't used is given
+	// back afterwards.
+	var exceeded bool
+	if q := l.quota(dir); q != nil {
+		allowed := q.take(size)
+		if allowed == 0 && size > 0 {
+			return 0, ErrQuotaExceeded
+		}
+		exceeded = allowed < size
+		size = allowed
+		defer func() {
+			q.give(size - n)
+		}()
+	}
+	// Exempt packets and the grace bytes of the RLReadWriter don't have to
+	// wait. The part of the grace bytes that isn't used is given back
+	// afterwards.
+	var free int
+	disabled := l.disabled()
+	switch {
+	case mode == transferExempt || disabled:
+		free = size
+	case l.grace != nil:
+		free = l.grace.take(size)
+		defer func() {
+			l.grace.give(free - n)
+		}()
+	}
+	charged := size - free
+	switch {
+	case charged == 0:
+		// The whole packet is exempt or covered by grace bytes.
+	case (mode == transferTry || l.drop && dir == DirectionWrite) && lim.rl != nil:
+		if !l.try(lim, dir, charged) {
+			return 0, ErrDropped
+		}
+	default:
+		if err = l.waitPacket(lim, dir, charged, d, expired); err != nil {
+			return 0, err
+		}
+	}
+	n, err = transfer(size)
+	if lim.rl != nil && !disabled {
+		lim.rl.transferred(dir, n)
+	}
+	if err == nil && exceeded {
+		err = ErrQuotaExceeded
+	}
+	if l.onProgress != nil && n > 0 {
+		l.onProgress(dir, n)
 	}
-	rl.wmu.Unlock()
 
-	// Sleep until it is safe to write.
-	select {
-	case <-time.After(time.Until(wb)):
-	case <-l.cancel:
-		return 0, errors.New("write cancelled due to interrupt")
+	// Only charge for the bytes that were actually transferred. They are
+	// paid for with the grace bytes first.
+	paid := n - free
+	if paid < 0 {
+		paid = 0
+	}
+	if unused := charged - paid; unused > 0 {
+		if l.connRL != nil {
+			l.connRL.bucket(dir).refund(unused)
+		}
+		if lim.rl != nil {
+			lim.rl.refund(dir, unused, l.flows[dir])
+		}
+	}
+	return
+}
+
+// begin marks the start of a read or write operation if the current Limiter is
+// one of this package. The returned Limiter needs to be passed to end once the
+// operation is done.
+func (l *RLReadWriter) begin() *limiterRef {
+	lim := l.current()
+	if lim.rl != nil {
+		lim.rl.begin()
+	}
+	return lim
+}
+
+// end marks the end of a read or write operation started by begin.
+func (l *RLReadWriter) end(lim *limiterRef) {
+	if lim.rl != nil {
+		lim.rl.end()
+	}
+}
+
+// quota returns the quota for the given direction.
+func (l *RLReadWriter) quota(dir Direction) *quota {
+	if dir == DirectionRead {
+		return l.readQuota
+	}
+	return l.writeQuota
+}
+
+// deadline returns the deadline for the given direction.
+func (l *RLReadWriter) deadline(dir Direction) *deadline {
+	if dir == DirectionRead {
+		return l.readDeadline
 	}
-	return l.ReadWriter.Write(b)
+	return l.writeDeadline
 }
@@ -2,9 +2,17 @@ package ratelimit
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -205,3 +213,1835 @@ func TestNewRatelimitStream(t *testing.T) {
 		t.Fatalf("test only took %v seconds", s)
 	}
 }
+
+// TestSetBPS tests changing the limits of a RateLimit in the middle of a
+// transfer.
+func TestSetBPS(t *testing.T) {
+	// Set limits
+	packetSize := uint64(50)
+	bps := int64(1000)
+	rl := NewRateLimit(bps, bps, packetSize)
+
+	// Wrap a buffer into a rate limited ReadWriter.
+	c := make(chan struct{})
+	defer close(c)
+	rlc := NewRLReadWriter(bytes.NewBuffer(make([]byte, 0)), rl, c)
+
+	// Write the first half of the data.
+	data := fastrand.Bytes(1000)
+	start := time.Now()
+	_, err := rlc.Write(data[:len(data)/2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	d1 := time.Since(start)
+
+	// Halve the limit and write the second half.
+	rl.SetWriteBPS(bps / 2)
+	start = time.Now()
+	_, err = rlc.Write(data[len(data)/2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2 := time.Since(start)
+
+	// The second half should take roughly twice as long.
+	if ratio := d2.Seconds() / d1.Seconds(); ratio < 1.5 || ratio > 2.5 {
+		t.Fatalf("second half took %v times as long as the first half (%v vs %v)", ratio, d2, d1)
+	}
+	if readBPS, writeBPS, _ := rl.Limits(); readBPS != bps || writeBPS != bps/2 {
+		t.Fatal("wrong limits", readBPS, writeBPS)
+	}
+}
+
+// TestSetBPSBlocked tests that raising the limit unblocks a caller that is
+// waiting on the old limit.
+func TestSetBPSBlocked(t *testing.T) {
+	// Set a limit that would block the second write for 10 seconds.
+	rl := NewRateLimit(10, 10, 0)
+	c := make(chan struct{})
+	defer close(c)
+	rlc := NewRLReadWriter(bytes.NewBuffer(make([]byte, 0)), rl, c)
+	data := fastrand.Bytes(100)
+	if _, err := rlc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Raise the limit while the second write is blocked.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		rl.SetWriteBPS(1 << 20)
+	}()
+	start := time.Now()
+	if _, err := rlc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatal("write didn't pick up the new limit", d)
+	}
+}
+
+// TestSetBPSConcurrent tests changing the limits while multiple threads are
+// reading and writing.
+func TestSetBPSConcurrent(t *testing.T) {
+	rl := NewRateLimit(1<<20, 1<<20, 64)
+
+	// Start a few threads that read and write.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rlc := NewRLReadWriter(bytes.NewBuffer(make([]byte, 0)), rl, stop)
+			data := fastrand.Bytes(1000)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := rlc.Write(data); err != nil {
+					return
+				}
+				if _, err := rlc.Read(data); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	// Change the limits a few times.
+	for i := 0; i < 100; i++ {
+		rl.SetReadBPS(int64(fastrand.Intn(1<<20) + 1))
+		rl.SetWriteBPS(int64(fastrand.Intn(1<<20) + 1))
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// TestSettersRace hammers the setters of a RateLimit from multiple threads
+// while reads and writes are in progress. It is meant to be run with -race.
+func TestSettersRace(t *testing.T) {
+	rl := NewRateLimitWithOptions(WithReadBPS(1<<20), WithWriteBPS(1<<20), WithPacketSize(64), WithLogger(log.DiscardLogger))
+	child := rl.Derive(0.5)
+
+	// Start a few threads that read and write using the RateLimit and a
+	// RateLimit derived from it.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 6; i++ {
+		limiter := rl
+		if i%2 == 1 {
+			limiter = child
+		}
+		wg.Add(1)
+		go func(limiter *RateLimit) {
+			defer wg.Done()
+			rlc := NewRLReadWriter(&spyReadWriter{}, limiter, stop)
+			data := make([]byte, 1000)
+			for {
+				if _, err := rlc.Write(data); err != nil {
+					return
+				}
+				if _, err := rlc.Read(data); err != nil {
+					return
+				}
+				_, _, _ = limiter.Limits()
+				_ = limiter.Stats()
+			}
+		}(limiter)
+	}
+
+	// Change the limits from a few threads at once.
+	var setters sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		setters.Add(1)
+		go func() {
+			defer setters.Done()
+			for j := 0; j < 100; j++ {
+				rl.SetReadBPS(int64(fastrand.Intn(1<<20) + 1))
+				rl.SetWriteBPS(int64(fastrand.Intn(1<<20) + 1))
+				rl.SetPacketSizes(uint64(fastrand.Intn(128)+1), uint64(fastrand.Intn(128)+1))
+				rl.SetLimits(int64(fastrand.Intn(1<<20)+1), int64(fastrand.Intn(1<<20)+1), uint64(fastrand.Intn(128)+1))
+				rl.SetWritePPS(int64(fastrand.Intn(1 << 20)))
+				rl.SetName("race")
+				if j%10 == 0 {
+					rl.Pause()
+					rl.Resume()
+					rl.Reset()
+				}
+				time.Sleep(100 * time.Microsecond)
+			}
+		}()
+	}
+	setters.Wait()
+	close(stop)
+	wg.Wait()
+}
+
+// TestGetters tests that the getters return the limits the RateLimit was
+// created with.
+func TestGetters(t *testing.T) {
+	readBPS, writeBPS, packetSize := int64(1000), int64(2000), uint64(64)
+	rl := NewRateLimit(readBPS, writeBPS, packetSize)
+	if rl.ReadBPS() != readBPS {
+		t.Fatal("wrong readBPS", rl.ReadBPS())
+	}
+	if rl.WriteBPS() != writeBPS {
+		t.Fatal("wrong writeBPS", rl.WriteBPS())
+	}
+	if rl.PacketSize() != packetSize {
+		t.Fatal("wrong packetSize", rl.PacketSize())
+	}
+}
+
+// TestUnlimited tests that a limit of 0 doesn't limit reads or writes.
+func TestUnlimited(t *testing.T) {
+	data := fastrand.Bytes(10 << 20)
+
+	// Writes are unlimited.
+	rl := NewRateLimit(1, 0, 64)
+	c := make(chan struct{})
+	defer close(c)
+	rw := bytes.NewBuffer(make([]byte, 0, len(data)))
+	rlc := NewRLReadWriter(rw, rl, c)
+	start := time.Now()
+	n, err := rlc.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) {
+		t.Fatal("not whole data was written", n)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatal("unlimited write took too long", d)
+	}
+
+	// Reads are unlimited.
+	rl = NewRateLimit(0, 1, 64)
+	rlc = NewRLReadWriter(bytes.NewBuffer(data), rl, c)
+	readData := make([]byte, len(data))
+	start = time.Now()
+	n, err = rlc.Read(readData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) {
+		t.Fatal("not whole data was read", n)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatal("unlimited read took too long", d)
+	}
+	if !bytes.Equal(readData, data) {
+		t.Fatal("read data doesn't match written data")
+	}
+}
+
+// TestCancelCtx tests cancelling a rate-limited write through a context.
+func TestCancelCtx(t *testing.T) {
+	packetSize := uint64(100)
+	rl := NewRateLimit(1000, 1000, packetSize)
+
+	// Wrap a buffer into a rate limited ReadWriter.
+	ctx, cancel := context.WithCancel(context.Background())
+	rw := bytes.NewBuffer(make([]byte, 0))
+	rlc := NewRLReadWriterCtx(rw, rl, ctx)
+
+	// Cancel the context in the middle of the write.
+	go func() {
+		time.Sleep(350 * time.Millisecond)
+		cancel()
+	}()
+	n, err := rlc.Write(fastrand.Bytes(1000))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal("expected context.Canceled but got", err)
+	}
+	if n != rw.Len() {
+		t.Fatalf("write reported %v bytes but %v were written", n, rw.Len())
+	}
+	if n == 0 || n%int(packetSize) != 0 || n >= 1000 {
+		t.Fatal("unexpected number of written bytes", n)
+	}
+}
+
+// TestDeadline tests that reads and writes which are waiting for the rate
+// limit time out once their deadline is exceeded.
+func TestDeadline(t *testing.T) {
+	packetSize := uint64(100)
+	rl := NewRateLimit(1000, 1000, packetSize)
+
+	// Wrap a buffer into a rate limited ReadWriter.
+	c := make(chan struct{})
+	defer close(c)
+	rw := bytes.NewBuffer(make([]byte, 0))
+	rlc := NewRLReadWriter(rw, rl, c)
+
+	// Set a deadline that expires in the middle of the write.
+	if err := rlc.SetWriteDeadline(time.Now().Add(350 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	n, err := rlc.Write(fastrand.Bytes(1000))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatal("expected timeout error but got", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatal("write didn't time out in time", d)
+	}
+	if n != rw.Len() {
+		t.Fatalf("write reported %v bytes but %v were written", n, rw.Len())
+	}
+	if n == 0 || n >= 1000 {
+		t.Fatal("unexpected number of written bytes", n)
+	}
+
+	// Further writes should fail right away.
+	n, err = rlc.Write(fastrand.Bytes(1000))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() || n != 0 {
+		t.Fatal("expected timeout error but got", n, err)
+	}
+
+	// Reads are not affected.
+	readData := make([]byte, rw.Len())
+	if _, err := rlc.Read(readData); err != nil {
+		t.Fatal(err)
+	}
+
+	// Extending the deadline allows for writing again.
+	if err := rlc.SetWriteDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rlc.Write(fastrand.Bytes(100)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Setting a deadline in the past interrupts a pending read.
+	rlc = NewRLReadWriter(bytes.NewBuffer(fastrand.Bytes(1000)), NewRateLimit(10, 10, 0), c)
+	if _, err := rlc.Read(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		rlc.SetReadDeadline(time.Now())
+	}()
+	_, err = rlc.Read(make([]byte, 100))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatal("expected timeout error but got", err)
+	}
+}
+
+// TestRLConn tests the ratelimit on a net.Conn.
+func TestRLConn(t *testing.T) {
+	// Create a pipe and wrap both ends.
+	c := make(chan struct{})
+	defer close(c)
+	bps := int64(1000)
+	rl := NewRateLimit(bps, bps, 100)
+	p1, p2 := net.Pipe()
+	conn1 := NewRLConn(p1, rl, c)
+	conn2 := NewRLConn(p2, rl, c)
+	defer conn1.Close()
+	defer conn2.Close()
+	if conn1.LocalAddr() != p1.LocalAddr() || conn1.RemoteAddr() != p1.RemoteAddr() {
+		t.Fatal("addresses weren't forwarded")
+	}
+
+	// Write some data from one end and read it from the other one.
+	data := fastrand.Bytes(1000)
+	errChan := make(chan error)
+	go func() {
+		_, err := conn1.Write(data)
+		errChan <- err
+	}()
+	start := time.Now()
+	readData := make([]byte, len(data))
+	if _, err := io.ReadFull(conn2, readData); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d.Seconds() < float64(len(data)-100)/float64(bps) {
+		t.Fatal("transfer didn't take long enough", d)
+	}
+	if !bytes.Equal(readData, data) {
+		t.Fatal("read data doesn't match written data")
+	}
+
+	// Slow down writes and set a deadline that expires while the next write
+	// is waiting for the rate limit.
+	rl.SetWriteBPS(10)
+	go io.Copy(ioutil.Discard, conn2)
+	if err := conn1.SetWriteDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	_, err := conn1.Write(data)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatal("expected timeout error but got", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatal("write didn't time out in time", d)
+	}
+}
+
+// TestStats tests that all the readers and writers sharing a RateLimit
+// contribute to its stats.
+func TestStats(t *testing.T) {
+	rl := NewRateLimit(0, 0, 64)
+
+	// Start a few threads that write and read some data.
+	var wg sync.WaitGroup
+	numThreads := 20
+	var written, read uint64
+	for i := 0; i < numThreads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rlc := NewRLReadWriter(bytes.NewBuffer(make([]byte, 0)), rl, nil)
+			data := fastrand.Bytes(fastrand.Intn(10000) + 1)
+			n, err := rlc.Write(data)
+			if err != nil {
+				t.Error(err)
+			}
+			atomic.AddUint64(&written, uint64(n))
+			n, err = rlc.Read(data[:len(data)/2])
+			if err != nil {
+				t.Error(err)
+			}
+			atomic.AddUint64(&read, uint64(n))
+		}()
+	}
+	wg.Wait()
+
+	// Check the stats.
+	stats := rl.Stats()
+	if stats.BytesWritten != written {
+		t.Fatalf("expected %v bytes written but was %v", written, stats.BytesWritten)
+	}
+	if stats.BytesRead != read {
+		t.Fatalf("expected %v bytes read but was %v", read, stats.BytesRead)
+	}
+}
+
+// TestOnThrottle tests that the throttle callback is called whenever a write
+// waits for the rate limit.
+func TestOnThrottle(t *testing.T) {
+	packetSize := uint64(100)
+	bps := int64(1000)
+	rl := NewRateLimit(bps, bps, packetSize)
+
+	// Register a callback.
+	var mu sync.Mutex
+	var calls int
+	var total time.Duration
+	rl.SetOnThrottle(func(dir Direction, waited time.Duration, bytes int) {
+		mu.Lock()
+		defer mu.Unlock()
+		if dir != DirectionWrite {
+			t.Error("wrong direction", dir)
+		}
+		if bytes != int(packetSize) {
+			t.Error("wrong number of bytes", bytes)
+		}
+		calls++
+		total += waited
+	})
+
+	// Write 3 packets. The first one goes through right away.
+	rlc := NewRLReadWriter(bytes.NewBuffer(make([]byte, 0)), rl, nil)
+	if _, err := rlc.Write(fastrand.Bytes(3 * int(packetSize))); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if calls != 2 {
+		t.Fatal("wrong number of calls", calls)
+	}
+	if total < 150*time.Millisecond || total > 300*time.Millisecond {
+		t.Fatal("implausible wait", total)
+	}
+	mu.Unlock()
+
+	// Remove the callback.
+	rl.SetOnThrottle(nil)
+	if _, err := rlc.Write(fastrand.Bytes(3 * int(packetSize))); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if calls != 2 {
+		t.Fatal("callback was called after it was removed", calls)
+	}
+	mu.Unlock()
+}
+
+// TestBurst tests that unused bandwidth can be used for bursting after being
+// idle.
+func TestBurst(t *testing.T) {
+	packetSize := uint64(100)
+	burst := uint64(500)
+	bps := int64(1000)
+	rl := NewRateLimitBurst(bps, bps, packetSize, burst)
+	rw := bytes.NewBuffer(make([]byte, 0))
+	rlc := NewRLReadWriter(rw, rl, nil)
+
+	// Stay idle for a second to fill up the bucket.
+	time.Sleep(time.Second)
+
+	// Writing burst bytes should happen almost instantly.
+	start := time.Now()
+	if _, err := rlc.Write(fastrand.Bytes(int(burst))); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatal("burst took too long", d)
+	}
+
+	// The following bytes are paced. The first packet still goes through
+	// since the bucket is empty but not in debt.
+	start = time.Now()
+	if _, err := rlc.Write(fastrand.Bytes(int(burst))); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d.Seconds() < float64(burst-packetSize)/float64(bps) {
+		t.Fatal("write after burst wasn't paced", d)
+	}
+}
+
+// TestPerConnLimit tests that connections with a per-connection limit are
+// limited by both their own limit and the global one.
+func TestPerConnLimit(t *testing.T) {
+	packetSize := 50
+	globalBPS := int64(1000)
+	perConnBPS := int64(600)
+	rl := NewRateLimit(globalBPS, globalBPS, uint64(packetSize))
+
+	// Start two connections which write at the same time.
+	var wg sync.WaitGroup
+	bytesPerConn := 600
+	durations := make([]time.Duration, 2)
+	start := time.Now()
+	for i := range durations {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rlc := NewRLReadWriterLimited(bytes.NewBuffer(make([]byte, 0)), rl, perConnBPS, nil)
+			connStart := time.Now()
+			if _, err := rlc.Write(fastrand.Bytes(bytesPerConn)); err != nil {
+				t.Error(err)
+			}
+			durations[i] = time.Since(connStart)
+		}(i)
+	}
+	wg.Wait()
+	total := time.Since(start)
+
+	// Neither connection should have exceeded its own limit. The first packet
+	// of each connection is free.
+	for _, d := range durations {
+		if rate := float64(bytesPerConn-packetSize) / d.Seconds(); rate > float64(perConnBPS)*1.05 {
+			t.Fatal("connection exceeded its limit", rate)
+		}
+	}
+	// The aggregate should not exceed the global limit. Only the very first
+	// packet is free.
+	if rate := float64(2*bytesPerConn-packetSize) / total.Seconds(); rate > float64(globalBPS)*1.05 {
+		t.Fatal("connections exceeded the global limit", rate)
+	}
+}
+
+// TestReadFromWriteTo tests copying data from and to a RLReadWriter.
+func TestReadFromWriteTo(t *testing.T) {
+	bps := int64(1 << 22)
+	rl := NewRateLimit(bps, bps, 1<<16)
+	rw := bytes.NewBuffer(make([]byte, 0))
+	rlc := NewRLReadWriter(rw, rl, nil)
+
+	// Copy some data into the RLReadWriter. Wrap the source to make sure
+	// io.Copy uses ReadFrom.
+	data := fastrand.Bytes(1 << 22)
+	start := time.Now()
+	n, err := io.Copy(rlc, struct{ io.Reader }{bytes.NewReader(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Fatal("wrong number of bytes copied", n)
+	}
+	if d := time.Since(start); d.Seconds() < 0.9 {
+		t.Fatal("copy wasn't paced", d)
+	}
+	if !bytes.Equal(rw.Bytes(), data) {
+		t.Fatal("copied data doesn't match")
+	}
+
+	// Copy the data back out. Wrap the destination to make sure io.Copy uses
+	// WriteTo.
+	var buf bytes.Buffer
+	n, err = io.Copy(struct{ io.Writer }{&buf}, rlc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Fatal("wrong number of bytes copied", n)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("copied data doesn't match")
+	}
+}
+
+// BenchmarkReadFrom benchmarks copying data into a RLReadWriter using
+// ReadFrom.
+func BenchmarkReadFrom(b *testing.B) {
+	rl := NewRateLimit(0, 0, 1<<16)
+	data := fastrand.Bytes(1 << 20)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rlc := NewRLReadWriter(struct {
+			io.Reader
+			io.Writer
+		}{nil, ioutil.Discard}, rl, nil)
+		if _, err := io.Copy(rlc, struct{ io.Reader }{bytes.NewReader(data)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCopy benchmarks copying data into a RLReadWriter using the generic
+// copy loop of io.Copy.
+func BenchmarkCopy(b *testing.B) {
+	rl := NewRateLimit(0, 0, 1<<16)
+	data := fastrand.Bytes(1 << 20)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rlc := NewRLReadWriter(struct {
+			io.Reader
+			io.Writer
+		}{nil, ioutil.Discard}, rl, nil)
+		if _, err := io.Copy(struct{ io.Writer }{rlc}, struct{ io.Reader }{bytes.NewReader(data)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkNop benchmarks writing through a RLReadWriter using a
+// NopRateLimit compared to writing to the underlying writer directly.
+func BenchmarkNop(b *testing.B) {
+	data := fastrand.Bytes(1 << 16)
+	run := func(b *testing.B, w io.Writer) {
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := w.Write(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("Raw", func(b *testing.B) {
+		run(b, ioutil.Discard)
+	})
+	b.Run("Nop", func(b *testing.B) {
+		run(b, NewRLReadWriter(struct {
+			io.Reader
+			io.Writer
+		}{nil, ioutil.Discard}, NopRateLimit(), nil))
+	})
+}
+
+// closeBuffer is a bytes.Buffer that implements io.Closer.
+type closeBuffer struct {
+	bytes.Buffer
+	closed int
+}
+
+// Close implements io.Closer.
+func (cb *closeBuffer) Close() error {
+	cb.closed++
+	return nil
+}
+
+// TestClose tests closing a RLReadWriter.
+func TestClose(t *testing.T) {
+	// Wrap a closer.
+	rl := NewRateLimit(10, 10, 0)
+	cb := &closeBuffer{}
+	rlc := NewRLReadWriter(cb, rl, nil)
+
+	// The first write goes through. The second one blocks until the
+	// RLReadWriter is closed.
+	data := fastrand.Bytes(100)
+	if _, err := rlc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := rlc.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	start := time.Now()
+	if _, err := rlc.Write(data); err != errClosed {
+		t.Fatal("expected errClosed but got", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatal("write wasn't interrupted", d)
+	}
+	if cb.closed != 1 {
+		t.Fatal("underlying closer wasn't closed", cb.closed)
+	}
+
+	// Reads fail right away.
+	if _, err := rlc.Read(data); err != errClosed {
+		t.Fatal("expected errClosed but got", err)
+	}
+
+	// Wrap a non-closer.
+	rw := bytes.NewBuffer(make([]byte, 0))
+	rlc = NewRLReadWriter(rw, rl, nil)
+	if err := rlc.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReset tests that resetting a RateLimit discards the time owed for
+// previous writes.
+func TestReset(t *testing.T) {
+	// Saturate the limiter. The next write would have to wait for 10 seconds.
+	rl := NewRateLimit(10, 10, 0)
+	rlc := NewRLReadWriter(bytes.NewBuffer(make([]byte, 0)), rl, nil)
+	data := fastrand.Bytes(100)
+	if _, err := rlc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reset the limiter while another thread is waiting.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := rlc.Write(data); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	rl.Reset()
+	wg.Wait()
+
+	// The waiting write should have been released and the next write should
+	// go through without penalty from before the reset.
+	rl.Reset()
+	if _, err := rlc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatal("writes were penalized after reset", d)
+	}
+	if rl.WriteBPS() != 10 || rl.Stats().BytesWritten != 300 {
+		t.Fatal("reset changed the limits or stats", rl.WriteBPS(), rl.Stats())
+	}
+}
+
+// TestRLReaderWriter tests the one-directional NewRLReader and NewRLWriter.
+func TestRLReaderWriter(t *testing.T) {
+	packetSize := uint64(100)
+	bps := int64(1000)
+	rl := NewRateLimit(bps, bps, packetSize)
+
+	// Read some data through a rate-limited reader.
+	data := fastrand.Bytes(500)
+	r := NewRLReader(bytes.NewReader(data), rl, nil)
+	readData := make([]byte, len(data))
+	start := time.Now()
+	if _, err := io.ReadFull(r, readData); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d.Seconds() < float64(uint64(len(data))-packetSize)/float64(bps) {
+		t.Fatal("read wasn't limited", d)
+	}
+	if !bytes.Equal(readData, data) {
+		t.Fatal("read data doesn't match")
+	}
+	if stats := rl.Stats(); stats.BytesRead != uint64(len(data)) || stats.BytesWritten != 0 {
+		t.Fatal("wrong stats", stats)
+	}
+
+	// Reading shouldn't affect writes. Write a single packet which should go
+	// through right away.
+	var buf bytes.Buffer
+	w := NewRLWriter(&buf, rl, nil)
+	start = time.Now()
+	if _, err := w.Write(data[:packetSize]); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatal("write was limited by previous reads", d)
+	}
+
+	// The following writes are limited.
+	start = time.Now()
+	if _, err := w.Write(data[packetSize:]); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d.Seconds() < float64(uint64(len(data))-packetSize)/float64(bps) {
+		t.Fatal("write wasn't limited", d)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("written data doesn't match")
+	}
+}
+
+// TestAvailable tests AvailableRead and AvailableWrite.
+func TestAvailable(t *testing.T) {
+	packetSize := uint64(100)
+	burst := uint64(500)
+	bps := int64(1000)
+	rl := NewRateLimitBurst(bps, bps, packetSize, burst)
+	rw := bytes.NewBuffer(make([]byte, 0))
+	rlc := NewRLReadWriter(rw, rl, nil)
+
+	// A new RateLimit starts out empty.
+	if n := rl.AvailableWrite(); n < 0 || n > int64(packetSize) {
+		t.Fatal("wrong available bytes after construction", n)
+	}
+
+	// Stay idle for a second to fill up the bucket. It shouldn't accumulate
+	// more than burst bytes.
+	time.Sleep(time.Second)
+	if n := rl.AvailableWrite(); n != int64(burst) {
+		t.Fatal("wrong available bytes after being idle", n)
+	}
+	if n := rl.AvailableRead(); n != int64(burst) {
+		t.Fatal("wrong available bytes after being idle", n)
+	}
+
+	// Writing consumes the accumulated bytes but doesn't affect reading.
+	if _, err := rlc.Write(fastrand.Bytes(int(burst) - int(packetSize))); err != nil {
+		t.Fatal(err)
+	}
+	if n := rl.AvailableWrite(); n < int64(packetSize) || n > 2*int64(packetSize) {
+		t.Fatal("wrong available bytes after writing", n)
+	}
+	if n := rl.AvailableRead(); n != int64(burst) {
+		t.Fatal("wrong available bytes after writing", n)
+	}
+
+	// Writing more than is available puts the bucket in debt.
+	if _, err := rlc.Write(fastrand.Bytes(int(burst))); err != nil {
+		t.Fatal(err)
+	}
+	if n := rl.AvailableWrite(); n >= 0 {
+		t.Fatal("expected bucket to be in debt", n)
+	}
+
+	// Without a limit there is no restriction.
+	rl.SetLimits(0, 0, packetSize)
+	if n := rl.AvailableWrite(); n != math.MaxInt64 {
+		t.Fatal("wrong available bytes without limit", n)
+	}
+}
+
+// TestAllow tests AllowRead and AllowWrite.
+func TestAllow(t *testing.T) {
+	burst := uint64(1000)
+	rl := NewRateLimitBurst(1000, 1000, 100, burst)
+
+	// A new RateLimit starts out empty.
+	if rl.AllowWrite(100) || rl.AllowRead(100) {
+		t.Fatal("new RateLimit shouldn't allow transfers")
+	}
+
+	// Stay idle for a second to fill up the bucket. Then lower the limit to
+	// make sure the budget doesn't grow noticeably during the test.
+	time.Sleep(time.Second)
+	rl.SetWriteBPS(1)
+
+	// Flood AllowWrite from multiple goroutines.
+	var consumed uint64
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if n := fastrand.Intn(50) + 1; rl.AllowWrite(n) {
+					atomic.AddUint64(&consumed, uint64(n))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if consumed > burst+1 {
+		t.Fatal("consumed more than the available budget", consumed)
+	}
+	if consumed < burst-50 {
+		t.Fatal("didn't consume the available budget", consumed)
+	}
+	if rl.AllowWrite(50) {
+		t.Fatal("budget should be used up")
+	}
+
+	// Reading is unaffected.
+	if !rl.AllowRead(int(burst)) {
+		t.Fatal("read budget should be available")
+	}
+
+	// Without a limit everything is allowed.
+	rl.SetWriteBPS(0)
+	if !rl.AllowWrite(math.MaxInt32) {
+		t.Fatal("unlimited RateLimit should allow everything")
+	}
+}
+
+// TestReserve tests ReserveWrite and CancelWrite.
+func TestReserve(t *testing.T) {
+	bps := int64(1000)
+	rl := NewRateLimit(bps, bps, 100)
+
+	// approx checks that d is close to the time it takes to transfer n bytes.
+	approx := func(d time.Duration, n int) bool {
+		expected := time.Duration(n) * time.Second / time.Duration(bps)
+		return d <= expected && d > expected-50*time.Millisecond
+	}
+
+	// A new RateLimit starts out empty so reserving bytes requires waiting for
+	// them to accrue.
+	if d := rl.ReserveWrite(500); !approx(d, 500) {
+		t.Fatal("wrong delay for first reservation", d)
+	}
+	// Additional reservations queue up behind the first one.
+	if d := rl.ReserveWrite(250); !approx(d, 750) {
+		t.Fatal("wrong delay for second reservation", d)
+	}
+	// Reading is unaffected.
+	if d := rl.ReserveRead(100); !approx(d, 100) {
+		t.Fatal("wrong delay for read reservation", d)
+	}
+
+	// Cancelling the second reservation makes its bytes available again.
+	rl.CancelWrite(250)
+	if d := rl.ReserveWrite(100); !approx(d, 600) {
+		t.Fatal("wrong delay after cancelling", d)
+	}
+
+	// A writer has to wait for the reservations.
+	rw := bytes.NewBuffer(make([]byte, 0))
+	rlc := NewRLReadWriter(rw, rl, nil)
+	start := time.Now()
+	if _, err := rlc.Write(fastrand.Bytes(1)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 500*time.Millisecond {
+		t.Fatal("write didn't wait for reservation", d)
+	}
+
+	// Without a limit there is no delay.
+	rl.SetLimits(0, 0, 100)
+	if d := rl.ReserveWrite(1000); d != 0 {
+		t.Fatal("unlimited RateLimit shouldn't delay", d)
+	}
+	rl.CancelWrite(1000)
+}
+
+// shortWriter is a bytes.Buffer that only accepts up to max bytes per write.
+// If fail is set, a short write returns an error.
+type shortWriter struct {
+	bytes.Buffer
+	max  int
+	fail bool
+}
+
+// Write implements io.Writer.
+func (sw *shortWriter) Write(b []byte) (int, error) {
+	if len(b) <= sw.max {
+		return sw.Buffer.Write(b)
+	}
+	n, _ := sw.Buffer.Write(b[:sw.max])
+	if sw.fail {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+// TestShortWrite tests that a RLReadWriter is only charged for the bytes that
+// the underlying writer actually accepted.
+func TestShortWrite(t *testing.T) {
+	packetSize := uint64(100)
+	bps := int64(1000)
+	rl := NewRateLimit(bps, bps, packetSize)
+	sw := &shortWriter{max: 10}
+	rlc := NewRLReadWriter(sw, rl, nil)
+
+	// Write 500 bytes 10 bytes at a time. The first write is free and the
+	// remaining bytes are paced. If every write was charged for the requested
+	// bytes, this would take multiple seconds.
+	data := fastrand.Bytes(500)
+	start := time.Now()
+	if n, err := rlc.Write(data); err != nil || n != len(data) {
+		t.Fatal(n, err)
+	}
+	expected := time.Duration(len(data)-sw.max) * time.Second / time.Duration(bps)
+	if d := time.Since(start); d < expected || d > expected+250*time.Millisecond {
+		t.Fatal("wrong pacing", d, expected)
+	}
+	if !bytes.Equal(sw.Bytes(), data) {
+		t.Fatal("wrong data written")
+	}
+
+	// A failed write is only charged for the bytes that were written.
+	rl.Reset()
+	sw.fail = true
+	if n, err := rlc.Write(data[:packetSize]); err != io.ErrShortWrite || n != sw.max {
+		t.Fatal(n, err)
+	}
+	if n := rl.AvailableWrite(); n > 0 || n < -int64(sw.max) {
+		t.Fatal("wrong available bytes after failed write", n)
+	}
+}
+
+// chunkReader is a io.ReadWriter that returns at most chunk bytes per read.
+type chunkReader struct {
+	bytes.Buffer
+	chunk int
+}
+
+// Read implements io.Reader.
+func (cr *chunkReader) Read(b []byte) (int, error) {
+	if len(b) > cr.chunk {
+		b = b[:cr.chunk]
+	}
+	return cr.Buffer.Read(b)
+}
+
+// TestShortRead tests that a RLReadWriter is only charged for the bytes that
+// the underlying reader actually returned.
+func TestShortRead(t *testing.T) {
+	bps := int64(1000)
+	rl := NewRateLimit(bps, bps, 1<<12)
+	cr := &chunkReader{chunk: 100}
+	cr.Write(fastrand.Bytes(1000))
+	rlc := NewRLReadWriter(cr, rl, nil)
+
+	// Read the data in chunks using a large buffer. Every read should return
+	// a single chunk and only the chunks should be paced.
+	buf := make([]byte, 1<<20)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		n, err := rlc.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != cr.chunk {
+			t.Fatal("wrong number of bytes read", n)
+		}
+	}
+	expected := 9 * time.Duration(cr.chunk) * time.Second / time.Duration(bps)
+	if d := time.Since(start); d < expected || d > expected+250*time.Millisecond {
+		t.Fatal("wrong pacing", d, expected)
+	}
+}
+
+// eofReader is a io.ReadWriter that returns io.EOF together with the last
+// bytes of its buffer.
+type eofReader struct {
+	bytes.Buffer
+}
+
+// Read implements io.Reader.
+func (er *eofReader) Read(b []byte) (int, error) {
+	n, err := er.Buffer.Read(b)
+	if err == nil && er.Buffer.Len() == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// TestReadEOF tests that a RLReadWriter returns the bytes read together with
+// io.EOF on the same call and is only charged for those bytes.
+func TestReadEOF(t *testing.T) {
+	rl := NewRateLimit(1000, 1000, 100)
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"single packet", 10},
+		{"multiple packets", 250},
+	}
+	var total uint64
+	for _, test := range tests {
+		er := &eofReader{}
+		data := fastrand.Bytes(test.size)
+		er.Write(data)
+		rlc := NewRLReadWriter(er, rl, nil)
+
+		buf := make([]byte, 1000)
+		n, err := rlc.Read(buf)
+		if err != io.EOF {
+			t.Fatalf("%v: expected io.EOF but got %v", test.name, err)
+		}
+		if n != test.size || !bytes.Equal(buf[:n], data) {
+			t.Fatalf("%v: wrong data, read %v bytes", test.name, n)
+		}
+		// Only the bytes of the last packet that were read are charged, so the
+		// next read doesn't have to wait for a full packet.
+		if eta := rl.eta(DirectionRead, 1); eta >= 90*time.Millisecond {
+			t.Fatalf("%v: last packet was charged in full %v", test.name, eta)
+		}
+		total += uint64(n)
+		if read := rl.Stats().BytesRead; read != total {
+			t.Fatalf("%v: wrong number of bytes accounted for %v", test.name, read)
+		}
+	}
+}
+
+// TestCancelReuse tests that cancelling a pending write still works promptly
+// after the waiters of a bucket were reused.
+func TestCancelReuse(t *testing.T) {
+	rl := NewRateLimit(1000, 1000, 100)
+	rw := bytes.NewBuffer(make([]byte, 0))
+
+	for i := 0; i < 3; i++ {
+		// The first packet goes through right away while the remaining ones
+		// need to wait.
+		ctx, cancel := context.WithCancel(context.Background())
+		rlc := NewRLReadWriterCtx(rw, rl, ctx)
+		go func() {
+			time.Sleep(150 * time.Millisecond)
+			cancel()
+		}()
+		start := time.Now()
+		_, err := rlc.Write(fastrand.Bytes(10000))
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal("expected context.Canceled but got", err)
+		}
+		if d := time.Since(start); d > 250*time.Millisecond {
+			t.Fatal("cancellation took too long", d)
+		}
+		rl.Reset()
+	}
+}
+
+// BenchmarkWriteThrottled benchmarks writing to a RLReadWriter that needs to
+// wait for almost every packet.
+func BenchmarkWriteThrottled(b *testing.B) {
+	rl := NewRateLimit(0, 1<<26, 1<<10)
+	data := fastrand.Bytes(1 << 16)
+	rlc := NewRLReadWriter(struct {
+		io.Reader
+		io.Writer
+	}{nil, ioutil.Discard}, rl, nil)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := rlc.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestNewRateLimitChecked tests validating the limits of a new RateLimit.
+func TestNewRateLimitChecked(t *testing.T) {
+	tests := []struct {
+		readBPS    int64
+		writeBPS   int64
+		packetSize uint64
+		valid      bool
+	}{
+		{0, 0, 0, true},
+		{1000, 2000, 100, true},
+		{math.MaxInt64, math.MaxInt64, math.MaxInt32, true},
+		{-1, 1000, 100, false},
+		{1000, -1, 100, false},
+		{math.MinInt64, math.MinInt64, 100, false},
+		{1000, 1000, math.MaxUint64, false},
+		{1000, 2000, 1000, true},
+		{1000, 2000, 1001, false},
+		{2000, 1000, 1001, false},
+		{0, 500, 500, true},
+		{0, 500, 501, false},
+		{0, 0, 1 << 20, true},
+	}
+	for _, test := range tests {
+		rl, err := NewRateLimitChecked(test.readBPS, test.writeBPS, test.packetSize)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%v/%v/%v: expected error", test.readBPS, test.writeBPS, test.packetSize)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v/%v/%v: unexpected error: %v", test.readBPS, test.writeBPS, test.packetSize, err)
+			continue
+		}
+		if rl.ReadBPS() != test.readBPS || rl.WriteBPS() != test.writeBPS || rl.PacketSize() != test.packetSize {
+			t.Errorf("%v/%v/%v: wrong limits", test.readBPS, test.writeBPS, test.packetSize)
+		}
+	}
+	// Packets exceeding a limit are reported as such.
+	if _, err := NewRateLimitChecked(1000, 0, 1001); !errors.Is(err, ErrPacketSizeTooLarge) {
+		t.Fatal("expected ErrPacketSizeTooLarge", err)
+	}
+}
+
+// TestAggregate tests a RateLimit with a limit that is shared by reads and
+// writes.
+func TestAggregate(t *testing.T) {
+	packetSize := uint64(100)
+	bps := int64(1000)
+	rl := NewRateLimitAggregate(bps, packetSize)
+	if rl.ReadBPS() != bps || rl.WriteBPS() != bps {
+		t.Fatal("wrong limits", rl.ReadBPS(), rl.WriteBPS())
+	}
+
+	// Read and write at the same time.
+	data := fastrand.Bytes(500)
+	rw := NewRLReadWriter(bytes.NewBuffer(append([]byte(nil), data...)), rl, nil)
+	start := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if _, err := rw.Read(make([]byte, len(data))); err != nil {
+			t.Error(err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if _, err := NewRLWriter(ioutil.Discard, rl, nil).Write(data); err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+
+	// The combined throughput shouldn't exceed the shared limit.
+	expected := time.Duration(uint64(2*len(data))-packetSize) * time.Second / time.Duration(bps)
+	if d := time.Since(start); d < expected {
+		t.Fatal("combined throughput exceeded the limit", d, expected)
+	}
+
+	// Changing either limit changes the shared one.
+	rl.SetWriteBPS(2 * bps)
+	if rl.ReadBPS() != 2*bps {
+		t.Fatal("shared limit wasn't changed", rl.ReadBPS())
+	}
+}
+
+// failWriter is a io.Writer that always fails.
+type failWriter struct{}
+
+// Write implements io.Writer.
+func (failWriter) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+
+// TestErrors tests that the errors for cancellation, exceeded deadlines and
+// failed I/O can be told apart.
+func TestErrors(t *testing.T) {
+	// newBlocked creates a RLReadWriter that blocks on the second write.
+	newBlocked := func(ctx context.Context) *RLReadWriter {
+		rl := NewRateLimit(10, 10, 0)
+		rlc := NewRLReadWriterCtx(bytes.NewBuffer(nil), rl, ctx)
+		if _, err := rlc.Write(fastrand.Bytes(100)); err != nil {
+			t.Fatal(err)
+		}
+		return rlc
+	}
+
+	// Closing the cancel channel.
+	c := make(chan struct{})
+	rlc := newBlocked(chanContext(c))
+	time.AfterFunc(50*time.Millisecond, func() { close(c) })
+	_, err := rlc.Write(fastrand.Bytes(10))
+	if !errors.Is(err, ErrCanceled) || !errors.Is(err, context.Canceled) || errors.Is(err, ErrDeadlineExceeded) {
+		t.Fatal("expected ErrCanceled but got", err)
+	}
+
+	// Timing out the context.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	rlc = newBlocked(ctx)
+	_, err = rlc.Write(fastrand.Bytes(10))
+	if !errors.Is(err, ErrCanceled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected ErrCanceled but got", err)
+	}
+
+	// Exceeding the deadline.
+	rlc = newBlocked(context.Background())
+	rlc.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = rlc.Write(fastrand.Bytes(10))
+	if !errors.Is(err, ErrDeadlineExceeded) || errors.Is(err, ErrCanceled) {
+		t.Fatal("expected ErrDeadlineExceeded but got", err)
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatal("ErrDeadlineExceeded should be a timeout", err)
+	}
+
+	// Failing to write.
+	_, err = NewRLWriter(failWriter{}, NewRateLimit(0, 0, 0), nil).Write(fastrand.Bytes(10))
+	if err == nil || errors.Is(err, ErrCanceled) || errors.Is(err, ErrDeadlineExceeded) {
+		t.Fatal("expected I/O error but got", err)
+	}
+}
+
+// spyReadWriter is a io.ReadWriter that counts the bytes it transferred.
+type spyReadWriter struct {
+	read    uint64
+	written uint64
+}
+
+// Read implements io.Reader.
+func (s *spyReadWriter) Read(b []byte) (int, error) {
+	atomic.AddUint64(&s.read, uint64(len(b)))
+	return len(b), nil
+}
+
+// Write implements io.Writer.
+func (s *spyReadWriter) Write(b []byte) (int, error) {
+	atomic.AddUint64(&s.written, uint64(len(b)))
+	return len(b), nil
+}
+
+// TestCancelPartial tests that an interrupted read or write reports exactly
+// the number of bytes that were transferred.
+func TestCancelPartial(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		rl := NewRateLimit(10000, 10000, 100)
+		spy := &spyReadWriter{}
+		c := make(chan struct{})
+		rlc := NewRLReadWriter(spy, rl, c)
+
+		// Cancel at a random point during the transfers.
+		time.AfterFunc(time.Duration(fastrand.Intn(50)+10)*time.Millisecond, func() { close(c) })
+		var wg sync.WaitGroup
+		wg.Add(2)
+		var read, written int
+		var readErr, writeErr error
+		go func() {
+			defer wg.Done()
+			written, writeErr = rlc.Write(fastrand.Bytes(10000))
+		}()
+		go func() {
+			defer wg.Done()
+			read, readErr = rlc.Read(make([]byte, 10000))
+		}()
+		wg.Wait()
+
+		if !errors.Is(writeErr, ErrCanceled) || !errors.Is(readErr, ErrCanceled) {
+			t.Fatal("expected ErrCanceled", writeErr, readErr)
+		}
+		if uint64(written) != atomic.LoadUint64(&spy.written) {
+			t.Fatalf("write reported %v bytes but %v were written", written, spy.written)
+		}
+		if uint64(read) != atomic.LoadUint64(&spy.read) {
+			t.Fatalf("read reported %v bytes but %v were read", read, spy.read)
+		}
+		if written == 0 || read == 0 {
+			t.Fatal("nothing was transferred", written, read)
+		}
+	}
+}
+
+// TestCancelSplit tests that the cancel channels of a RLReadWriter created
+// with NewRLReadWriterSplit only interrupt their own direction.
+func TestCancelSplit(t *testing.T) {
+	for _, dir := range []Direction{DirectionRead, DirectionWrite} {
+		rl := NewRateLimit(1000, 1000, 100)
+		readCancel, writeCancel := make(chan struct{}), make(chan struct{})
+		rlc := NewRLReadWriterSplit(&spyReadWriter{}, rl, readCancel, writeCancel)
+
+		// Cancel one direction while both are waiting for the limit.
+		if dir == DirectionRead {
+			time.AfterFunc(50*time.Millisecond, func() { close(readCancel) })
+		} else {
+			time.AfterFunc(50*time.Millisecond, func() { close(writeCancel) })
+		}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		var readErr, writeErr error
+		var written, read int
+		go func() {
+			defer wg.Done()
+			written, writeErr = rlc.Write(make([]byte, 300))
+		}()
+		go func() {
+			defer wg.Done()
+			read, readErr = rlc.Read(make([]byte, 300))
+		}()
+		wg.Wait()
+
+		canceledErr, otherErr := readErr, writeErr
+		other := written
+		if dir == DirectionWrite {
+			canceledErr, otherErr = writeErr, readErr
+			other = read
+		}
+		if !errors.Is(canceledErr, ErrCanceled) {
+			t.Fatal("expected ErrCanceled", dir, canceledErr)
+		}
+		if otherErr != nil || other != 300 {
+			t.Fatal("other direction was interrupted", dir, other, otherErr)
+		}
+	}
+}
+
+// TestCancelClosed tests that a RLReadWriter whose cancel channel is already
+// closed doesn't transfer anything, even if it wouldn't have to wait.
+func TestCancelClosed(t *testing.T) {
+	c := make(chan struct{})
+	close(c)
+	spy := &spyReadWriter{}
+	rlc := NewRLReadWriter(spy, NewRateLimit(0, 0, 100), c)
+	if n, err := rlc.Write(make([]byte, 1000)); !errors.Is(err, ErrCanceled) || n != 0 {
+		t.Fatal("expected ErrCanceled", n, err)
+	}
+	if n, err := rlc.Read(make([]byte, 1000)); !errors.Is(err, ErrCanceled) || n != 0 {
+		t.Fatal("expected ErrCanceled", n, err)
+	}
+	if spy.read != 0 || spy.written != 0 {
+		t.Fatal("data was transferred", spy.read, spy.written)
+	}
+}
+
+// TestCancelNil tests that a RLReadWriter without a cancel channel is never
+// canceled.
+func TestCancelNil(t *testing.T) {
+	spy := &spyReadWriter{}
+	rlc := NewRLReadWriter(spy, NewRateLimit(10000, 10000, 100), nil)
+	if n, err := rlc.Write(make([]byte, 1000)); err != nil || n != 1000 {
+		t.Fatal("write failed", n, err)
+	}
+	if n, err := rlc.Read(make([]byte, 1000)); err != nil || n != 1000 {
+		t.Fatal("read failed", n, err)
+	}
+}
+
+// TestNetError tests that the errors returned on timeouts and cancellation
+// implement net.Error.
+func TestNetError(t *testing.T) {
+	// checkNetError checks the flags of err.
+	checkNetError := func(err error, timeout, temporary bool) {
+		t.Helper()
+		netErr, ok := err.(net.Error)
+		if !ok {
+			t.Fatalf("%v doesn't implement net.Error", err)
+		}
+		if netErr.Timeout() != timeout || netErr.Temporary() != temporary {
+			t.Fatal("wrong flags", err, netErr.Timeout(), netErr.Temporary())
+		}
+	}
+	checkNetError(ErrDeadlineExceeded, true, true)
+	checkNetError(ErrCanceled, false, false)
+
+	// Exceeded deadlines.
+	rlc := NewRLReadWriter(&spyReadWriter{}, NewRateLimit(10, 10, 100), nil)
+	rlc.SetDeadline(time.Now().Add(-time.Second))
+	_, err := rlc.Write(make([]byte, 100))
+	checkNetError(err, true, true)
+
+	// Cancellation.
+	c := make(chan struct{})
+	close(c)
+	rlc = NewRLReadWriter(&spyReadWriter{}, NewRateLimit(10, 10, 100), c)
+	_, err = rlc.Read(make([]byte, 100))
+	checkNetError(err, false, false)
+	if !errors.Is(err, ErrCanceled) || !errors.Is(err, context.Canceled) {
+		t.Fatal("expected ErrCanceled but got", err)
+	}
+}
+
+// TestDrain tests waiting for the reads and writes of a RateLimit to finish.
+func TestDrain(t *testing.T) {
+	rl := NewRateLimit(1000, 1000, 100)
+
+	// Without operations in progress Drain returns right away.
+	if err := rl.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start a slow write.
+	go func() {
+		rlc := NewRLReadWriter(bytes.NewBuffer(nil), rl, nil)
+		if _, err := rlc.Write(fastrand.Bytes(500)); err != nil {
+			t.Error(err)
+		}
+	}()
+	for atomic.LoadInt64(&rl.atomicActiveOps) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Drain times out with a short context.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := rl.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected context.DeadlineExceeded but got", err)
+	}
+
+	// Without a timeout Drain returns after the write is done.
+	if err := rl.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if rl.Stats().BytesWritten != 500 {
+		t.Fatal("Drain returned before the write was done", rl.Stats())
+	}
+}
+
+// TestActiveOps tests counting the reads and writes in progress.
+func TestActiveOps(t *testing.T) {
+	rl := NewRateLimit(1000, 1000, 100)
+	if n := rl.ActiveOps(); n != 0 {
+		t.Fatal("wrong number of active ops", n)
+	}
+
+	// Start a few writes which all need to wait.
+	rl.ReserveWrite(100)
+	numOps := 5
+	var wg sync.WaitGroup
+	for i := 0; i < numOps; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rlc := NewRLReadWriter(bytes.NewBuffer(nil), rl, nil)
+			if _, err := rlc.Write(fastrand.Bytes(100)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// All of them should be active at some point.
+	start := time.Now()
+	for rl.ActiveOps() != numOps {
+		if time.Since(start) > time.Second {
+			t.Fatal("wrong number of active ops", rl.ActiveOps())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if rl.Stats().BytesWritten == uint64(numOps*100) {
+		t.Fatal("writes shouldn't be done yet")
+	}
+	wg.Wait()
+	if n := rl.ActiveOps(); n != 0 {
+		t.Fatal("wrong number of active ops", n)
+	}
+}
+
+// TestProgress tests the progress callback of a RLReadWriter.
+func TestProgress(t *testing.T) {
+	packetSize := uint64(100)
+	rl := NewRateLimit(0, 0, packetSize)
+	var reported [2]int
+	var calls int
+	rlc := NewRLReadWriterProgress(bytes.NewBuffer(nil), rl, nil, func(dir Direction, n int) {
+		reported[dir] += n
+		calls++
+		if uint64(n) > packetSize {
+			t.Error("reported more than a packet", n)
+		}
+	})
+
+	// Write some data and read part of it back.
+	n, err := rlc.Write(fastrand.Bytes(1050))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reported[DirectionWrite] != n || calls != 11 {
+		t.Fatal("wrong progress", reported, calls)
+	}
+	n, err = rlc.Read(make([]byte, 420))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reported[DirectionRead] != n || calls != 16 {
+		t.Fatal("wrong progress", reported, calls)
+	}
+}
+
+// TestSetPacketSize tests changing the packet size while a transfer is in
+// progress.
+func TestSetPacketSize(t *testing.T) {
+	rl := NewRateLimit(0, 0, 100)
+	var sizes []int
+	buf := bytes.NewBuffer(nil)
+	rlc := NewRLReadWriterProgress(buf, rl, nil, func(dir Direction, n int) {
+		sizes = append(sizes, n)
+		// Shrink the packets halfway through and then stop splitting them
+		// up.
+		switch len(sizes) {
+		case 5:
+			rl.SetPacketSize(10)
+		case 10:
+			rl.SetPacketSize(0)
+		}
+	})
+
+	// Write some data. The packet size changes at the packet boundaries.
+	data := fastrand.Bytes(1000)
+	n, err := rlc.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("data was corrupted")
+	}
+	expected := []int{100, 100, 100, 100, 100, 10, 10, 10, 10, 10, 450}
+	if !reflect.DeepEqual(sizes, expected) {
+		t.Fatal("wrong packet sizes", sizes)
+	}
+	if stats := rl.Stats(); stats.BytesWritten != uint64(len(data)) {
+		t.Fatal("wrong number of bytes written", stats.BytesWritten)
+	}
+
+	// Read it back with a packet size that changes after the first packet.
+	sizes = sizes[:0]
+	rl.SetPacketSize(300)
+	read := make([]byte, len(data))
+	rlc = NewRLReadWriterProgress(buf, rl, nil, func(dir Direction, n int) {
+		sizes = append(sizes, n)
+		rl.SetPacketSize(200)
+	})
+	if _, err := io.ReadFull(rlc, read); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatal("data was corrupted")
+	}
+	expected = []int{300, 200, 200, 200, 100}
+	if !reflect.DeepEqual(sizes, expected) {
+		t.Fatal("wrong packet sizes", sizes)
+	}
+	if stats := rl.Stats(); stats.BytesRead != uint64(len(data)) {
+		t.Fatal("wrong number of bytes read", stats.BytesRead)
+	}
+}
+
+// TestNopRateLimit tests transferring data using a NopRateLimit.
+func TestNopRateLimit(t *testing.T) {
+	rl := NopRateLimit()
+	rlc := NewRLReadWriter(bytes.NewBuffer(nil), rl, nil)
+
+	// Transfer more data than any limit would let through in time.
+	data := fastrand.Bytes(1 << 20)
+	start := time.Now()
+	if _, err := rlc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	read := make([]byte, len(data))
+	if _, err := io.ReadFull(rlc, read); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatal("data was corrupted")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatal("transfer took too long", d)
+	}
+
+	// The bytes are still counted.
+	if stats := rl.Stats(); stats.BytesRead != uint64(len(data)) || stats.BytesWritten != uint64(len(data)) {
+		t.Fatal("wrong stats", stats)
+	}
+}
+
+// callCounter is a io.ReadWriter that counts the calls to the underlying
+// io.ReadWriter.
+type callCounter struct {
+	io.ReadWriter
+	reads  int
+	writes int
+}
+
+// Read implements io.Reader.
+func (c *callCounter) Read(b []byte) (int, error) {
+	c.reads++
+	return c.ReadWriter.Read(b)
+}
+
+// Write implements io.Writer.
+func (c *callCounter) Write(b []byte) (int, error) {
+	c.writes++
+	return c.ReadWriter.Write(b)
+}
+
+// TestPacketSizes tests that reads and writes are split up into packets of
+// their own size.
+func TestPacketSizes(t *testing.T) {
+	rl := NewRateLimitPackets(1<<40, 1<<40, 400, 100)
+	if rl.ReadPacketSize() != 400 || rl.WritePacketSize() != 100 || rl.PacketSize() != 100 {
+		t.Fatal("wrong packet sizes", rl.ReadPacketSize(), rl.WritePacketSize(), rl.PacketSize())
+	}
+	cc := &callCounter{ReadWriter: bytes.NewBuffer(nil)}
+	rlc := NewRLReadWriter(cc, rl, nil)
+
+	data := fastrand.Bytes(1000)
+	if _, err := rlc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if cc.writes != 10 {
+		t.Fatal("wrong number of writes", cc.writes)
+	}
+	read := make([]byte, len(data))
+	if _, err := io.ReadFull(rlc, read); err != nil {
+		t.Fatal(err)
+	}
+	if cc.reads != 3 || !bytes.Equal(read, data) {
+		t.Fatal("wrong number of reads", cc.reads)
+	}
+
+	// Setting a single packet size applies to both directions.
+	rl.SetPacketSize(500)
+	if rl.ReadPacketSize() != 500 || rl.WritePacketSize() != 500 {
+		t.Fatal("wrong packet sizes", rl.ReadPacketSize(), rl.WritePacketSize())
+	}
+
+	// Without a write packet size, the read packet size is returned.
+	rl.SetPacketSizes(200, 0)
+	if rl.PacketSize() != 200 {
+		t.Fatal("wrong packet size", rl.PacketSize())
+	}
+}
+
+// TestBackpressure tests that the backpressure channel is only signaled when
+// the RateLimit is saturated.
+func TestBackpressure(t *testing.T) {
+	// Writes that don't have to wait don't signal backpressure.
+	rl := NewRateLimit(0, 100000, 100)
+	rlc := NewRLReadWriter(&spyReadWriter{}, rl, nil)
+	if _, err := rlc.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	unlimited := NopRateLimit()
+	if _, err := NewRLReadWriter(&spyReadWriter{}, unlimited, nil).Write(make([]byte, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-rl.BackpressureC():
+		t.Fatal("unsaturated RateLimit signaled backpressure")
+	case <-unlimited.BackpressureC():
+		t.Fatal("unlimited RateLimit signaled backpressure")
+	default:
+	}
+
+	// Saturate the RateLimit. The signals are coalesced.
+	if _, err := rlc.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-rl.BackpressureC():
+	default:
+		t.Fatal("saturated RateLimit didn't signal backpressure")
+	}
+	select {
+	case <-rl.BackpressureC():
+		t.Fatal("signals weren't coalesced")
+	default:
+	}
+}
+
+// TestSaturated tests that a RateLimit reports whether it is saturated in
+// each direction.
+func TestSaturated(t *testing.T) {
+	clock := newFakeClock()
+	rl := NewRateLimitWithOptions(WithReadBPS(1000), WithWriteBPS(1000), WithPacketSize(100), WithClock(clock))
+	if rl.SaturatedRead() || rl.SaturatedWrite() {
+		t.Fatal("new RateLimit is saturated")
+	}
+
+	// Saturate the writes.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := NewRLReadWriter(&spyReadWriter{}, rl, nil).Write(make([]byte, 300)); err != nil {
+			t.Error(err)
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		for clock.Pending() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(100 * time.Millisecond)
+	}
+	<-done
+	if !rl.SaturatedWrite() || rl.SaturatedRead() {
+		t.Fatal("wrong saturation", rl.SaturatedWrite(), rl.SaturatedRead())
+	}
+
+	// Once idle, the saturation clears.
+	clock.Advance(saturationWindow)
+	if rl.SaturatedWrite() {
+		t.Fatal("idle RateLimit is saturated")
+	}
+}
+
+// timestampWriter is a io.ReadWriter that records the time of every write.
+type timestampWriter struct {
+	io.Reader
+	times []time.Time
+}
+
+// Write implements io.Writer.
+func (w *timestampWriter) Write(b []byte) (int, error) {
+	w.times = append(w.times, time.Now())
+	return len(b), nil
+}
+
+// TestLargeWriteChunked tests that a single large write is split up into
+// packets which are written at a steady pace instead of a single burst.
+func TestLargeWriteChunked(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	packetSize := 4 << 10
+	size := 1 << 20
+	rl := NewRateLimit(0, 2<<20, uint64(packetSize))
+	w := &timestampWriter{}
+	rlc := NewRLReadWriter(w, rl, nil)
+
+	start := time.Now()
+	if n, err := rlc.Write(make([]byte, size)); err != nil || n != size {
+		t.Fatal("write failed", n, err)
+	}
+	elapsed := time.Since(start)
+	if len(w.times) != size/packetSize {
+		t.Fatal("wrong number of writes", len(w.times))
+	}
+
+	// Every packet took about 2ms. There shouldn't be any long pauses and
+	// half the data should be written after roughly half the time.
+	prev := start
+	for i, ts := range w.times {
+		if gap := ts.Sub(prev); gap > 100*time.Millisecond {
+			t.Fatal("long pause before packet", i, gap)
+		}
+		prev = ts
+	}
+	if half := w.times[len(w.times)/2].Sub(start); half < elapsed/4 || half > elapsed*3/4 {
+		t.Fatalf("data wasn't written steadily: half after %v of %v", half, elapsed)
+	}
+}
+
+// cancelWriter is a io.ReadWriter that calls cancel on every write.
+type cancelWriter struct {
+	io.Reader
+	cancel func()
+}
+
+// Write implements io.Writer.
+func (w cancelWriter) Write(b []byte) (int, error) {
+	w.cancel()
+	return len(b), nil
+}
+
+// TestWriteCanceledBetweenPackets tests that a write is interrupted between
+// packets even if the packets don't have to wait.
+func TestWriteCanceledBetweenPackets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	rlc := NewRLReadWriterCtx(cancelWriter{cancel: cancel}, NewRateLimit(1<<40, 1<<40, 100), ctx)
+	n, err := rlc.Write(make([]byte, 1000))
+	if !errors.Is(err, ErrCanceled) || n != 100 {
+		t.Fatal("write wasn't canceled after the first packet", n, err)
+	}
+}
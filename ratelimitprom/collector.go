@@ -0,0 +1,100 @@
+// Package ratelimitprom exports the metrics of a ratelimit.RateLimit to
+// Prometheus. It is a separate package to avoid forcing the Prometheus
+// dependency on all users of the ratelimit package.
+package ratelimitprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uplo-tech/ratelimit"
+)
+
+const (
+	// namespace is the prefix of the names of all the metrics.
+	namespace = "ratelimit"
+
+	// nameLabel is the label which holds the name of the RateLimit.
+	nameLabel = "name"
+)
+
+// collector is a prometheus.Collector for the metrics of a RateLimit.
+type collector struct {
+	rl *ratelimit.RateLimit
+
+	// withName is true if the name of rl is added as a variable label.
+	withName bool
+
+	bytesRead    *prometheus.Desc
+	bytesWritten *prometheus.Desc
+	activeOps    *prometheus.Desc
+	waitSeconds  *prometheus.Desc
+}
+
+// NewCollector creates a prometheus.Collector which exposes the metrics of rl.
+// The metrics are read from rl whenever they are collected. The labels are
+// added to all the metrics and are required to tell multiple RateLimits
+// registered with the same prometheus.Registerer apart. Unless labels contain
+// a "name" label, the current name of rl is added as the "name" label.
+func NewCollector(rl *ratelimit.RateLimit, labels prometheus.Labels) prometheus.Collector {
+	_, hasName := labels[nameLabel]
+	var variableLabels []string
+	if !hasName {
+		variableLabels = []string{nameLabel}
+	}
+	return &collector{
+		rl:       rl,
+		withName: !hasName,
+		bytesRead: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "bytes_read_total"),
+			"The total number of bytes read.",
+			variableLabels, labels,
+		),
+		bytesWritten: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "bytes_written_total"),
+			"The total number of bytes written.",
+			variableLabels, labels,
+		),
+		activeOps: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "active_operations"),
+			"The number of reads and writes in progress.",
+			variableLabels, labels,
+		),
+		waitSeconds: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wait_seconds"),
+			"The time packets waited for the rate limit.",
+			variableLabels, labels,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.bytesRead
+	ch <- c.bytesWritten
+	ch <- c.activeOps
+	ch <- c.waitSeconds
+}
+
+// Collect implements prometheus.Collector.
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	var labelValues []string
+	if c.withName {
+		labelValues = []string{c.rl.Name()}
+	}
+	stats := c.rl.Stats()
+	ch <- prometheus.MustNewConstMetric(c.bytesRead, prometheus.CounterValue, float64(stats.BytesRead), labelValues...)
+	ch <- prometheus.MustNewConstMetric(c.bytesWritten, prometheus.CounterValue, float64(stats.BytesWritten), labelValues...)
+	ch <- prometheus.MustNewConstMetric(c.activeOps, prometheus.GaugeValue, float64(c.rl.ActiveOps()), labelValues...)
+
+	// Prometheus buckets are cumulative and the last bucket of the
+	// WaitHistogram is the implicit +Inf bucket.
+	hist := c.rl.WaitHistogram()
+	buckets := make(map[float64]uint64, len(hist)-1)
+	var count uint64
+	for i, b := range hist {
+		count += b.Count
+		if i < len(hist)-1 {
+			buckets[b.UpperBound.Seconds()] = count
+		}
+	}
+	ch <- prometheus.MustNewConstHistogram(c.waitSeconds, count, c.rl.TotalWait().Seconds(), buckets, labelValues...)
+}
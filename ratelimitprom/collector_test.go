@@ -0,0 +1,113 @@
+package ratelimitprom
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/uplo-tech/ratelimit"
+)
+
+// gather gathers the metric families of reg by name.
+func gather(t *testing.T, reg *prometheus.Registry) map[string]*dto.MetricFamily {
+	t.Helper()
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := make(map[string]*dto.MetricFamily)
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+	return families
+}
+
+// TestCollector tests that the collector exposes the metrics of a RateLimit.
+func TestCollector(t *testing.T) {
+	rl := ratelimit.NewRateLimit(0, 0, 100)
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(NewCollector(rl, prometheus.Labels{"name": "test"})); err != nil {
+		t.Fatal(err)
+	}
+
+	// All the metric families should be there from the start.
+	families := gather(t, reg)
+	for _, name := range []string{
+		"ratelimit_bytes_read_total",
+		"ratelimit_bytes_written_total",
+		"ratelimit_active_operations",
+		"ratelimit_wait_seconds",
+	} {
+		mf, ok := families[name]
+		if !ok || len(mf.GetMetric()) != 1 {
+			t.Fatal("missing metric", name)
+		}
+		labels := mf.GetMetric()[0].GetLabel()
+		if len(labels) != 1 || labels[0].GetName() != "name" || labels[0].GetValue() != "test" {
+			t.Fatal("wrong labels", name, labels)
+		}
+	}
+	if v := families["ratelimit_bytes_written_total"].GetMetric()[0].GetCounter().GetValue(); v != 0 {
+		t.Fatal("wrong initial value", v)
+	}
+
+	// Transfer some data.
+	rlc := ratelimit.NewRLReadWriter(new(bytes.Buffer), rl, nil)
+	if _, err := rlc.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rlc.Read(make([]byte, 400)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The counters should have increased.
+	families = gather(t, reg)
+	if v := families["ratelimit_bytes_written_total"].GetMetric()[0].GetCounter().GetValue(); v != 1000 {
+		t.Fatal("wrong bytes written", v)
+	}
+	if v := families["ratelimit_bytes_read_total"].GetMetric()[0].GetCounter().GetValue(); v != 400 {
+		t.Fatal("wrong bytes read", v)
+	}
+	if v := families["ratelimit_active_operations"].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Fatal("wrong active operations", v)
+	}
+	// Without limits, the write and the read aren't split up into packets.
+	hist := families["ratelimit_wait_seconds"].GetMetric()[0].GetHistogram()
+	if hist.GetSampleCount() != 2 {
+		t.Fatal("wrong number of waits", hist.GetSampleCount())
+	}
+	buckets := hist.GetBucket()
+	if len(buckets) == 0 || buckets[len(buckets)-1].GetCumulativeCount() != hist.GetSampleCount() {
+		t.Fatal("buckets should be cumulative", buckets)
+	}
+}
+
+// TestCollectorName tests that the name of a RateLimit is used as the "name"
+// label unless the labels already contain one.
+func TestCollectorName(t *testing.T) {
+	rl := ratelimit.NewRateLimitWithOptions(ratelimit.WithName("uploads"))
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(NewCollector(rl, prometheus.Labels{"host": "a"})); err != nil {
+		t.Fatal(err)
+	}
+
+	// nameOf returns the value of the "name" label of the active operations.
+	nameOf := func() string {
+		for _, label := range gather(t, reg)["ratelimit_active_operations"].GetMetric()[0].GetLabel() {
+			if label.GetName() == "name" {
+				return label.GetValue()
+			}
+		}
+		return ""
+	}
+	if name := nameOf(); name != "uploads" {
+		t.Fatal("wrong name", name)
+	}
+
+	// Renaming the RateLimit changes the label.
+	rl.SetName("downloads")
+	if name := nameOf(); name != "downloads" {
+		t.Fatal("wrong name", name)
+	}
+}
@@ -0,0 +1,50 @@
+// Package ratelimitxrate adapts a rate.Limiter from golang.org/x/time/rate to
+// the ratelimit.Limiter interface. It is a separate package to avoid forcing
+// the x/time dependency on all users of the ratelimit package.
+package ratelimitxrate
+
+import (
+	"context"
+
+	"github.com/uplo-tech/ratelimit"
+	"golang.org/x/time/rate"
+)
+
+// rateAdapter is a ratelimit.Limiter backed by a rate.Limiter from golang.org/x/time/rate
+// whose events are bytes.
+type rateAdapter struct {
+	l *rate.Limiter
+}
+
+// LimiterFromRate creates a ratelimit.Limiter which paces reads and writes with l. Every
+// byte is a single event of l and reads and writes share l. Reads and writes
+// of more bytes than the burst of l wait for multiple bursts in a row.
+func LimiterFromRate(l *rate.Limiter) ratelimit.Limiter {
+	return &rateAdapter{l: l}
+}
+
+// WaitRead blocks until l allows reading n bytes.
+func (a *rateAdapter) WaitRead(ctx context.Context, n int) error {
+	return a.wait(ctx, n)
+}
+
+// WaitWrite blocks until l allows writing n bytes.
+func (a *rateAdapter) WaitWrite(ctx context.Context, n int) error {
+	return a.wait(ctx, n)
+}
+
+// wait waits for n events of l. Since rate.Limiter.WaitN refuses to wait for
+// more events than the burst, larger waits are split up.
+func (a *rateAdapter) wait(ctx context.Context, n int) error {
+	if a.l.Limit() == rate.Inf {
+		return nil
+	}
+	burst := a.l.Burst()
+	for n > burst && burst > 0 {
+		if err := a.l.WaitN(ctx, burst); err != nil {
+			return err
+		}
+		n -= burst
+	}
+	return a.l.WaitN(ctx, n)
+}
@@ -0,0 +1,43 @@
+package ratelimitxrate
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/ratelimit"
+	"golang.org/x/time/rate"
+)
+
+// TestLimiterFromRate tests pacing a RLReadWriter with a rate.Limiter.
+func TestLimiterFromRate(t *testing.T) {
+	// The first 1000 bytes are covered by the burst, the remaining 4000
+	// bytes take 400ms.
+	l := rate.NewLimiter(10000, 1000)
+	rlc := ratelimit.NewRLReadWriter(new(bytes.Buffer), LimiterFromRate(l), nil)
+	start := time.Now()
+	if _, err := rlc.Write(make([]byte, 5000)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 350*time.Millisecond || d > time.Second {
+		t.Fatal("wrong duration", d)
+	}
+
+	// Waiting for the rate.Limiter can be canceled.
+	cancel := make(chan struct{})
+	rlc = ratelimit.NewRLReadWriter(bytes.NewBuffer(make([]byte, 10)), LimiterFromRate(rate.NewLimiter(1, 1)), cancel)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(cancel)
+	}()
+	if _, err := rlc.Read(make([]byte, 10)); !errors.Is(err, ratelimit.ErrCanceled) {
+		t.Fatal("expected ErrCanceled", err)
+	}
+
+	// An infinite rate doesn't limit at all.
+	rlc = ratelimit.NewRLReadWriter(new(bytes.Buffer), LimiterFromRate(rate.NewLimiter(rate.Inf, 0)), nil)
+	if _, err := rlc.Write(make([]byte, 5000)); err != nil {
+		t.Fatal(err)
+	}
+}
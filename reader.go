@@ -0,0 +1,42 @@
+package ratelimit
+
+import (
+	"io"
+	"sync"
+)
+
+// RateLimitedReader is a rate-limiting wrapper for the io.ReadCloser interface.
+// It is only limited by the read limit of the global rate limiter.
+type RateLimitedReader struct {
+	rlrw *RLReadWriter
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewRateLimitedReader wraps a io.ReadCloser into a RateLimitedReader. Closing
+// cancel interrupts all pending reads.
+func NewRateLimitedReader(rc io.ReadCloser, rl Limiter, cancel <-chan struct{}) *RateLimitedReader {
+	return &RateLimitedReader{
+		rlrw: NewRLReadWriter(struct {
+			io.ReadCloser
+			io.Writer
+		}{ReadCloser: rc}, rl, cancel),
+	}
+}
+
+// Read reads from the underlying reader with the maximum possible speed
+// allowed by the rateLimit.
+func (r *RateLimitedReader) Read(b []byte) (int, error) {
+	return r.rlrw.Read(b)
+}
+
+// Close closes the underlying reader and interrupts pending reads. Only the
+// first call closes the underlying reader, subsequent calls return the same
+// error.
+func (r *RateLimitedReader) Close() error {
+	r.closeOnce.Do(func() {
+		r.closeErr = r.rlrw.Close()
+	})
+	return r.closeErr
+}
@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+)
+
+// countCloser is an io.ReadCloser which counts how often it was closed.
+type countCloser struct {
+	io.Reader
+	closed int
+}
+
+// Close implements io.Closer.
+func (cc *countCloser) Close() error {
+	cc.closed++
+	return errors.New("closed")
+}
+
+// TestRateLimitedReader tests reading from a RateLimitedReader and closing it.
+func TestRateLimitedReader(t *testing.T) {
+	data := fastrand.Bytes(300)
+	cc := &countCloser{Reader: bytes.NewReader(data)}
+	r := NewRateLimitedReader(cc, NewRateLimit(1000, 0, 100), nil)
+
+	// Reading 3 packets waits for 2 of them.
+	start := time.Now()
+	read, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatal("wrong data")
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatal("read wasn't limited", d)
+	}
+
+	// Close is only forwarded once.
+	for i := 0; i < 2; i++ {
+		if err := r.Close(); err == nil || err.Error() != "closed" {
+			t.Fatal("wrong error", err)
+		}
+	}
+	if cc.closed != 1 {
+		t.Fatal("wrong number of closes", cc.closed)
+	}
+	if _, err := r.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read after close should fail")
+	}
+}
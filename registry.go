@@ -0,0 +1,27 @@
+package ratelimit
+
+import "sync"
+
+var (
+	// registry contains the RateLimits that were registered by name.
+	registry   = make(map[string]*RateLimit)
+	registryMu sync.Mutex
+)
+
+// Register registers rl under the provided name which allows for looking it
+// up with Get from anywhere in the program. If a RateLimit was already
+// registered under the same name, it is replaced.
+func Register(name string, rl *RateLimit) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = rl
+}
+
+// Get returns the RateLimit that was registered under the provided name. The
+// returned bool indicates whether a RateLimit was found.
+func Get(name string) (*RateLimit, bool) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	rl, ok := registry[name]
+	return rl, ok
+}
@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+)
+
+// TestRegistry tests registering and looking up RateLimits by name.
+func TestRegistry(t *testing.T) {
+	// Looking up an unknown name fails.
+	if _, ok := Get(t.Name()); ok {
+		t.Fatal("found unregistered RateLimit")
+	}
+
+	// Register a RateLimit.
+	rl := NewRateLimit(1000, 1000, 100)
+	Register(t.Name(), rl)
+
+	// Fetch it from a different call site and use it.
+	write := func() time.Duration {
+		rl, ok := Get(t.Name())
+		if !ok {
+			t.Fatal("RateLimit wasn't found")
+		}
+		rlc := NewRLReadWriter(bytes.NewBuffer(nil), rl, nil)
+		start := time.Now()
+		if _, err := rlc.Write(fastrand.Bytes(300)); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+	got, _ := Get(t.Name())
+	if got != rl {
+		t.Fatal("got a different RateLimit")
+	}
+
+	// Both writes share the same limit. The second write has to wait for the
+	// first one.
+	write()
+	if d := write(); d < 300*time.Millisecond {
+		t.Fatal("registered RateLimit didn't enforce the limit", d)
+	}
+
+	// Registering the same name again replaces the RateLimit.
+	rl2 := NewRateLimit(0, 0, 0)
+	Register(t.Name(), rl2)
+	if got, ok := Get(t.Name()); !ok || got != rl2 {
+		t.Fatal("RateLimit wasn't replaced")
+	}
+}
@@ -0,0 +1,161 @@
+package ratelimit
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// day is the length of the cycle of a Scheduler.
+const day = 24 * time.Hour
+
+type (
+	// Scheduler changes the limits of a RateLimit at fixed times of the day,
+	// e.g. to allow for more bandwidth overnight. Every rule takes effect at
+	// its time of day and stays in effect until the next rule's time of day.
+	// Before the earliest rule of a day, the latest rule of the previous day
+	// is in effect. That way the rules always cover the whole day, including
+	// windows that wrap around midnight. If multiple rules have the same time
+	// of day, the one that was added last wins.
+	//
+	// The times of day are measured from midnight in the location of the
+	// times returned by the RateLimit's Clock.
+	Scheduler struct {
+		mu      sync.Mutex
+		rules   []scheduleRule
+		changed chan struct{} // signals the running schedule to re-evaluate.
+		stop    chan struct{}
+		wg      sync.WaitGroup
+	}
+
+	// scheduleRule is a change of the limits at a time of the day.
+	scheduleRule struct {
+		at       time.Duration // the offset from midnight.
+		readBPS  int64
+		writeBPS int64
+	}
+)
+
+// NewScheduler creates a new Scheduler without any rules.
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Add adds a rule which sets the limits to readBPS and writeBPS at timeOfDay,
+// the time since midnight. timeOfDay is taken modulo 24 hours. Rules can be
+// added while the Scheduler is running.
+func (s *Scheduler) Add(timeOfDay time.Duration, readBPS, writeBPS int64) {
+	timeOfDay %= day
+	if timeOfDay < 0 {
+		timeOfDay += day
+	}
+	s.mu.Lock()
+	// Insert the rule after all the rules with the same time of day to let
+	// it win.
+	i := sort.Search(len(s.rules), func(i int) bool {
+		return s.rules[i].at > timeOfDay
+	})
+	s.rules = append(s.rules, scheduleRule{})
+	copy(s.rules[i+1:], s.rules[i:])
+	s.rules[i] = scheduleRule{at: timeOfDay, readBPS: readBPS, writeBPS: writeBPS}
+	s.mu.Unlock()
+
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Start applies the rule that is currently in effect to rl and keeps applying
+// the rules in a background goroutine until Stop is called. A Scheduler that
+// is already running is stopped first.
+func (s *Scheduler) Start(rl *RateLimit) {
+	s.Stop()
+	s.mu.Lock()
+	s.stop = make(chan struct{})
+	stop := s.stop
+	s.mu.Unlock()
+
+	// The rules that were added so far are applied right away.
+	select {
+	case <-s.changed:
+	default:
+	}
+	d := s.apply(rl)
+	s.wg.Add(1)
+	go s.threadedSchedule(rl, d, stop)
+}
+
+// Stop stops applying the rules. The limits of the RateLimit remain the ones
+// that were set last.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// apply sets the limits of rl to the ones of the rule in effect and returns
+// the time until the next rule takes effect. Without rules, rl is not changed
+// and the returned duration is 0.
+func (s *Scheduler) apply(rl *RateLimit) time.Duration {
+	now := rl.clock.Now()
+	year, month, date := now.Date()
+	midnight := time.Date(year, month, date, 0, 0, 0, 0, now.Location())
+	sinceMidnight := now.Sub(midnight)
+
+	s.mu.Lock()
+	if len(s.rules) == 0 {
+		s.mu.Unlock()
+		return 0
+	}
+	// The rule in effect is the last one that started at or before now. If
+	// there is none, it's the last one of the previous day.
+	i := sort.Search(len(s.rules), func(i int) bool {
+		return s.rules[i].at > sinceMidnight
+	})
+	current := s.rules[(i+len(s.rules)-1)%len(s.rules)]
+	var next time.Time
+	if i < len(s.rules) {
+		next = midnight.Add(s.rules[i].at)
+	} else {
+		next = time.Date(year, month, date+1, 0, 0, 0, 0, now.Location()).Add(s.rules[0].at)
+	}
+	s.mu.Unlock()
+
+	rl.SetReadBPS(current.readBPS)
+	rl.SetWriteBPS(current.writeBPS)
+	return next.Sub(now)
+}
+
+// threadedSchedule applies the rules to rl whenever the next one takes effect
+// until stop is closed. d is the time until the next rule takes effect.
+func (s *Scheduler) threadedSchedule(rl *RateLimit, d time.Duration, stop <-chan struct{}) {
+	defer s.wg.Done()
+	if d <= 0 {
+		d = day
+	}
+	timer := rl.clock.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C():
+		case <-s.changed:
+			// Stop the timer before resetting it.
+			if !timer.Stop() {
+				<-timer.C()
+			}
+		}
+		if d = s.apply(rl); d <= 0 {
+			d = day
+		}
+		timer.Reset(d)
+	}
+}
@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// TestScheduler tests that a Scheduler applies its rules when their time of
+// day is reached.
+func TestScheduler(t *testing.T) {
+	clock := newFakeClock()
+	clock.now = time.Date(2020, 1, 1, 22, 0, 0, 0, time.UTC)
+	rl := NewRateLimitWithOptions(WithReadBPS(1), WithWriteBPS(1), WithClock(clock))
+
+	// Limit the bandwidth during the day and lift the limits overnight. The
+	// later of the two rules at 8:00 wins.
+	s := NewScheduler()
+	s.Add(8*time.Hour, 10, 20)
+	s.Add(8*time.Hour, 100, 200)
+	s.Add(23*time.Hour, 0, 0)
+	s.Add(-23*time.Hour, 1000, 2000) // 1:00
+
+	// waitFor advances the clock by d once the Scheduler is waiting and
+	// waits for the limits to change.
+	waitFor := func(d time.Duration, readBPS, writeBPS int64) {
+		t.Helper()
+		for clock.Pending() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(d)
+		deadline := time.Now().Add(5 * time.Second)
+		for rl.ReadBPS() != readBPS || rl.WriteBPS() != writeBPS {
+			if time.Now().After(deadline) {
+				t.Fatal("limits weren't updated", rl.ReadBPS(), rl.WriteBPS())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The rule that started at 8:00 is applied right away.
+	s.Start(rl)
+	if rl.ReadBPS() != 100 || rl.WriteBPS() != 200 {
+		t.Fatal("wrong initial limits", rl.ReadBPS(), rl.WriteBPS())
+	}
+
+	// Cross the boundaries at 23:00 and at 1:00 of the next day.
+	waitFor(time.Hour, 0, 0)
+	waitFor(2*time.Hour, 1000, 2000)
+
+	// Rules can be added while running.
+	s.Add(2*time.Hour, 5, 5)
+	waitFor(time.Hour, 5, 5)
+
+	// After stopping, the limits don't change anymore.
+	s.Stop()
+	clock.Advance(24 * time.Hour)
+	if rl.ReadBPS() != 5 || rl.WriteBPS() != 5 {
+		t.Fatal("limits changed after stopping", rl.ReadBPS(), rl.WriteBPS())
+	}
+}
@@ -0,0 +1,45 @@
+package ratelimit
+
+// splitGroup is a group of RateLimits created by Split. The members of the
+// group share the limits of their parent equally.
+type splitGroup struct {
+	members []*RateLimit // protected by the parent's childrenMu.
+}
+
+// Split divides the limits of rl equally among n new RateLimits derived from
+// rl. Like with Derive, the RateLimits follow changes of the limits of rl and
+// can't exceed them together. Once a RateLimit of the group is released, the
+// remaining ones reclaim its share.
+func (rl *RateLimit) Split(n int) []*RateLimit {
+	if n <= 0 {
+		return nil
+	}
+	group := &splitGroup{}
+	children := make([]*RateLimit, n)
+	for i := range children {
+		children[i] = rl.Derive(1 / float64(n))
+		children[i].group = group
+	}
+
+	rl.childrenMu.Lock()
+	defer rl.childrenMu.Unlock()
+	group.members = append(group.members, children...)
+	return children
+}
+
+// leave removes rl from its group and divides its share among the remaining
+// RateLimits of the group. rl.parent.childrenMu must be held by the caller.
+func (rl *RateLimit) leave() {
+	members := rl.group.members
+	for i, member := range members {
+		if member != rl {
+			continue
+		}
+		rl.group.members = append(members[:i:i], members[i+1:]...)
+		for _, m := range rl.group.members {
+			m.fraction = 1 / float64(len(rl.group.members))
+			m.deriveLimits()
+		}
+		return
+	}
+}
@@ -0,0 +1,44 @@
+package ratelimit
+
+import "testing"
+
+// TestSplit tests splitting a RateLimit into equal shares and releasing them.
+func TestSplit(t *testing.T) {
+	parent := NewRateLimit(1200, 2400, 100)
+	children := parent.Split(4)
+	if len(children) != 4 {
+		t.Fatal("wrong number of children", len(children))
+	}
+	for _, child := range children {
+		if child.ReadBPS() != 300 || child.WriteBPS() != 600 {
+			t.Fatal("wrong share", child.ReadBPS(), child.WriteBPS())
+		}
+	}
+
+	// Releasing a child raises the shares of the others.
+	children[0].Release()
+	for _, child := range children[1:] {
+		if child.ReadBPS() != 400 || child.WriteBPS() != 800 {
+			t.Fatal("wrong share after release", child.ReadBPS(), child.WriteBPS())
+		}
+	}
+
+	// The released child no longer follows the parent. Releasing it again
+	// is a no-op.
+	children[0].Release()
+	parent.SetLimits(3000, 6000, 100)
+	if children[0].ReadBPS() != 300 || children[0].WriteBPS() != 600 {
+		t.Fatal("released child followed the parent", children[0].ReadBPS(), children[0].WriteBPS())
+	}
+	for _, child := range children[1:] {
+		if child.ReadBPS() != 1000 || child.WriteBPS() != 2000 {
+			t.Fatal("wrong share after update", child.ReadBPS(), child.WriteBPS())
+		}
+	}
+
+	// RateLimits that weren't split can't be released.
+	parent.Release()
+	if parent.Split(0) != nil {
+		t.Fatal("splitting into 0 RateLimits should return nil")
+	}
+}
@@ -0,0 +1,44 @@
+package ratelimit
+
+// Suspend stops the reads and writes of the RLReadWriter until Resume is
+// called. Unlike RateLimit.Pause, it only affects this RLReadWriter and not the
+// others sharing its Limiter. Packets that are already being transferred are
+// finished. The following ones block before they are charged, so the time
+// spent suspended doesn't count towards the limits. Blocked reads and writes
+// can still be canceled and their deadlines still expire.
+func (l *RLReadWriter) Suspend() {
+	l.suspendMu.Lock()
+	defer l.suspendMu.Unlock()
+	if l.resumed == nil {
+		l.resumed = make(chan struct{})
+	}
+}
+
+// Resume continues the reads and writes of a suspended RLReadWriter.
+func (l *RLReadWriter) Resume() {
+	l.suspendMu.Lock()
+	defer l.suspendMu.Unlock()
+	if l.resumed != nil {
+		close(l.resumed)
+		l.resumed = nil
+	}
+}
+
+// waitResumed blocks while the RLReadWriter is suspended. If expired is closed
+// before it is resumed, the error of the deadline d is returned.
+func (l *RLReadWriter) waitResumed(dir Direction, d *deadline, expired <-chan struct{}) error {
+	l.suspendMu.Lock()
+	resumed := l.resumed
+	l.suspendMu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-l.ctxs[dir].Done():
+		return l.canceledErr(dir, l.ctxs[dir].Err())
+	case <-expired:
+		return d.err()
+	}
+}
@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSuspend tests that suspending a RLReadWriter only stalls that one and
+// not the others sharing its RateLimit.
+func TestSuspend(t *testing.T) {
+	rl := NewRateLimit(0, 10000, 100)
+	suspendedSpy, otherSpy := &spyReadWriter{}, &spyReadWriter{}
+	suspended := NewRLReadWriter(suspendedSpy, rl, nil)
+	other := NewRLReadWriter(otherSpy, rl, nil)
+
+	suspended.Suspend()
+	done := make(chan error, 1)
+	go func() {
+		_, err := suspended.Write(make([]byte, 1000))
+		done <- err
+	}()
+
+	// The other RLReadWriter keeps writing.
+	if _, err := other.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		t.Fatal("suspended write wasn't stalled", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if atomic.LoadUint64(&suspendedSpy.written) != 0 {
+		t.Fatal("suspended RLReadWriter wrote data", suspendedSpy.written)
+	}
+	if written := rl.Stats().BytesWritten; written != 1000 {
+		t.Fatal("suspended write was charged", written)
+	}
+
+	// Once resumed, the write finishes.
+	suspended.Resume()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadUint64(&suspendedSpy.written) != 1000 {
+		t.Fatal("wrong number of bytes written", suspendedSpy.written)
+	}
+}
+
+// TestSuspendCancel tests that the reads and writes of a suspended
+// RLReadWriter can still be canceled and time out.
+func TestSuspendCancel(t *testing.T) {
+	cancel := make(chan struct{})
+	rlc := NewRLReadWriter(&spyReadWriter{}, NewRateLimit(0, 0, 100), cancel)
+	rlc.Suspend()
+	rlc.Suspend()
+
+	// The deadline still expires.
+	rlc.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := rlc.Read(make([]byte, 100)); !errors.Is(err, ErrDeadlineExceeded) {
+		t.Fatal("expected ErrDeadlineExceeded but got", err)
+	}
+
+	// Closing the cancel channel unblocks the write.
+	time.AfterFunc(20*time.Millisecond, func() { close(cancel) })
+	if _, err := rlc.Write(make([]byte, 100)); !errors.Is(err, ErrCanceled) {
+		t.Fatal("expected ErrCanceled but got", err)
+	}
+}
@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// defaultHandshakeGrace is the time after which the limits of a connection
+// created by NewRLConnExemptHandshake engage if the connection doesn't report
+// the end of the handshake before.
+const defaultHandshakeGrace = 2 * time.Second
+
+type (
+	// handshake is the TLS handshake of a connection which is exempt from the
+	// limits of its RLReadWriter.
+	handshake struct {
+		stater tlsStater // nil if the connection doesn't report its state.
+		end    time.Time // the end of the grace period.
+		clock  Clock
+
+		atomicDone int32 // set to 1 once the limits engaged.
+	}
+
+	// tlsStater is implemented by connections which report the state of
+	// their TLS handshake, e.g. *tls.Conn.
+	tlsStater interface {
+		ConnectionState() tls.ConnectionState
+	}
+)
+
+// NewRLConnExemptHandshake wraps a net.Conn into a RLReadWriter whose reads
+// and writes aren't limited until the TLS handshake is done. Like
+// NewRLConnExemptHandshakeGrace, it assumes that the handshake is done after
+// 2 seconds at the latest.
+func NewRLConnExemptHandshake(conn net.Conn, rl Limiter, cancel <-chan struct{}) net.Conn {
+	return NewRLConnExemptHandshakeGrace(conn, rl, defaultHandshakeGrace, cancel)
+}
+
+// NewRLConnExemptHandshakeGrace wraps a net.Conn into a RLReadWriter whose
+// reads and writes aren't limited until the TLS handshake is done. That way
+// the limits don't slow down the connection setup.
+//
+// If conn reports the state of its handshake, i.e. if it is a *tls.Conn, the
+// limits engage as soon as the handshake is complete. Otherwise, e.g. for the
+// connection underneath a *tls.Conn, the handshake can't be observed and the
+// grace period since the creation of the wrapper is used as an approximation.
+// Reads and writes are never exempt for longer than grace. Closing cancel
+// interrupts all pending reads and writes.
+func NewRLConnExemptHandshakeGrace(conn net.Conn, rl Limiter, grace time.Duration, cancel <-chan struct{}) net.Conn {
+	var clock Clock = realClock{}
+	if r, ok := rl.(*RateLimit); ok {
+		clock = r.clock
+	}
+	c := &rlConn{
+		Conn: conn,
+		rlrw: NewRLReadWriter(conn, rl, cancel),
+	}
+	c.rlrw.handshake = &handshake{
+		end:   clock.Now().Add(grace),
+		clock: clock,
+	}
+	c.rlrw.handshake.stater, _ = conn.(tlsStater)
+	return c
+}
+
+// exempt returns whether the handshake is still in progress. Once it returns
+// false, it always does.
+func (h *handshake) exempt() bool {
+	if h == nil || atomic.LoadInt32(&h.atomicDone) == 1 {
+		return false
+	}
+	if (h.stater != nil && h.stater.ConnectionState().HandshakeComplete) || !h.clock.Now().Before(h.end) {
+		atomic.StoreInt32(&h.atomicDone, 1)
+		return false
+	}
+	return true
+}
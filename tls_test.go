@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stateConn is a net.Conn which reports the state of its TLS handshake.
+type stateConn struct {
+	net.Conn
+	atomicComplete int32
+}
+
+// ConnectionState implements the tlsStater interface.
+func (c *stateConn) ConnectionState() tls.ConnectionState {
+	return tls.ConnectionState{HandshakeComplete: atomic.LoadInt32(&c.atomicComplete) == 1}
+}
+
+// newDiscardPipe creates a net.Conn whose writes are discarded by the other
+// end of the pipe until it is closed.
+func newDiscardPipe() net.Conn {
+	p1, p2 := net.Pipe()
+	go func() {
+		io.Copy(ioutil.Discard, p2)
+		p2.Close()
+	}()
+	return p1
+}
+
+// timeWrite writes n bytes to conn and returns how long it took.
+func timeWrite(t *testing.T, conn net.Conn, n int) time.Duration {
+	t.Helper()
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, n)); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+// TestExemptHandshakeGrace tests that the bytes written during the grace
+// period aren't limited while the ones written afterwards are.
+func TestExemptHandshakeGrace(t *testing.T) {
+	grace := 300 * time.Millisecond
+	rl := NewRateLimit(1000, 1000, 100)
+	conn := NewRLConnExemptHandshakeGrace(newDiscardPipe(), rl, grace, nil)
+	defer conn.Close()
+
+	// At 1000 bytes per second the early write would take a second.
+	if d := timeWrite(t, conn, 1000); d > 100*time.Millisecond {
+		t.Fatal("handshake was limited", d)
+	}
+	if written := rl.Stats().BytesWritten; written != 0 {
+		t.Fatal("handshake was accounted for", written)
+	}
+
+	// After the grace period the writes are limited.
+	time.Sleep(grace)
+	if d := timeWrite(t, conn, 300); d < 200*time.Millisecond {
+		t.Fatal("write after the handshake wasn't limited", d)
+	}
+}
+
+// TestExemptHandshakeState tests that the limits engage once a connection
+// reports the end of its handshake.
+func TestExemptHandshakeState(t *testing.T) {
+	sc := &stateConn{Conn: newDiscardPipe()}
+	conn := NewRLConnExemptHandshakeGrace(sc, NewRateLimit(1000, 1000, 100), time.Hour, nil)
+	defer conn.Close()
+
+	if d := timeWrite(t, conn, 1000); d > 100*time.Millisecond {
+		t.Fatal("handshake was limited", d)
+	}
+	atomic.StoreInt32(&sc.atomicComplete, 1)
+	if d := timeWrite(t, conn, 300); d < 200*time.Millisecond {
+		t.Fatal("write after the handshake wasn't limited", d)
+	}
+
+	// The limits stay engaged.
+	atomic.StoreInt32(&sc.atomicComplete, 0)
+	if d := timeWrite(t, conn, 300); d < 200*time.Millisecond {
+		t.Fatal("limits didn't stay engaged", d)
+	}
+
+	// Without a grace period, the limits engage right away.
+	conn = NewRLConnExemptHandshakeGrace(newDiscardPipe(), NewRateLimit(1000, 1000, 100), 0, nil)
+	defer conn.Close()
+	if d := timeWrite(t, conn, 300); d < 200*time.Millisecond {
+		t.Fatal("write without grace period wasn't limited", d)
+	}
+}
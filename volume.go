@@ -0,0 +1,274 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrVolumeCapExceeded is returned by a non-blocking VolumeCap if a read or
+// write doesn't fit into what is left of the current interval's allowance.
+var ErrVolumeCapExceeded = errors.New("volume cap exceeded")
+
+type (
+	// VolumeCap is a Limiter which caps the number of bytes transferred in
+	// each direction per interval, e.g. to enforce a monthly data cap. Once
+	// the allowance of an interval is used up, reads and writes block until
+	// the next interval starts. Intervals are counted from the creation of
+	// the VolumeCap.
+	VolumeCap struct {
+		read  *volumeWindow
+		write *volumeWindow
+		untracked
+
+		atomicNonBlocking int32
+	}
+
+	// volumeCharge is the interval of a volumeWindow in which a flow was
+	// last charged.
+	volumeCharge struct {
+		vw  *volumeWindow
+		idx int64
+	}
+
+	// volumeWindow is the allowance of a VolumeCap for a single direction.
+	volumeWindow struct {
+		allowance uint64
+		interval  time.Duration
+		clock     Clock
+		origin    time.Time
+
+		mu   sync.Mutex
+		idx  int64  // the index of the current interval.
+		used uint64 // the bytes used within the current interval.
+	}
+)
+
+// NewVolumeCap creates a new VolumeCap which allows for transferring up to
+// bytesPerInterval bytes in each direction within every interval. A
+// bytesPerInterval of 0 means that reads and writes are unlimited. Of the
+// options, only WithClock applies to a VolumeCap.
+func NewVolumeCap(bytesPerInterval uint64, interval time.Duration, opts ...Option) *VolumeCap {
+	o := newOptions(opts)
+	return &VolumeCap{
+		read:  newVolumeWindow(bytesPerInterval, interval, o.clock),
+		write: newVolumeWindow(bytesPerInterval, interval, o.clock),
+	}
+}
+
+// newVolumeWindow creates a new volumeWindow whose first interval starts now.
+func newVolumeWindow(allowance uint64, interval time.Duration, clock Clock) *volumeWindow {
+	if interval <= 0 {
+		interval = 1
+	}
+	return &volumeWindow{
+		allowance: allowance,
+		interval:  interval,
+		clock:     clock,
+		origin:    clock.Now(),
+	}
+}
+
+// SetBlocking sets whether reads and writes block until the next interval once
+// the allowance is used up, which is the default. A non-blocking VolumeCap
+// returns ErrVolumeCapExceeded instead and doesn't count the rejected bytes.
+func (vc *VolumeCap) SetBlocking(blocking bool) {
+	var nonBlocking int32
+	if !blocking {
+		nonBlocking = 1
+	}
+	atomic.StoreInt32(&vc.atomicNonBlocking, nonBlocking)
+}
+
+// WaitRead blocks until n bytes can be read without exceeding the allowance.
+func (vc *VolumeCap) WaitRead(ctx context.Context, n int) error {
+	_, _, err := vc.read.wait(ctx, n, vc.blocking(), nil)
+	return err
+}
+
+// WaitWrite blocks until n bytes can be written without exceeding the
+// allowance.
+func (vc *VolumeCap) WaitWrite(ctx context.Context, n int) error {
+	_, _, err := vc.write.wait(ctx, n, vc.blocking(), nil)
+	return err
+}
+
+// blocking returns whether the VolumeCap blocks once the allowance is used up.
+func (vc *VolumeCap) blocking() bool {
+	return atomic.LoadInt32(&vc.atomicNonBlocking) == 0
+}
+
+// window returns the volumeWindow for the given direction.
+func (vc *VolumeCap) window(dir Direction) *volumeWindow {
+	if dir == DirectionRead {
+		return vc.read
+	}
+	return vc.write
+}
+
+// wait waits until n bytes can be transferred in the given direction as part
+// of flow f without exceeding the allowance.
+func (vc *VolumeCap) wait(ctx context.Context, dir Direction, n int, expired <-chan struct{}, f *flow) (time.Duration, error) {
+	vw := vc.window(dir)
+	waited, idx, err := vw.wait(ctx, n, vc.blocking(), expired)
+	if err == nil {
+		f.charged(vw, idx)
+	}
+	return waited, err
+}
+
+// refund gives n bytes that weren't transferred in the given direction as
+// part of flow f back to the interval in which f was charged for them. If
+// that interval is over, the bytes are gone.
+func (vc *VolumeCap) refund(dir Direction, n int, f *flow) {
+	vw := vc.window(dir)
+	if idx, ok := f.lastCharge(vw); ok && n > 0 {
+		vw.give(idx, uint64(n))
+	}
+}
+
+// try takes n bytes from the allowance of the current interval for the given
+// direction if they fit and returns whether it did.
+func (vc *VolumeCap) try(dir Direction, n int, f *flow) bool {
+	vw := vc.window(dir)
+	_, idx, err := vw.wait(context.Background(), n, false, nil)
+	if err != nil {
+		return false
+	}
+	f.charged(vw, idx)
+	return true
+}
+
+// eta returns how long it takes until n bytes can be transferred in the given
+// direction.
+func (vc *VolumeCap) eta(dir Direction, n int) time.Duration {
+	return vc.window(dir).eta(n)
+}
+
+// wait blocks until n bytes can be transferred without exceeding the
+// allowance and returns how long that took. If n doesn't fit into what is
+// left of the current interval, the rest of the interval's allowance is used
+// up and the remaining bytes are taken from the following intervals. That way
+// transfers larger than the allowance eventually go through while no interval
+// exceeds its allowance. Without blocking, the n bytes either fit into the
+// current interval or an error is returned. If ctx is done or expired is
+// closed before the last interval, ErrDeadlineExceeded or ctx.Err() is
+// returned. Otherwise the index of the interval the last bytes were taken
+// from is returned.
+func (vw *volumeWindow) wait(ctx context.Context, n int, blocking bool, expired <-chan struct{}) (time.Duration, int64, error) {
+	if vw.allowance == 0 || n <= 0 {
+		return 0, 0, nil
+	}
+	start := vw.clock.Now()
+	remaining := uint64(n)
+	for {
+		vw.mu.Lock()
+		now := vw.clock.Now()
+		vw.roll(now)
+		free := vw.allowance - vw.used
+		if !blocking && remaining > free {
+			vw.mu.Unlock()
+			return now.Sub(start), 0, ErrVolumeCapExceeded
+		}
+		taken := remaining
+		if taken > free {
+			taken = free
+		}
+		vw.used += taken
+		remaining -= taken
+		idx := vw.idx
+		next := vw.start(idx + 1)
+		vw.mu.Unlock()
+		if remaining == 0 {
+			return now.Sub(start), idx, nil
+		}
+
+		// Wait for the next interval. Only the bytes taken from the current
+		// interval are given back on cancellation, the ones of past intervals
+		// are gone either way.
+		timer := vw.clock.NewTimer(next.Sub(now))
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			vw.give(idx, taken)
+			return vw.clock.Now().Sub(start), 0, ctx.Err()
+		case <-expired:
+			timer.Stop()
+			vw.give(idx, taken)
+			return vw.clock.Now().Sub(start), 0, ErrDeadlineExceeded
+		}
+	}
+}
+
+// eta returns how long it takes until n bytes can be transferred. Bytes that
+// don't fit into the current interval are taken from the following ones.
+func (vw *volumeWindow) eta(n int) time.Duration {
+	if vw.allowance == 0 || n <= 0 {
+		return 0
+	}
+	vw.mu.Lock()
+	defer vw.mu.Unlock()
+	now := vw.clock.Now()
+	vw.roll(now)
+	free := vw.allowance - vw.used
+	if uint64(n) <= free {
+		return 0
+	}
+	intervals := (uint64(n) - free + vw.allowance - 1) / vw.allowance
+	return vw.start(vw.idx + int64(intervals)).Sub(now)
+}
+
+// give gives n bytes back to the interval with the provided index if it is
+// still the current one. The bytes used by the interval never drop below 0.
+func (vw *volumeWindow) give(idx int64, n uint64) {
+	vw.mu.Lock()
+	defer vw.mu.Unlock()
+	vw.roll(vw.clock.Now())
+	if vw.idx != idx {
+		return
+	}
+	if n > vw.used {
+		vw.used = 0
+	} else {
+		vw.used -= n
+	}
+}
+
+// charged records that the flow was last charged by vw in the interval with
+// the provided index. Charges of a nil flow aren't recorded.
+func (f *flow) charged(vw *volumeWindow, idx int64) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.charge = volumeCharge{vw: vw, idx: idx}
+}
+
+// lastCharge returns the index of the interval in which the flow was last
+// charged by vw. It returns false if there is no such charge.
+func (f *flow) lastCharge(vw *volumeWindow) (int64, bool) {
+	if f == nil {
+		return 0, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.charge.idx, f.charge.vw == vw
+}
+
+// roll resets the used bytes if a new interval started before now. vw.mu must
+// be held by the caller.
+func (vw *volumeWindow) roll(now time.Time) {
+	if idx := int64(now.Sub(vw.origin) / vw.interval); idx > vw.idx {
+		vw.idx = idx
+		vw.used = 0
+	}
+}
+
+// start returns the time at which the interval with the provided index starts.
+func (vw *volumeWindow) start(idx int64) time.Time {
+	return vw.origin.Add(time.Duration(idx) * vw.interval)
+}
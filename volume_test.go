@@ -0,0 +1,245 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// gateWriter is a io.ReadWriter whose writes block until release is closed
+// and then fail.
+type gateWriter struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+// Read implements io.Reader.
+func (gw *gateWriter) Read([]byte) (int, error) { return 0, io.EOF }
+
+// Write implements io.Writer.
+func (gw *gateWriter) Write([]byte) (int, error) {
+	close(gw.entered)
+	<-gw.release
+	return 0, errors.New("write failed")
+}
+
+// TestVolumeCap tests that a VolumeCap blocks once the allowance is used up
+// and unblocks once the next interval starts.
+func TestVolumeCap(t *testing.T) {
+	clock := newFakeClock()
+	interval := time.Hour
+	vc := NewVolumeCap(1000, interval, WithClock(clock))
+	ctx := context.Background()
+
+	// waitBlocked starts waiting for n bytes and makes sure that the wait
+	// blocks.
+	waitBlocked := func(n int) <-chan error {
+		t.Helper()
+		done := make(chan error, 1)
+		go func() {
+			done <- vc.WaitWrite(ctx, n)
+		}()
+		for clock.Pending() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		select {
+		case err := <-done:
+			t.Fatal("wait didn't block", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		return done
+	}
+
+	// The allowance is available right away.
+	if err := vc.WaitWrite(ctx, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once it is used up, writes block until the next interval.
+	done := waitBlocked(1)
+	clock.Advance(interval - time.Second)
+	select {
+	case <-done:
+		t.Fatal("wait didn't block until the next interval")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads have their own allowance.
+	if err := vc.WaitRead(ctx, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	// A write that rolls over into the next interval uses up the current one
+	// and takes the rest from the next one.
+	if err := vc.WaitWrite(ctx, 699); err != nil {
+		t.Fatal(err)
+	}
+	done = waitBlocked(500)
+	if vc.write.used != 1000 {
+		t.Fatal("rest of the interval wasn't used", vc.write.used)
+	}
+	clock.Advance(interval)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if vc.write.used != 200 {
+		t.Fatal("wrong usage of the next interval", vc.write.used)
+	}
+
+	// A write larger than the allowance is spread across multiple intervals.
+	clock.Advance(interval)
+	done = waitBlocked(2500)
+	for i := 0; i < 2; i++ {
+		clock.Advance(interval)
+		for clock.Pending() == 0 && len(done) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if vc.write.used != 500 {
+		t.Fatal("wrong usage of the last interval", vc.write.used)
+	}
+
+	// Canceled waits give back what they took from the current interval.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- vc.WaitWrite(cancelCtx, 1000)
+	}()
+	for clock.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatal("expected context.Canceled but got", err)
+	}
+	if vc.write.used != 500 {
+		t.Fatal("canceled wait wasn't given back", vc.write.used)
+	}
+}
+
+// TestVolumeCapNonBlocking tests that a non-blocking VolumeCap returns an
+// error once the allowance is used up.
+func TestVolumeCapNonBlocking(t *testing.T) {
+	clock := newFakeClock()
+	vc := NewVolumeCap(1000, time.Hour, WithClock(clock))
+	vc.SetBlocking(false)
+	rlc := NewRLReadWriter(bytes.NewBuffer(nil), vc, nil)
+
+	if _, err := rlc.Write(make([]byte, 600)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rlc.Write(make([]byte, 600)); !errors.Is(err, ErrVolumeCapExceeded) {
+		t.Fatal("expected ErrVolumeCapExceeded but got", err)
+	}
+
+	// The rejected write didn't count and writes larger than the allowance
+	// are never allowed.
+	if _, err := rlc.Write(make([]byte, 400)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	if _, err := rlc.Write(make([]byte, 1001)); !errors.Is(err, ErrVolumeCapExceeded) {
+		t.Fatal("expected ErrVolumeCapExceeded but got", err)
+	}
+
+	// Blocking can be turned back on and an allowance of 0 is unlimited.
+	vc.SetBlocking(true)
+	if !vc.blocking() {
+		t.Fatal("VolumeCap should block")
+	}
+	if err := NewVolumeCap(0, time.Hour).WaitWrite(context.Background(), 1<<30); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestVolumeCapShortRead tests that a VolumeCap only counts the bytes that
+// were actually read and knows when the allowance is available again.
+func TestVolumeCapShortRead(t *testing.T) {
+	clock := newFakeClock()
+	vc := NewVolumeCap(1000, time.Hour, WithClock(clock))
+	cr := &chunkReader{chunk: 50}
+	cr.Write(make([]byte, 100))
+	rlc := NewRLReadWriter(cr, vc, nil)
+
+	if n, err := rlc.Read(make([]byte, 500)); err != nil || n != cr.chunk {
+		t.Fatal("unexpected read", n, err)
+	}
+	if vc.read.used != 50 {
+		t.Fatal("wrong usage after short read", vc.read.used)
+	}
+
+	// The rest of the allowance is available right away, more than that
+	// once the following intervals start.
+	if d := vc.eta(DirectionRead, 950); d != 0 {
+		t.Fatal("wrong eta", d)
+	}
+	if d := vc.eta(DirectionRead, 951); d != time.Hour {
+		t.Fatal("wrong eta", d)
+	}
+	if d := vc.eta(DirectionRead, 2951); d != 3*time.Hour {
+		t.Fatal("wrong eta", d)
+	}
+}
+
+// TestVolumeCapRefundCancel tests that refunds only go to the interval that
+// was charged and that giving back bytes never exceeds the allowance.
+func TestVolumeCapRefundCancel(t *testing.T) {
+	clock := newFakeClock()
+	interval := time.Hour
+	vc := NewVolumeCap(1000, interval, WithClock(clock))
+
+	// A write is charged in the first interval but only fails in the second
+	// one.
+	gw := &gateWriter{entered: make(chan struct{}), release: make(chan struct{})}
+	rlc := NewRLReadWriter(gw, vc, nil)
+	failed := make(chan error, 1)
+	go func() {
+		_, err := rlc.Write(make([]byte, 300))
+		failed <- err
+	}()
+	<-gw.entered
+	clock.Advance(interval)
+
+	// Meanwhile a waiter uses up the second interval.
+	ctx, cancel := context.WithCancel(context.Background())
+	waited := make(chan error, 1)
+	go func() {
+		waited <- vc.WaitWrite(ctx, 1500)
+	}()
+	for clock.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The failed write's refund belongs to the first interval and is
+	// dropped.
+	close(gw.release)
+	if err := <-failed; err == nil {
+		t.Fatal("write should fail")
+	}
+	if vc.write.used != 1000 {
+		t.Fatal("refund was credited to the wrong interval", vc.write.used)
+	}
+
+	// Canceling the waiter gives back what it took without wrapping around.
+	cancel()
+	if err := <-waited; !errors.Is(err, context.Canceled) {
+		t.Fatal("expected context.Canceled but got", err)
+	}
+	if vc.write.used != 0 {
+		t.Fatal("wrong usage after cancellation", vc.write.used)
+	}
+	vc.SetBlocking(false)
+	if err := vc.WaitWrite(context.Background(), 1001); !errors.Is(err, ErrVolumeCapExceeded) {
+		t.Fatal("allowance was exceeded", err)
+	}
+}
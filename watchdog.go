@@ -0,0 +1,32 @@
+package ratelimit
+
+import (
+	"time"
+
+	"github.com/uplo-tech/log"
+)
+
+// watchdog logs a warning whenever a single wait for a RateLimit takes longer
+// than a threshold. It is purely diagnostic and doesn't affect the wait.
+type watchdog struct {
+	threshold time.Duration
+	logger    *log.Logger
+}
+
+// watch starts watching a wait of n bytes in the given direction for rl. The
+// returned function needs to be called once the wait is over.
+func (w *watchdog) watch(rl *RateLimit, dir Direction, n int) func() {
+	timer := rl.clock.NewTimer(w.threshold)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-timer.C():
+			w.logger.Printf("WARN: %v of %v bytes blocked by RateLimit %q for more than %v", dir, n, rl.Name(), w.threshold)
+		case <-done:
+		}
+	}()
+	return func() {
+		timer.Stop()
+		close(done)
+	}
+}
@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/log"
+)
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// Write implements io.Writer.
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// String returns the contents of the buffer.
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestWatchdog tests that waits exceeding the threshold of the watchdog are
+// logged while they are still waiting.
+func TestWatchdog(t *testing.T) {
+	clock := newFakeClock()
+	buf := &syncBuffer{}
+	logger, err := log.NewLogger(buf, log.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := NewRateLimitWithOptions(WithWriteBPS(1000), WithClock(clock), WithName("test"), WithWatchdog(time.Second, logger))
+
+	// A wait below the threshold isn't logged.
+	rl.ReserveWrite(500)
+	done := make(chan error)
+	go func() {
+		done <- rl.WaitWrite(context.Background(), 100)
+	}()
+	for clock.Pending() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(500 * time.Millisecond)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// A wait above the threshold is logged once it crosses the threshold.
+	rl.ReserveWrite(5000)
+	go func() {
+		done <- rl.WaitWrite(context.Background(), 100)
+	}()
+	for clock.Pending() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(2 * time.Second)
+	for start := time.Now(); !strings.Contains(buf.String(), "WARN"); {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("wait wasn't logged")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("watchdog affected the wait")
+	default:
+	}
+	clock.Advance(4 * time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	logged := buf.String()
+	if strings.Count(logged, "\n") != 1 || !strings.Contains(logged, `write of 100 bytes blocked by RateLimit "test"`) {
+		t.Fatal("wrong log", logged)
+	}
+}
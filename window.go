@@ -0,0 +1,293 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// windowSlots is the number of slots a sliding window is divided into. The
+// bytes transferred within a slot are accounted for together which keeps the
+// memory of a sliding window constant.
+const windowSlots = 32
+
+type (
+	// SlidingWindowLimiter is a Limiter which makes sure that no more than a
+	// fixed number of bytes are transferred in each direction within any
+	// window of a fixed duration.
+	SlidingWindowLimiter struct {
+		read  *slidingWindow
+		write *slidingWindow
+		untracked
+	}
+
+	// slidingWindow is the window of a SlidingWindowLimiter for a single
+	// direction. The bytes of a slot count towards the window until a full
+	// window has passed since the end of the slot.
+	slidingWindow struct {
+		maxBytes uint64
+		window   time.Duration
+		slotDur  time.Duration
+		clock    Clock
+		origin   time.Time
+
+		mu    sync.Mutex
+		slots [windowSlots + 2]windowSlot
+	}
+
+	// windowSlot contains the bytes that were transferred within a slot.
+	windowSlot struct {
+		idx   int64
+		bytes uint64
+	}
+)
+
+// NewSlidingWindowLimiter creates a new SlidingWindowLimiter which allows for
+// transferring up to maxBytes in each direction within any window of the
+// provided duration. Reads and writes of more than maxBytes are split up into
+// chunks of up to maxBytes. A maxBytes of 0 means that reads and writes are
+// unlimited.
+func NewSlidingWindowLimiter(maxBytes uint64, window time.Duration) *SlidingWindowLimiter {
+	return &SlidingWindowLimiter{
+		read:  newSlidingWindow(maxBytes, window, realClock{}),
+		write: newSlidingWindow(maxBytes, window, realClock{}),
+	}
+}
+
+// newSlidingWindow creates a new, empty slidingWindow.
+func newSlidingWindow(maxBytes uint64, window time.Duration, clock Clock) *slidingWindow {
+	slotDur := window / windowSlots
+	if slotDur <= 0 {
+		slotDur = 1
+	}
+	sw := &slidingWindow{
+		maxBytes: maxBytes,
+		window:   window,
+		slotDur:  slotDur,
+		clock:    clock,
+		origin:   clock.Now(),
+	}
+	for i := range sw.slots {
+		sw.slots[i].idx = -1
+	}
+	return sw
+}
+
+// PacketSize returns the maximum number of bytes within a window. Reads and
+// writes of a RLReadWriter are split up into packets that fit into a window.
+func (l *SlidingWindowLimiter) PacketSize() uint64 {
+	return l.read.maxBytes
+}
+
+// WaitRead blocks until n bytes can be read without exceeding the window.
+func (l *SlidingWindowLimiter) WaitRead(ctx context.Context, n int) error {
+	_, err := l.read.wait(ctx, n, nil)
+	return err
+}
+
+// WaitWrite blocks until n bytes can be written without exceeding the window.
+func (l *SlidingWindowLimiter) WaitWrite(ctx context.Context, n int) error {
+	_, err := l.write.wait(ctx, n, nil)
+	return err
+}
+
+// window returns the slidingWindow for the given direction.
+func (l *SlidingWindowLimiter) window(dir Direction) *slidingWindow {
+	if dir == DirectionRead {
+		return l.read
+	}
+	return l.write
+}
+
+// wait waits until n bytes can be transferred in the given direction without
+// exceeding the window.
+func (l *SlidingWindowLimiter) wait(ctx context.Context, dir Direction, n int, expired <-chan struct{}, _ *flow) (time.Duration, error) {
+	return l.window(dir).wait(ctx, n, expired)
+}
+
+// refund removes n bytes that weren't transferred from the window for the
+// given direction.
+func (l *SlidingWindowLimiter) refund(dir Direction, n int, _ *flow) {
+	l.window(dir).refund(n)
+}
+
+// try adds n bytes to the window for the given direction if they fit right
+// away and returns whether it did.
+func (l *SlidingWindowLimiter) try(dir Direction, n int, _ *flow) bool {
+	return l.window(dir).try(n)
+}
+
+// eta returns how long it takes until n bytes can be transferred in the given
+// direction without exceeding the window.
+func (l *SlidingWindowLimiter) eta(dir Direction, n int) time.Duration {
+	return l.window(dir).eta(n)
+}
+
+// wait blocks until n bytes can be transferred without exceeding the window
+// and returns how long that took. More than maxBytes are admitted in chunks of
+// maxBytes, each of which waits for the window to have room. If ctx is done or
+// expired is closed before all chunks are admitted, the admitted chunks are
+// removed from the window again.
+func (sw *slidingWindow) wait(ctx context.Context, n int, expired <-chan struct{}) (time.Duration, error) {
+	if sw.maxBytes == 0 || n <= 0 {
+		return 0, nil
+	}
+	start := sw.clock.Now()
+	for remaining := uint64(n); remaining > 0; {
+		chunk := remaining
+		if chunk > sw.maxBytes {
+			chunk = sw.maxBytes
+		}
+		sw.mu.Lock()
+		now := sw.clock.Now()
+		ok, retry := sw.admit(now, chunk)
+		sw.mu.Unlock()
+		if ok {
+			remaining -= chunk
+			continue
+		}
+
+		timer := sw.clock.NewTimer(retry.Sub(now))
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			sw.refund(n - int(remaining))
+			return sw.clock.Now().Sub(start), ctx.Err()
+		case <-expired:
+			timer.Stop()
+			sw.refund(n - int(remaining))
+			return sw.clock.Now().Sub(start), ErrDeadlineExceeded
+		}
+	}
+	return sw.clock.Now().Sub(start), nil
+}
+
+// try adds n bytes to the window if they fit right away and returns whether
+// it did. More than maxBytes never fit.
+func (sw *slidingWindow) try(n int) bool {
+	if sw.maxBytes == 0 || n <= 0 {
+		return true
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	ok, _ := sw.admit(sw.clock.Now(), uint64(n))
+	return ok
+}
+
+// eta returns how long it takes until n bytes can be transferred without
+// exceeding the window. Every chunk of maxBytes after the first one takes
+// another window.
+func (sw *slidingWindow) eta(n int) time.Duration {
+	if sw.maxBytes == 0 || n <= 0 {
+		return 0
+	}
+	chunk := uint64(n)
+	var d time.Duration
+	if chunk > sw.maxBytes {
+		d = time.Duration((chunk-1)/sw.maxBytes) * sw.window
+		chunk = sw.maxBytes
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	now := sw.clock.Now()
+	if ok, retry := sw.fits(now, chunk); !ok {
+		d += retry.Sub(now)
+	}
+	return d
+}
+
+// refund removes n bytes that weren't transferred from the window. They are
+// taken from the oldest slots first. Any window that contains one of these
+// slots and is still relevant for future transfers also contains the slot
+// the bytes were added to, so the window never ends up exceeding maxBytes.
+func (sw *slidingWindow) refund(n int) {
+	if sw.maxBytes == 0 || n <= 0 {
+		return
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	now := sw.clock.Now()
+	cur := sw.slotIndex(now)
+	remaining := uint64(n)
+	for idx := cur - int64(len(sw.slots)) + 1; idx <= cur && remaining > 0; idx++ {
+		if idx < 0 {
+			continue
+		}
+		s := &sw.slots[idx%int64(len(sw.slots))]
+		if s.idx != idx || !sw.expiry(idx).After(now) {
+			continue
+		}
+		taken := s.bytes
+		if taken > remaining {
+			taken = remaining
+		}
+		s.bytes -= taken
+		remaining -= taken
+	}
+}
+
+// admit adds n bytes to the window if they fit at the provided time.
+// Otherwise it returns the time at which enough bytes will have left the
+// window. More than maxBytes never fit and the returned time is zero.
+// sw.mu must be held by the caller.
+func (sw *slidingWindow) admit(now time.Time, n uint64) (bool, time.Time) {
+	ok, retry := sw.fits(now, n)
+	if !ok {
+		return false, retry
+	}
+	cur := sw.slotIndex(now)
+	s := &sw.slots[cur%int64(len(sw.slots))]
+	if s.idx != cur {
+		*s = windowSlot{idx: cur}
+	}
+	s.bytes += n
+	return true, time.Time{}
+}
+
+// fits returns whether n bytes fit into the window at the provided time.
+// Otherwise it returns the time at which enough bytes will have left the
+// window. More than maxBytes never fit and the returned time is zero.
+// sw.mu must be held by the caller.
+func (sw *slidingWindow) fits(now time.Time, n uint64) (bool, time.Time) {
+	cur := sw.slotIndex(now)
+	var used uint64
+	for _, s := range sw.slots {
+		if s.idx >= 0 && sw.expiry(s.idx).After(now) {
+			used += s.bytes
+		}
+	}
+	if n > sw.maxBytes {
+		return false, time.Time{}
+	}
+	if used+n <= sw.maxBytes {
+		return true, time.Time{}
+	}
+
+	// Find the slot which needs to leave the window to make room.
+	need := used + n - sw.maxBytes
+	var freed uint64
+	for idx := cur - int64(len(sw.slots)) + 1; idx <= cur; idx++ {
+		if idx < 0 {
+			continue
+		}
+		s := sw.slots[idx%int64(len(sw.slots))]
+		if s.idx != idx || !sw.expiry(idx).After(now) {
+			continue
+		}
+		if freed += s.bytes; freed >= need {
+			return false, sw.expiry(idx)
+		}
+	}
+	return false, sw.expiry(cur)
+}
+
+// slotIndex returns the index of the slot t falls into.
+func (sw *slidingWindow) slotIndex(t time.Time) int64 {
+	return int64(t.Sub(sw.origin) / sw.slotDur)
+}
+
+// expiry returns the time at which the bytes of a slot leave the window.
+func (sw *slidingWindow) expiry(idx int64) time.Time {
+	return sw.origin.Add(time.Duration(idx+1)*sw.slotDur + sw.window)
+}
@@ -0,0 +1,210 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/uplo-tech/fastrand"
+)
+
+// admission is a single transfer admitted by a slidingWindow.
+type admission struct {
+	t time.Time
+	n uint64
+}
+
+// checkWindow checks that no window of the provided duration contains more
+// than maxBytes.
+func checkWindow(t *testing.T, admissions []admission, maxBytes uint64, window time.Duration) {
+	t.Helper()
+	var sum uint64
+	start := 0
+	for i, a := range admissions {
+		if a.n > maxBytes {
+			t.Fatalf("admission %v has %v bytes", i, a.n)
+		}
+		// Drop the admissions that left the window.
+		sum += a.n
+		for a.t.Sub(admissions[start].t) >= window {
+			sum -= admissions[start].n
+			start++
+		}
+		if sum > maxBytes {
+			t.Fatalf("window ending at admission %v contains %v bytes", i, sum)
+		}
+	}
+}
+
+// TestSlidingWindowInvariant tests that a slidingWindow never admits more
+// than maxBytes within any window.
+func TestSlidingWindowInvariant(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes uint64
+		window   time.Duration
+		size     func() uint64
+		gap      func() time.Duration
+	}{
+		{"steady", 1000, time.Second, func() uint64 { return 100 }, func() time.Duration { return 10 * time.Millisecond }},
+		{"bursty", 1000, time.Second, func() uint64 { return uint64(fastrand.Intn(300) + 1) }, func() time.Duration {
+			if fastrand.Intn(10) == 0 {
+				return time.Duration(fastrand.Intn(2000)) * time.Millisecond
+			}
+			return 0
+		}},
+		{"tiny window", 100, time.Millisecond, func() uint64 { return 100 }, func() time.Duration { return 0 }},
+		{"high throughput", 1 << 30, time.Second, func() uint64 { return 1 << 10 }, func() time.Duration { return time.Microsecond }},
+	}
+	for _, test := range tests {
+		clock := newFakeClock()
+		sw := newSlidingWindow(test.maxBytes, test.window, clock)
+		var admissions []admission
+		for i := 0; i < 10000; i++ {
+			clock.Advance(test.gap())
+			n := test.size()
+			for {
+				ok, retry := sw.admit(clock.Now(), n)
+				if ok {
+					break
+				}
+				if !retry.After(clock.Now()) {
+					t.Fatalf("%v: retry isn't in the future", test.name)
+				}
+				clock.Advance(retry.Sub(clock.Now()))
+			}
+			admissions = append(admissions, admission{clock.Now(), n})
+		}
+		checkWindow(t, admissions, test.maxBytes, test.window)
+	}
+}
+
+// TestSlidingWindowLimiter tests that a SlidingWindowLimiter blocks until the
+// window has room.
+func TestSlidingWindowLimiter(t *testing.T) {
+	window := 200 * time.Millisecond
+	l := NewSlidingWindowLimiter(1000, window)
+	rlc := NewRLReadWriter(bytes.NewBuffer(nil), l, nil)
+
+	// A full window is written right away.
+	start := time.Now()
+	if _, err := rlc.Write(fastrand.Bytes(1000)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatal("write took too long", d)
+	}
+
+	// The next write needs to wait for the window to pass.
+	if _, err := rlc.Write(fastrand.Bytes(1)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < window {
+		t.Fatal("write didn't wait for the window", d)
+	}
+
+	// Waiting can be cancelled.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.WaitWrite(ctx, 1000); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected context.DeadlineExceeded but got", err)
+	}
+
+	// Reads use their own window and a maxBytes of 0 is unlimited.
+	if err := l.WaitRead(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewSlidingWindowLimiter(0, window).WaitWrite(context.Background(), 1<<30); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSlidingWindowLarge tests that reads and writes larger than the window
+// are split up into chunks that fit into the window.
+func TestSlidingWindowLarge(t *testing.T) {
+	window := 200 * time.Millisecond
+	maxBytes := uint64(1000)
+
+	// A single admission never exceeds the window.
+	sw := newSlidingWindow(maxBytes, window, newFakeClock())
+	if ok, _ := sw.admit(sw.clock.Now(), maxBytes+1); ok {
+		t.Fatal("admitted more than maxBytes at once")
+	}
+
+	// A write of 2.5 windows takes two windows to complete.
+	l := NewSlidingWindowLimiter(maxBytes, window)
+	spy := &spyReadWriter{}
+	start := time.Now()
+	if _, err := NewRLReadWriter(spy, l, nil).Write(make([]byte, 2500)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 2*window || d > 2*window+150*time.Millisecond {
+		t.Fatal("write wasn't split up", d)
+	}
+
+	// So does a single call to WaitRead.
+	start = time.Now()
+	if err := l.WaitRead(context.Background(), 2500); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 2*window || d > 2*window+150*time.Millisecond {
+		t.Fatal("wait wasn't split up", d)
+	}
+}
+
+// TestSlidingWindowShortRead tests that bytes which weren't read are removed
+// from the window again.
+func TestSlidingWindowShortRead(t *testing.T) {
+	window := 200 * time.Millisecond
+	maxBytes := uint64(1000)
+	l := NewSlidingWindowLimiter(maxBytes, window)
+	cr := &chunkReader{chunk: 50}
+	cr.Write(fastrand.Bytes(100))
+	rlc := NewRLReadWriter(cr, l, nil)
+
+	// A read returning 50 bytes leaves room for another 950 bytes.
+	n, err := rlc.Read(make([]byte, 500))
+	if err != nil || n != cr.chunk {
+		t.Fatal("unexpected read", n, err)
+	}
+	if d := l.eta(DirectionRead, 950); d > 0 {
+		t.Fatal("window was charged for the whole buffer", d)
+	}
+	if d := l.eta(DirectionRead, int(maxBytes)); d <= 0 || d > window+window/windowSlots {
+		t.Fatal("window wasn't charged for the read bytes", d)
+	}
+}
+
+// TestSlidingWindowTryWrite tests that TryWrite and drop mode don't wait for
+// a SlidingWindowLimiter.
+func TestSlidingWindowTryWrite(t *testing.T) {
+	window := 200 * time.Millisecond
+	maxBytes := uint64(1000)
+	l := NewSlidingWindowLimiter(maxBytes, window)
+
+	// The first write fills the window, the second one doesn't fit.
+	buf := bytes.NewBuffer(nil)
+	rlc := NewRLReadWriter(buf, l, nil)
+	if n, _, err := rlc.TryWrite(make([]byte, maxBytes)); err != nil || n != int(maxBytes) {
+		t.Fatal("write should fit into the window", n, err)
+	}
+	start := time.Now()
+	n, retryAfter, err := rlc.TryWrite(make([]byte, 100))
+	if err != ErrDropped || n != 0 {
+		t.Fatal("expected ErrDropped", n, err)
+	}
+	if retryAfter <= 0 || retryAfter > window+window/windowSlots {
+		t.Fatal("wrong retry after", retryAfter)
+	}
+
+	// Drop mode doesn't wait either.
+	drop := NewRLReadWriterDrop(buf, l, nil)
+	if n, err := drop.Write(make([]byte, 100)); err != ErrDropped || n != 0 {
+		t.Fatal("expected ErrDropped", n, err)
+	}
+	if d := time.Since(start); d > window/2 {
+		t.Fatal("writes waited for the window", d)
+	}
+}